@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const adminUser = "admin"
+
+// requireAdmin protects a handler with HTTP basic auth against
+// ADMIN_PASSWORD. Without a password the admin pages don't exist.
+func (app *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.adminPassword == "" {
+			http.NotFound(w, r)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(adminUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(app.adminPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="BananaVerse admin", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// moderationHandler shows the gallery submissions waiting for review.
+func (app *App) moderationHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := app.store.ListGallery(GalleryPending)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list moderation queue", "err", err)
+		http.Error(w, "Failed to load moderation queue", http.StatusInternalServerError)
+		return
+	}
+	if err := app.templates.ExecuteTemplate(w, "moderation.html", app.galleryViews(pending)); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Template error", "template", "moderation.html", "err", err)
+	}
+}
+
+// moderateHandler approves or rejects a submission and replaces its entry in
+// the queue with the outcome.
+func (app *App) moderateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var status string
+	switch r.PathValue("action") {
+	case "approve":
+		status = GalleryApproved
+	case "reject":
+		status = GalleryRejected
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	entry, err := app.store.GetGalleryEntry(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	entry.Status = status
+	entry.Reviewed = time.Now()
+	if err := app.store.UpdateGalleryEntry(entry); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to moderate gallery entry", "share_id", entry.ShareID, "err", err)
+		http.Error(w, "Failed to save decision", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Gallery entry moderated", "share_id", entry.ShareID, "status", status)
+
+	app.renderPartial(w, "moderation-result", entry)
+}
+
+// dashboardWindow is how far back the dashboard's usage and cost totals
+// go. The job list shows the most recent dashboardJobs of them.
+const (
+	dashboardWindow = 7 * 24 * time.Hour
+	dashboardJobs   = 100
+)
+
+// modelUsage totals the calls made to one model.
+type modelUsage struct {
+	Model        string
+	Calls        int
+	Failures     int
+	InputTokens  int64
+	OutputTokens int64
+	Cost         float64
+}
+
+// kindUsage is the space taken by one kind of upload.
+type kindUsage struct {
+	Kind  string
+	Files int
+	Bytes int64
+}
+
+func (k *kindUsage) Size() string {
+	return formatBytes(k.Bytes)
+}
+
+// formatBytes renders n in the largest unit that keeps it at least 1.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// adminPage is the data for admin.html.
+type adminPage struct {
+	Since         time.Time
+	FailedOnly    bool
+	Jobs          []*Job
+	JobCount      int
+	FailedCount   int
+	Usage         []*modelUsage
+	TotalCost     float64
+	Storage       []*kindUsage
+	UploadBytes   int64
+	DatabaseBytes int64
+	PendingReview int
+	Bans          []*Ban
+}
+
+func (p *adminPage) UploadSize() string   { return formatBytes(p.UploadBytes) }
+func (p *adminPage) DatabaseSize() string { return formatBytes(p.DatabaseBytes) }
+
+// adminDashboardHandler shows recent jobs, model usage and cost, storage and
+// the moderation queue.
+func (app *App) adminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	page := adminPage{
+		Since:         time.Now().Add(-dashboardWindow),
+		FailedOnly:    r.URL.Query().Get("failed") != "",
+		DatabaseBytes: app.store.Size(),
+	}
+
+	jobs, err := app.store.ListJobs(page.Since)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list jobs", "err", err)
+		http.Error(w, "Failed to load jobs", http.StatusInternalServerError)
+		return
+	}
+	page.JobCount = len(jobs)
+	usage := map[string]*modelUsage{}
+	for _, job := range jobs {
+		if job.Failed() {
+			page.FailedCount++
+		}
+		if (!page.FailedOnly || job.Failed()) && len(page.Jobs) < dashboardJobs {
+			page.Jobs = append(page.Jobs, job)
+		}
+		for _, s := range job.Stages {
+			u := usage[s.Model]
+			if u == nil {
+				u = &modelUsage{Model: s.Model}
+				usage[s.Model] = u
+				page.Usage = append(page.Usage, u)
+			}
+			u.Calls++
+			if s.Outcome != OutcomeSuccess {
+				u.Failures++
+			}
+			u.InputTokens += int64(s.InputTokens)
+			u.OutputTokens += int64(s.OutputTokens)
+			u.Cost += s.Cost()
+			page.TotalCost += s.Cost()
+		}
+	}
+	sort.Slice(page.Usage, func(i, j int) bool { return page.Usage[i].Model < page.Usage[j].Model })
+
+	if page.Storage, err = uploadsUsage(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to measure uploads", "err", err)
+	}
+	for _, k := range page.Storage {
+		page.UploadBytes += k.Bytes
+	}
+
+	pending, err := app.store.ListGallery(GalleryPending)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list moderation queue", "err", err)
+	}
+	page.PendingReview = len(pending)
+
+	if page.Bans, err = app.store.ListBans(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list bans", "err", err)
+	}
+
+	if err := app.templates.ExecuteTemplate(w, "admin.html", &page); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Template error", "template", "admin.html", "err", err)
+	}
+}
+
+// uploadsUsage adds up the files in static/uploads by asset kind, which
+// saveAsset puts at the start of each filename.
+func uploadsUsage() ([]*kindUsage, error) {
+	entries, err := os.ReadDir("static/uploads")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	byKind := map[string]*kindUsage{}
+	var kinds []*kindUsage
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		kind, _, ok := strings.Cut(e.Name(), "_")
+		if !ok {
+			kind = "other"
+		}
+		k := byKind[kind]
+		if k == nil {
+			k = &kindUsage{Kind: kind}
+			byKind[kind] = k
+			kinds = append(kinds, k)
+		}
+		k.Files++
+		k.Bytes += info.Size()
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Bytes > kinds[j].Bytes })
+	return kinds, nil
+}
+
+// adminRetryHandler runs a failed job again and reports how it went.
+func (app *App) adminRetryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	old, err := app.store.GetJob(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	job, err := app.retryJob(r.Context(), old)
+	if err != nil {
+		app.renderPartial(w, "admin-result", "❌ "+err.Error())
+		return
+	}
+	slog.InfoContext(r.Context(), "Job retried", "job_id", old.ID, "retry_id", job.ID, "failed", job.Failed())
+	if job.Failed() {
+		app.renderPartial(w, "admin-result", "❌ Retry failed: "+job.Error)
+		return
+	}
+	app.renderPartial(w, "admin-result", "✅ Retry succeeded")
+}
+
+// adminPurgeHandler deletes an asset and its file, taking down any share
+// pages and removing any comic panels that show it.
+func (app *App) adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	// Like the sweeper, never delete a file a request is still reading
+	if !app.leases.claim(id) {
+		w.WriteHeader(http.StatusConflict)
+		app.renderPartial(w, "admin-result", "⏳ In use, try again")
+		return
+	}
+	defer app.leases.unclaim(id)
+
+	purge, err := app.store.PurgeAsset(id)
+	if errors.Is(err, ErrNotFound) {
+		app.renderPartial(w, "admin-result", "Already purged")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to purge asset", "asset_id", id, "err", err)
+		http.Error(w, "Failed to purge asset", http.StatusInternalServerError)
+		return
+	}
+	asset := purge.Asset
+	path := filepath.Join("static", "uploads", filepath.Base(asset.Filename))
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.ErrorContext(r.Context(), "Failed to delete purged asset file", "asset_id", asset.ID, "err", err)
+	}
+	slog.InfoContext(r.Context(), "Asset purged", "asset_id", asset.ID, "kind", asset.Kind, "panels", purge.Panels, "shares", purge.Shares)
+	app.renderPartial(w, "admin-result", fmt.Sprintf("🗑️ Purged (%d panels, %d shares removed)", purge.Panels, purge.Shares))
+}
+
+// adminBanHandler bans or unbans a session.
+func (app *App) adminBanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := r.PathValue("id")
+	var err error
+	var result string
+	switch r.PathValue("action") {
+	case "ban":
+		err = app.store.BanSession(&Ban{Session: session, Created: time.Now()})
+		result = "🚫 Banned"
+	case "unban":
+		err = app.store.UnbanSession(session)
+		result = "✅ Unbanned"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update ban", "action", r.PathValue("action"), "err", err)
+		http.Error(w, "Failed to save ban", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Session ban updated", "action", r.PathValue("action"), "session", session)
+	app.renderPartial(w, "admin-result", result)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeAsset(t *testing.T) {
+	app := testApp(t)
+	figurine := &Asset{ID: newID(), Kind: AssetFigurine, Owner: "alice", Filename: "missing-figurine.png"}
+	panel := &Asset{ID: newID(), Kind: AssetPanel, Owner: "alice", Filename: "missing-panel.png"}
+	for _, a := range []*Asset{figurine, panel} {
+		if err := app.store.PutAsset(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comic := &Comic{ID: newID(), Owner: "alice", Title: "Banana Quest", Created: time.Now()}
+	if err := app.store.CreateComic(comic); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*Panel{
+		{ID: "shows", ComicID: comic.ID, ComposedID: panel.ID},
+		{ID: "made-from", ComicID: comic.ID, FigurineID: panel.ID, ComposedID: "other"},
+		{ID: "unrelated", ComicID: comic.ID, FigurineID: figurine.ID, ComposedID: "other"},
+	} {
+		if err := app.store.AddPanel(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	share := &Share{ID: newID(), Owner: "alice", Kind: ShareAsset, TargetID: panel.ID, AssetIDs: []string{panel.ID}}
+	if err := app.store.CreateShare(share); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.store.SubmitToGallery(&GalleryEntry{ShareID: share.ID, Status: GalleryPending}); err != nil {
+		t.Fatal(err)
+	}
+
+	purge := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/assets/"+id+"/purge", nil)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		app.adminPurgeHandler(w, r)
+		return w
+	}
+
+	// A purge waits for readers rather than pulling the file from under them
+	if !app.leases.acquire(panel.ID) {
+		t.Fatal("couldn't lease the panel")
+	}
+	if w := purge(panel.ID); w.Code != http.StatusConflict {
+		t.Errorf("purging a leased asset: status %d", w.Code)
+	}
+	if _, err := app.store.GetAsset(panel.ID); err != nil {
+		t.Errorf("leased asset was purged: %v", err)
+	}
+	app.leases.release(panel.ID)
+
+	w := purge(panel.ID)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "1 panels, 1 shares") {
+		t.Fatalf("purge: status %d: %s", w.Code, w.Body)
+	}
+	if !app.leases.acquire(panel.ID) {
+		t.Error("purge left the asset claimed")
+	}
+	app.leases.release(panel.ID)
+	if _, err := app.store.GetAsset(panel.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("purged asset: %v", err)
+	}
+	if _, err := app.store.GetShare(share.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("share of purged asset: %v", err)
+	}
+	if _, err := app.store.GetGalleryEntry(share.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("gallery entry of purged asset: %v", err)
+	}
+	if app.store.IsPublic(panel.ID) {
+		t.Error("purged asset still public")
+	}
+	panels, err := app.store.Panels(comic.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(panels) != 2 || panels[0].ID != "made-from" || panels[1].ID != "unrelated" {
+		t.Fatalf("panels after purge: %v", panelIDs(t, app.store, comic.ID))
+	}
+	if panels[0].FigurineID != "" || panels[0].ComposedID != "other" {
+		t.Errorf("panel made from the asset: %+v", panels[0])
+	}
+	if panels[1].FigurineID != figurine.ID {
+		t.Errorf("unrelated panel changed: %+v", panels[1])
+	}
+
+	if w := purge(panel.ID); !strings.Contains(w.Body.String(), "Already purged") {
+		t.Errorf("purging twice: %s", w.Body)
+	}
+}
+
+func TestBannedSessionCannotGenerate(t *testing.T) {
+	app := testApp(t)
+	if err := app.store.BanSession(&Ban{Session: "spammer"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := app.withSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string]int{"/": http.StatusOK, "/hx/scene": http.StatusForbidden, "/api/comics": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "spammer." + app.signSession("spammer")})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: got status %d, want %d", path, w.Code, want)
+		}
+	}
+}
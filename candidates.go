@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// maxCandidates caps how many images one request may ask to choose from.
+// Each is a full image generation, billed as one.
+const maxCandidates = 4
+
+// candidateGrace is how long the slower candidates get once the first is
+// back. Whatever hasn't arrived by then is cancelled, so asking for more
+// options never makes the user wait much longer than for one. It is a
+// variable so tests can shorten it.
+var candidateGrace = 30 * time.Second
+
+// candidateTargets are the containers the picker and the chosen image are
+// swapped into, by stage.
+var candidateTargets = map[string]string{
+	StageFigurine: "#figurine-container",
+	StageScene:    "#scene-container",
+}
+
+// candidateView is what the candidates partial renders.
+type candidateView struct {
+	BatchID    string
+	Target     string
+	Candidates []*Asset
+}
+
+// parseCandidates reads the candidates form field: how many images to
+// generate for the user to choose from. It defaults to one.
+func parseCandidates(r *http.Request) (int, error) {
+	s := r.FormValue("candidates")
+	if s == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxCandidates {
+		return 0, fmt.Errorf("candidates must be between 1 and %d", maxCandidates)
+	}
+	return n, nil
+}
+
+// generateCandidates calls gen n times at once and returns the images that
+// came back within the budget, fastest first. It fails only if none did.
+func generateCandidates(ctx context.Context, n int, gen func(context.Context) ([]byte, error)) ([][]byte, error) {
+	if n <= 1 {
+		data, err := gen(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{data}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, n)
+	for range n {
+		go func() {
+			data, err := gen(ctx)
+			results <- result{data, err}
+		}()
+	}
+
+	// Wait for every call, even cancelled ones, so none is still adding
+	// to the job when it is saved
+	var images [][]byte
+	var firstErr error
+	var grace *time.Timer
+	defer func() {
+		if grace != nil {
+			grace.Stop()
+		}
+	}()
+	for range n {
+		r := <-results
+		if r.err == nil && grace == nil {
+			grace = time.AfterFunc(candidateGrace, func() {
+				slog.WarnContext(ctx, "Candidate budget spent, cancelling the rest", "requested", n)
+				cancel()
+			})
+		}
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		images = append(images, r.data)
+	}
+	if len(images) == 0 {
+		return nil, firstErr
+	}
+	if len(images) < n {
+		slog.InfoContext(ctx, "Some candidates failed", "requested", n, "generated", len(images), "err", firstErr)
+	}
+	return images, nil
+}
+
+// saveCandidates saves generated images as assets made by newAsset. More
+// than one are saved as a candidate batch for the user to choose from,
+// with the input and the stage's prompt version, so choices can be compared
+// across prompt changes.
+func (app *App) saveCandidates(ctx context.Context, stage string, input map[string]string, images [][]byte, newAsset func() *Asset) ([]*Asset, error) {
+	var batch *CandidateBatch
+	if len(images) > 1 {
+		batchInput := map[string]string{"promptVersion": promptVersions[stage]}
+		for k, v := range input {
+			batchInput[k] = v
+		}
+		batch = &CandidateBatch{ID: newID(), Owner: sessionID(ctx), Stage: stage, Input: batchInput, Created: time.Now()}
+	}
+	assets := make([]*Asset, 0, len(images))
+	for _, data := range images {
+		a := newAsset()
+		if batch != nil {
+			a.BatchID, a.Candidate = batch.ID, true
+		}
+		if err := app.saveAsset(ctx, a, data, "png"); err != nil {
+			return nil, err
+		}
+		assets = append(assets, a)
+	}
+	if batch != nil {
+		for _, a := range assets {
+			batch.AssetIDs = append(batch.AssetIDs, a.ID)
+		}
+		if err := app.store.PutCandidateBatch(batch); err != nil {
+			return nil, err
+		}
+	}
+	return assets, nil
+}
+
+// renderCandidates shows the only asset as the stage's result, or a picker
+// when there are several.
+func (app *App) renderCandidates(w http.ResponseWriter, stage string, assets []*Asset) {
+	if len(assets) == 1 {
+		app.renderChosen(w, stage, assets[0])
+		return
+	}
+	app.renderPartial(w, "candidates", candidateView{
+		BatchID:    assets[0].BatchID,
+		Target:     candidateTargets[stage],
+		Candidates: assets,
+	})
+}
+
+func (app *App) renderChosen(w http.ResponseWriter, stage string, asset *Asset) {
+	switch stage {
+	case StageFigurine:
+		app.renderFigurineSuccess(w, asset)
+	case StageScene:
+		app.renderSceneSuccess(w, asset)
+	}
+}
+
+// chooseCandidateHandler records which candidate of a batch the user picked
+// and shows it as the stage's result. The others expire with the retention
+// policy's candidate TTL.
+func (app *App) chooseCandidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owned, err := app.store.GetCandidateBatch(r.PathValue("id"))
+	if err != nil || !ownedBy(r.Context(), owned.Owner) {
+		http.Error(w, "Unknown candidates", http.StatusNotFound)
+		return
+	}
+
+	batch, chosen, err := app.store.ChooseCandidate(owned.ID, r.FormValue("assetId"))
+	switch {
+	case errors.Is(err, ErrBadAsset), errors.Is(err, ErrNotFound):
+		http.Error(w, "Unknown candidate", http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrExists):
+		http.Error(w, "Another candidate was already chosen", http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to record candidate choice", "batch_id", owned.ID, "err", err)
+		http.Error(w, "Failed to choose candidate", http.StatusInternalServerError)
+		return
+	}
+
+	position := slices.Index(batch.AssetIDs, chosen.ID) + 1
+	candidateChoices.WithLabelValues(batch.Stage, strconv.Itoa(position)).Inc()
+	slog.InfoContext(r.Context(), "Candidate chosen", "batch_id", batch.ID, "stage", batch.Stage, "asset_id", chosen.ID, "position", position, "candidates", len(batch.AssetIDs))
+	app.renderChosen(w, batch.Stage, chosen)
+}
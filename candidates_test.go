@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGenerateCandidates(t *testing.T) {
+	var calls atomic.Int32
+	images, err := generateCandidates(context.Background(), 3, func(ctx context.Context) ([]byte, error) {
+		if calls.Add(1) == 2 {
+			return nil, errors.New("model overloaded")
+		}
+		return []byte("image"), nil
+	})
+	if err != nil || len(images) != 2 || calls.Load() != 3 {
+		t.Errorf("one of three failing: %d images, %d calls, %v", len(images), calls.Load(), err)
+	}
+
+	failed := errors.New("model down")
+	if _, err := generateCandidates(context.Background(), 2, func(ctx context.Context) ([]byte, error) {
+		return nil, failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("all failing: %v", err)
+	}
+
+	images, err = generateCandidates(context.Background(), 1, func(ctx context.Context) ([]byte, error) {
+		return []byte("only"), nil
+	})
+	if err != nil || len(images) != 1 || string(images[0]) != "only" {
+		t.Errorf("one candidate: %q, %v", images, err)
+	}
+}
+
+func TestGenerateCandidatesGrace(t *testing.T) {
+	defer func(grace time.Duration) { candidateGrace = grace }(candidateGrace)
+	candidateGrace = 10 * time.Millisecond
+
+	var calls, cancelled, finished atomic.Int32
+	images, err := generateCandidates(context.Background(), 3, func(ctx context.Context) ([]byte, error) {
+		defer finished.Add(1)
+		if calls.Add(1) == 1 {
+			return []byte("fast"), nil
+		}
+		// The slow calls only end once the grace period cancels them, and
+		// take a moment more to wind down
+		<-ctx.Done()
+		cancelled.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return nil, ctx.Err()
+	})
+	if err != nil || len(images) != 1 || string(images[0]) != "fast" {
+		t.Errorf("slow candidates: %q, %v", images, err)
+	}
+	if cancelled.Load() != 2 {
+		t.Errorf("%d slow calls cancelled, want 2", cancelled.Load())
+	}
+	if finished.Load() != 3 {
+		t.Errorf("returned with %d of 3 calls finished", finished.Load())
+	}
+}
+
+func TestChooseCandidate(t *testing.T) {
+	app := testApp(t)
+	ctx := context.WithValue(context.Background(), sessionKey, "alice")
+	input := map[string]string{"theme": "space station"}
+	assets, err := app.saveCandidates(ctx, StageScene, input, [][]byte{[]byte("a"), []byte("b")}, func() *Asset {
+		return &Asset{Kind: AssetScene}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range assets {
+		t.Cleanup(func() { os.Remove(filepath.Join("static", "uploads", a.Filename)) })
+	}
+	batch, err := app.store.GetCandidateBatch(assets[0].BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Input["theme"] != "space station" || batch.Input["promptVersion"] != promptVersions[StageScene] {
+		t.Errorf("batch input = %v", batch.Input)
+	}
+	if len(input) != 1 {
+		t.Errorf("caller's input changed: %v", input)
+	}
+
+	// Nothing but the picker may use a candidate before it is chosen
+	for _, a := range assets {
+		if _, err := app.checkAsset(ctx, a.ID, AssetScene); !errors.Is(err, ErrBadAsset) {
+			t.Errorf("unchosen candidate accepted: %v", err)
+		}
+	}
+
+	choose := func(session, assetID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/hx/candidates/"+batch.ID+"/choose", strings.NewReader("assetId="+assetID))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("id", batch.ID)
+		w := httptest.NewRecorder()
+		app.chooseCandidateHandler(w, asSession(r, session))
+		return w
+	}
+	if w := choose("bob", assets[1].ID); w.Code != http.StatusNotFound {
+		t.Errorf("choosing from another session's batch: status %d", w.Code)
+	}
+	if w := choose("alice", "stranger"); w.Code != http.StatusBadRequest {
+		t.Errorf("choosing an asset outside the batch: status %d", w.Code)
+	}
+	if w := choose("alice", assets[1].ID); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), assets[1].ID) {
+		t.Errorf("choosing: status %d: %s", w.Code, w.Body)
+	}
+	if w := choose("alice", assets[1].ID); w.Code != http.StatusOK {
+		t.Errorf("choosing the same candidate again: status %d", w.Code)
+	}
+	if w := choose("alice", assets[0].ID); w.Code != http.StatusConflict {
+		t.Errorf("choosing a second candidate: status %d", w.Code)
+	}
+
+	if _, err := app.checkAsset(ctx, assets[1].ID, AssetScene); err != nil {
+		t.Errorf("chosen candidate rejected: %v", err)
+	}
+	if _, err := app.checkAsset(ctx, assets[0].ID, AssetScene); !errors.Is(err, ErrBadAsset) {
+		t.Errorf("passed-over candidate accepted: %v", err)
+	}
+	if batch, _ := app.store.GetCandidateBatch(batch.ID); batch.ChosenID != assets[1].ID {
+		t.Errorf("chosen = %q", batch.ChosenID)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const characterSheetPrompt = "Create a character reference sheet of this toy figurine on a plain white background: a front view, a side view and a back view in a row, and below them three close-ups of its face showing happy, surprised and determined expressions. Keep the face, hair, outfit, colors, materials and chibi proportions exactly the same in every view."
+
+// characterSheet returns the character sheet made from a figurine, or an
+// error wrapping ErrNotFound if there isn't one yet.
+func (app *App) characterSheet(ctx context.Context, figurineID string) (*Asset, []byte, error) {
+	assets, err := app.store.ListAssets(sessionID(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Newest first, so a regenerated sheet wins
+	for _, a := range assets {
+		if a.Kind == AssetCharacter && a.ParentID == figurineID {
+			return app.loadAsset(ctx, a.ID, AssetCharacter)
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: no character sheet for figurine %s", ErrNotFound, figurineID)
+}
+
+// ensureCharacterSheet returns the figurine's character sheet, generating
+// it the first time the figurine is used.
+func (app *App) ensureCharacterSheet(ctx context.Context, figurineID string, figurineData []byte) (*Asset, []byte, error) {
+	sheet, data, err := app.characterSheet(ctx, figurineID)
+	if !errors.Is(err, ErrNotFound) {
+		return sheet, data, err
+	}
+	return app.generateCharacterSheet(ctx, figurineID, figurineData)
+}
+
+// generateCharacterSheet draws the figurine from several angles and with
+// several expressions, as a reference that keeps it looking the same from
+// one panel to the next.
+func (app *App) generateCharacterSheet(ctx context.Context, figurineID string, figurineData []byte) (*Asset, []byte, error) {
+	slog.DebugContext(ctx, "Generating character sheet", "figurine_id", figurineID)
+	resp, err := app.generate(ctx, app.model(StageCharacter), StageCharacter,
+		genai.Text(characterSheetPrompt),
+		genai.ImageData("png", figurineData),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("character sheet generation failed: %w", err)
+	}
+	if !hasImage(resp) {
+		return nil, nil, errors.New("no character sheet image generated")
+	}
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if blob, ok := part.(genai.Blob); ok {
+			sheet := &Asset{Kind: AssetCharacter, ParentID: figurineID}
+			if err := app.saveAsset(ctx, sheet, blob.Data, "png"); err != nil {
+				return nil, nil, err
+			}
+			slog.InfoContext(ctx, "Generated character sheet", "asset_id", sheet.ID, "figurine_id", figurineID, "bytes", len(blob.Data))
+			return sheet, blob.Data, nil
+		}
+	}
+	return nil, nil, errors.New("no character sheet image generated")
+}
+
+// driftReport is the JSON the drift stage asks the model for.
+type driftReport struct {
+	Score       int    `json:"score"`
+	Differences string `json:"differences"`
+}
+
+// checkConsistency asks a vision model how closely the figurine in a
+// composite matches its character sheet, from 0 to 100, and records the
+// score as a metric and on the current span.
+func (app *App) checkConsistency(ctx context.Context, sheetData, compositeData []byte) (int, error) {
+	prompt := `Image 1 is a character reference sheet of a toy figurine. Image 2 is a comic panel that should show the same figurine.
+Compare the figurine in image 2 with the reference: face, hair, outfit, colors, materials and proportions.
+Reply with JSON only: {"score": 0-100 where 100 means identical and 0 means a different character or no figurine, "differences": "short list of what changed"}`
+
+	var report driftReport
+	err := app.generateJSON(ctx, StageDrift, &report,
+		genai.Text(prompt),
+		genai.ImageData("png", sheetData),
+		genai.ImageData("png", compositeData),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("consistency check failed: %w", err)
+	}
+	score := min(max(report.Score, 0), 100)
+
+	characterConsistency.Observe(float64(score))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("bananaverse.consistency", score))
+	slog.InfoContext(ctx, "Character consistency", "score", score, "differences", userText(report.Differences))
+	return score, nil
+}
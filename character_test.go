@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCharacterSheet(t *testing.T) {
+	app := testApp(t)
+	ctx := context.WithValue(context.Background(), sessionKey, "alice")
+	figurine := &Asset{Kind: AssetFigurine}
+	saveTestAsset(t, app, "alice", figurine, []byte("figurine"))
+
+	if _, _, err := app.characterSheet(ctx, figurine.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("before any sheet: %v", err)
+	}
+
+	saveTestAsset(t, app, "alice", &Asset{Kind: AssetCharacter, ParentID: figurine.ID}, []byte("old sheet"))
+	saveTestAsset(t, app, "alice", &Asset{Kind: AssetCharacter, ParentID: "other"}, []byte("other sheet"))
+	time.Sleep(time.Millisecond)
+	newest := &Asset{Kind: AssetCharacter, ParentID: figurine.ID}
+	saveTestAsset(t, app, "alice", newest, []byte("new sheet"))
+
+	sheet, data, err := app.ensureCharacterSheet(ctx, figurine.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheet.ID != newest.ID || string(data) != "new sheet" {
+		t.Errorf("got sheet %s %q, want the newest", sheet.ID, data)
+	}
+
+	// Another session's figurine has no sheet of its own
+	bob := context.WithValue(context.Background(), sessionKey, "bob")
+	if _, _, err := app.characterSheet(bob, figurine.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("another session: %v", err)
+	}
+}
+
+func TestRetentionKeepsCharacterSheetWithFigurine(t *testing.T) {
+	store := testStore(t)
+	old := time.Now().Add(-1000 * time.Hour)
+	figurine := &Asset{ID: "fig", Kind: AssetFigurine, Created: old, Pinned: true}
+	sheet := &Asset{ID: "sheet", Kind: AssetCharacter, ParentID: "fig", Created: old}
+	orphan := &Asset{ID: "orphan", Kind: AssetCharacter, ParentID: "gone", Created: old}
+	for _, a := range []*Asset{figurine, sheet, orphan} {
+		if err := store.PutAsset(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := store.DeleteExpiredAssets(func(*Asset) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != "orphan" {
+		t.Errorf("deleted %v, want only the orphaned sheet", deleted)
+	}
+}
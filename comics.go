@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxTitleLength   = 120
+	maxCaptionLength = 500
+)
+
+type ComicRequest struct {
+	Title  string `json:"title"`
+	Layout string `json:"layout"`
+}
+
+type ComicPanelRequest struct {
+	ComposedID string `json:"composedId"`
+	FigurineID string `json:"figurineId"`
+	SceneID    string `json:"sceneId"`
+	Caption    string `json:"caption"`
+}
+
+type ReorderRequest struct {
+	PanelIDs []string `json:"panelIds"`
+}
+
+// PanelView is a stored panel plus the URL of its artwork.
+type PanelView struct {
+	*Panel
+	ImageURL string `json:"imageUrl"`
+}
+
+type ComicResponse struct {
+	Comic   *Comic      `json:"comic,omitempty"`
+	Panels  []PanelView `json:"panels,omitempty"`
+	Comics  []*Comic    `json:"comics,omitempty"`
+	Success bool        `json:"success"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// apiComicsHandler lists the session's comics (GET) or starts a new one
+// (POST).
+func (app *App) apiComicsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		comics, err := app.store.ListComics(sessionID(r.Context()))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to list comics", "err", err)
+			writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to list comics"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ComicResponse{Comics: comics, Success: true})
+
+	case http.MethodPost:
+		var req ComicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ComicResponse{Error: "Invalid JSON body"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, ComicResponse{Error: err.Error()})
+			return
+		}
+
+		now := time.Now()
+		comic := &Comic{ID: newID(), Owner: sessionID(r.Context()), Title: strings.TrimSpace(req.Title), Layout: req.Layout, Created: now, Updated: now}
+		if comic.Title == "" {
+			comic.Title = "BananaVerse Comic"
+		}
+		if err := app.store.CreateComic(comic); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to create comic", "err", err)
+			writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to create comic"})
+			return
+		}
+		writeJSON(w, http.StatusCreated, ComicResponse{Comic: comic, Success: true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiComicHandler reads (GET), renames or re-lays-out (PATCH) and deletes
+// (DELETE) a single comic.
+func (app *App) apiComicHandler(w http.ResponseWriter, r *http.Request) {
+	comic, ok := app.loadComic(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.writeComic(w, http.StatusOK, comic)
+
+	case http.MethodPatch:
+		var req ComicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ComicResponse{Error: "Invalid JSON body"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, ComicResponse{Error: err.Error()})
+			return
+		}
+		if title := strings.TrimSpace(req.Title); title != "" {
+			comic.Title = title
+		}
+		if req.Layout != "" {
+			comic.Layout = req.Layout
+		}
+		comic.Updated = time.Now()
+		if err := app.store.UpdateComic(comic); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to update comic", "comic_id", comic.ID, "err", err)
+			writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to update comic"})
+			return
+		}
+		app.writeComic(w, http.StatusOK, comic)
+
+	case http.MethodDelete:
+		if err := app.store.DeleteComic(comic.ID); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to delete comic", "comic_id", comic.ID, "err", err)
+			writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to delete comic"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ComicResponse{Success: true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiComicPanelsHandler appends a panel to a comic.
+func (app *App) apiComicPanelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	comic, ok := app.loadComic(w, r)
+	if !ok {
+		return
+	}
+
+	var req ComicPanelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicResponse{Error: "Invalid JSON body"})
+		return
+	}
+	if len(req.Caption) > maxCaptionLength {
+		writeJSON(w, http.StatusBadRequest, ComicResponse{Error: fmt.Sprintf("Caption must be at most %d characters", maxCaptionLength)})
+		return
+	}
+	if err := app.checkPanelAssets(r.Context(), req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicResponse{Error: err.Error()})
+		return
+	}
+
+	panels, err := app.store.Panels(comic.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read panels", "comic_id", comic.ID, "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to add panel"})
+		return
+	}
+	if len(panels) >= maxComicPanels {
+		writeJSON(w, http.StatusBadRequest, ComicResponse{Error: fmt.Sprintf("A comic can have at most %d panels", maxComicPanels)})
+		return
+	}
+
+	panel := &Panel{
+		ID:         newID(),
+		ComicID:    comic.ID,
+		Caption:    strings.TrimSpace(req.Caption),
+		FigurineID: req.FigurineID,
+		SceneID:    req.SceneID,
+		ComposedID: req.ComposedID,
+		Created:    time.Now(),
+	}
+	if err := app.store.AddPanel(panel); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add panel", "comic_id", comic.ID, "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to add panel"})
+		return
+	}
+	app.writeComic(w, http.StatusCreated, comic)
+}
+
+// apiComicPanelHandler edits a panel's caption (PATCH) or removes it (DELETE).
+func (app *App) apiComicPanelHandler(w http.ResponseWriter, r *http.Request) {
+	comic, ok := app.loadComic(w, r)
+	if !ok {
+		return
+	}
+
+	panel, err := app.store.GetPanel(comic.ID, r.PathValue("panelID"))
+	if errors.Is(err, ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, ComicResponse{Error: "Panel not found"})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load panel", "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to load panel"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		var req ComicPanelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ComicResponse{Error: "Invalid JSON body"})
+			return
+		}
+		if len(req.Caption) > maxCaptionLength {
+			writeJSON(w, http.StatusBadRequest, ComicResponse{Error: fmt.Sprintf("Caption must be at most %d characters", maxCaptionLength)})
+			return
+		}
+		panel.Caption = strings.TrimSpace(req.Caption)
+		if err := app.store.UpdatePanel(panel); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to update panel", "panel_id", panel.ID, "err", err)
+			writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to update panel"})
+			return
+		}
+
+	case http.MethodDelete:
+		if err := app.store.DeletePanel(comic.ID, panel.ID); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to delete panel", "panel_id", panel.ID, "err", err)
+			writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to delete panel"})
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	app.writeComic(w, http.StatusOK, comic)
+}
+
+// apiComicOrderHandler replaces the panel reading order.
+func (app *App) apiComicOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	comic, ok := app.loadComic(w, r)
+	if !ok {
+		return
+	}
+
+	var req ReorderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicResponse{Error: "Invalid JSON body"})
+		return
+	}
+	err := app.store.ReorderPanels(comic.ID, req.PanelIDs)
+	if errors.Is(err, ErrBadOrder) {
+		writeJSON(w, http.StatusBadRequest, ComicResponse{Error: err.Error()})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to reorder comic", "comic_id", comic.ID, "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to reorder panels"})
+		return
+	}
+	app.writeComic(w, http.StatusOK, comic)
+}
+
+func (req ComicRequest) validate() error {
+	if len(req.Title) > maxTitleLength {
+		return fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	}
+	return LayoutOptions{Layout: req.Layout}.validate()
+}
+
+// loadComic fetches the comic named in the URL, writing a 404 if it doesn't
+// exist or belongs to another session.
+func (app *App) loadComic(w http.ResponseWriter, r *http.Request) (*Comic, bool) {
+	comic, err := app.store.GetComic(r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && !ownedBy(r.Context(), comic.Owner)) {
+		writeJSON(w, http.StatusNotFound, ComicResponse{Error: "Comic not found"})
+		return nil, false
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load comic", "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to load comic"})
+		return nil, false
+	}
+	return comic, true
+}
+
+// writeComic responds with the comic and its current panels.
+func (app *App) writeComic(w http.ResponseWriter, status int, comic *Comic) {
+	// Re-read so the response reflects any Updated bump from panel edits.
+	if fresh, err := app.store.GetComic(comic.ID); err == nil {
+		comic = fresh
+	}
+	views, err := app.panelViews(comic.ID)
+	if err != nil {
+		slog.Error("Failed to read panels", "comic_id", comic.ID, "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to read panels"})
+		return
+	}
+	writeJSON(w, status, ComicResponse{Comic: comic, Panels: views, Success: true})
+}
+
+func (app *App) panelViews(comicID string) ([]PanelView, error) {
+	panels, err := app.store.Panels(comicID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]PanelView, 0, len(panels))
+	for _, p := range panels {
+		view := PanelView{Panel: p}
+		if a, err := app.store.GetAsset(p.ComposedID); err == nil {
+			view.ImageURL = a.URL()
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// checkPanelAssets makes sure every asset a new panel refers to exists, is
+// owned by the session and is of the right kind.
+func (app *App) checkPanelAssets(ctx context.Context, req ComicPanelRequest) error {
+	if req.ComposedID == "" {
+		return fmt.Errorf("composedId required")
+	}
+	refs := []struct {
+		id    string
+		kinds []string
+		field string
+	}{
+		{req.ComposedID, []string{AssetComposite, AssetPanel}, "composedId"},
+		{req.FigurineID, []string{AssetFigurine}, "figurineId"},
+		{req.SceneID, []string{AssetScene}, "sceneId"},
+	}
+	for _, ref := range refs {
+		if ref.id == "" {
+			continue
+		}
+		a, err := app.store.GetAsset(ref.id)
+		if err != nil || !ownedBy(ctx, a.Owner) {
+			return fmt.Errorf("%s does not refer to a known asset", ref.field)
+		}
+		valid := false
+		for _, k := range ref.kinds {
+			valid = valid || a.Kind == k
+		}
+		if !valid {
+			return fmt.Errorf("%s refers to a %s, not a %s", ref.field, a.Kind, strings.Join(ref.kinds, " or "))
+		}
+	}
+	return nil
+}
+
+// storedComicPanels turns a saved comic into the panel list used by the
+// layout and export code. Comics owned by another session are reported as
+// ErrNotFound.
+func (app *App) storedComicPanels(ctx context.Context, comicID string) (*Comic, []ComicPanel, error) {
+	comic, err := app.store.GetComic(comicID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ownedBy(ctx, comic.Owner) {
+		return nil, nil, ErrNotFound
+	}
+	views, err := app.panelViews(comicID)
+	if err != nil {
+		return nil, nil, err
+	}
+	panels := make([]ComicPanel, 0, len(views))
+	for _, v := range views {
+		if v.ComposedID == "" {
+			return nil, nil, fmt.Errorf("panel %s has no artwork", v.ID)
+		}
+		panels = append(panels, ComicPanel{AssetID: v.ComposedID, Caption: v.Caption})
+	}
+	return comic, panels, nil
+}
+
+// useStoredComic replaces panels with a saved comic's panels and fills in
+// its title and layout where opts leaves them unset. It writes an error
+// response and returns false if the comic can't be loaded.
+func (app *App) useStoredComic(ctx context.Context, w http.ResponseWriter, comicID string, panels *[]ComicPanel, opts *LayoutOptions) bool {
+	comic, stored, err := app.storedComicPanels(ctx, comicID)
+	if errors.Is(err, ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, ComicResponse{Error: "Comic not found"})
+		return false
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to load comic", "comic_id", comicID, "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicResponse{Error: "Failed to load comic"})
+		return false
+	}
+
+	*panels = stored
+	if opts != nil {
+		if opts.Title == "" {
+			opts.Title = comic.Title
+		}
+		if opts.Layout == "" {
+			opts.Layout = comic.Layout
+		}
+	}
+	return true
+}
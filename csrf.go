@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// csrfHeader carries the session's CSRF token on /hx requests. The index
+// page hands the token to HTMX through hx-headers and to fetch calls through
+// a meta tag.
+const csrfHeader = "X-CSRF-Token"
+
+// ErrorResponse is the JSON body for requests rejected before they reach a
+// handler.
+type ErrorResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// csrfToken returns the CSRF token for the request's session. It is derived
+// from the session ID, so it needs no storage and changes with the session.
+func (app *App) csrfToken(ctx context.Context) string {
+	return app.signSession("csrf:" + sessionID(ctx))
+}
+
+// withCSRF rejects cross-site requests. Every /hx request spends generation
+// budget, so they must carry the session's CSRF token; other state-changing
+// requests must come from our own origin. It runs inside withSession.
+func (app *App) withCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unsafe := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+		if unsafe && !sameOrigin(r) {
+			slog.WarnContext(r.Context(), "Rejected cross-origin request", "method", r.Method, "path", r.URL.Path, "origin", r.Header.Get("Origin"), "referer", r.Header.Get("Referer"))
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "Cross-origin request rejected"})
+			} else {
+				http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+			}
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/hx/") {
+			token := r.Header.Get(csrfHeader)
+			if token == "" || !hmac.Equal([]byte(token), []byte(app.csrfToken(r.Context()))) {
+				slog.WarnContext(r.Context(), "Rejected request without a valid CSRF token", "method", r.Method, "path", r.URL.Path)
+				http.Error(w, "Invalid or missing CSRF token, please reload the page", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether a request came from a page on this host.
+// Browsers send Origin on cross-site POSTs and usually Referer otherwise;
+// requests with neither come from scripts and tools rather than a visitor's
+// browser, so they can't be forged this way and are let through.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		// Includes the opaque "null" origin sent by sandboxed frames
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithCSRF(t *testing.T) {
+	app := testApp(t)
+	handler := app.withSession(app.withCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	cookie := &http.Cookie{Name: sessionCookie, Value: "alice." + app.signSession("alice")}
+	token := app.signSession("csrf:alice")
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		want    int
+	}{
+		{"page view", http.MethodGet, "/", nil, http.StatusOK},
+		{"hx with token", http.MethodPost, "/hx/scene", map[string]string{csrfHeader: token, "Origin": "http://example.com"}, http.StatusOK},
+		{"hx without token", http.MethodPost, "/hx/scene", nil, http.StatusForbidden},
+		{"hx with another session's token", http.MethodPost, "/hx/scene", map[string]string{csrfHeader: app.signSession("csrf:bob")}, http.StatusForbidden},
+		{"hx GET still needs the token", http.MethodGet, "/hx/figurine/abc", nil, http.StatusForbidden},
+		{"api from a script", http.MethodPost, "/api/comics", nil, http.StatusOK},
+		{"api from our page", http.MethodPost, "/api/comics", map[string]string{"Referer": "http://example.com/"}, http.StatusOK},
+		{"api from another site", http.MethodPost, "/api/comics", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"api from a sandboxed frame", http.MethodDelete, "/api/shares/x", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"hx with token from another site", http.MethodPost, "/hx/scene", map[string]string{csrfHeader: token, "Origin": "https://evil.example"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.AddCookie(cookie)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/image/draw"
+)
+
+// Comic book export formats.
+const (
+	ExportPDF = "pdf"
+	ExportCBZ = "cbz"
+)
+
+const (
+	folioHeight   = 44
+	folioFontSize = 18
+	// Pages are rasterised at 150 dpi; PDF user space is 72 units per inch.
+	pdfPixelsPerPoint = 150.0 / 72.0
+	pdfJPEGQuality    = 90
+)
+
+type ComicExportRequest struct {
+	Format  string       `json:"format"`
+	Author  string       `json:"author"`
+	ComicID string       `json:"comicId"`
+	Panels  []ComicPanel `json:"panels"`
+	LayoutOptions
+}
+
+type ComicExportResponse struct {
+	URL     string `json:"url"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ComicMetadata is embedded in exported comic books.
+type ComicMetadata struct {
+	Title   string
+	Author  string
+	Layout  string
+	Created time.Time
+	Pages   int
+}
+
+func (app *App) apiComicExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ComicExportRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxComicRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicExportResponse{Error: "Invalid JSON body"})
+		return
+	}
+	if req.ComicID != "" {
+		if !app.useStoredComic(r.Context(), w, req.ComicID, &req.Panels, &req.LayoutOptions) {
+			return
+		}
+	}
+	if req.Format != ExportPDF && req.Format != ExportCBZ {
+		writeJSON(w, http.StatusBadRequest, ComicExportResponse{Error: "format must be pdf or cbz"})
+		return
+	}
+	if len(req.Panels) == 0 || len(req.Panels) > maxComicPanels {
+		writeJSON(w, http.StatusBadRequest, ComicExportResponse{Error: fmt.Sprintf("Between 1 and %d panels required", maxComicPanels)})
+		return
+	}
+	if err := req.LayoutOptions.validateFor(len(req.Panels)); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicExportResponse{Error: err.Error()})
+		return
+	}
+	if err := app.resolvePanels(r.Context(), req.Panels); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicExportResponse{Error: err.Error()})
+		return
+	}
+
+	url, err := app.exportComicBook(r.Context(), req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Comic export failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicExportResponse{Error: "Failed to export comic"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ComicExportResponse{URL: url, Success: true})
+}
+
+// exportComicBook renders a title page plus numbered story pages and packs
+// them into the requested format.
+func (app *App) exportComicBook(ctx context.Context, req ComicExportRequest) (string, error) {
+	meta := ComicMetadata{
+		Title:   strings.TrimSpace(req.Title),
+		Author:  strings.TrimSpace(req.Author),
+		Layout:  req.Layout,
+		Created: time.Now().UTC(),
+	}
+	if meta.Title == "" {
+		meta.Title = "BananaVerse Comic"
+	}
+	if meta.Layout == "" {
+		meta.Layout = LayoutGrid
+	}
+
+	// The title and credits move to the title page, so story pages carry art only.
+	opts := req.LayoutOptions
+	opts.Title, opts.Credits = "", ""
+	story, err := app.layoutComic(ctx, req.Panels, opts)
+	if err != nil {
+		return "", err
+	}
+
+	cover, err := drawTitlePage(story[0].Bounds().Size(), meta, req.Credits, story[0])
+	if err != nil {
+		return "", err
+	}
+
+	pages := []image.Image{cover}
+	for i, page := range story {
+		numbered, err := addFolio(page, i+1)
+		if err != nil {
+			return "", err
+		}
+		pages = append(pages, numbered)
+	}
+	meta.Pages = len(pages)
+
+	var data []byte
+	switch req.Format {
+	case ExportPDF:
+		data, err = encodeComicPDF(pages, meta)
+	case ExportCBZ:
+		data, err = encodeComicCBZ(pages, meta)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s: %v", req.Format, err)
+	}
+
+	asset := &Asset{Kind: AssetComicBook}
+	if err := app.saveAsset(ctx, asset, data, req.Format); err != nil {
+		return "", err
+	}
+	return asset.URL(), nil
+}
+
+// drawTitlePage lays out the title, byline and a preview of the first story
+// page. Webtoon pages are very tall, so the cover falls back to a 4:3 shape.
+func drawTitlePage(size image.Point, meta ComicMetadata, credits string, preview image.Image) (*image.RGBA, error) {
+	if size.Y > size.X*2 {
+		size.Y = size.X * 4 / 3
+	}
+	page := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(page, page.Bounds(), image.NewUniform(pageBackground), image.Point{}, draw.Src)
+
+	margin := size.X / 12
+	titleBand := image.Rect(margin, margin, size.X-margin, margin+size.Y/6)
+	if err := drawBandText(page, titleBand, meta.Title, false, titleFontSize*1.5); err != nil {
+		return nil, err
+	}
+
+	byline := strings.TrimSpace(credits)
+	if meta.Author != "" && byline != "" {
+		byline = "by " + meta.Author + " · " + byline
+	} else if meta.Author != "" {
+		byline = "by " + meta.Author
+	}
+	bylineBand := image.Rect(margin, titleBand.Max.Y, size.X-margin, titleBand.Max.Y+creditsBand)
+	if byline != "" {
+		if err := drawBandText(page, bylineBand, byline, true, creditsFontSize*1.3); err != nil {
+			return nil, err
+		}
+	}
+
+	dateBand := image.Rect(margin, size.Y-margin-creditsBand, size.X-margin, size.Y-margin)
+	if err := drawBandText(page, dateBand, "Created "+meta.Created.Format("January 2, 2006"), true, creditsFontSize); err != nil {
+		return nil, err
+	}
+
+	art := image.Rect(margin, bylineBand.Max.Y+margin/2, size.X-margin, dateBand.Min.Y-margin/2)
+	drawContain(page, art, preview)
+	return page, nil
+}
+
+// addFolio returns page with a page-number strip added below it.
+func addFolio(page image.Image, number int) (*image.RGBA, error) {
+	b := page.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()+folioHeight))
+	draw.Draw(out, out.Bounds(), image.NewUniform(pageBackground), image.Point{}, draw.Src)
+	draw.Draw(out, image.Rect(0, 0, b.Dx(), b.Dy()), page, b.Min, draw.Src)
+
+	band := image.Rect(0, b.Dy(), b.Dx(), b.Dy()+folioHeight)
+	if err := drawBandText(out, band, fmt.Sprintf("— %d —", number), false, folioFontSize); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// drawContain scales src to fit inside r, centred, preserving aspect ratio.
+func drawContain(dst draw.Image, r image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if sb.Empty() || r.Empty() {
+		return
+	}
+
+	scale := min(float64(r.Dx())/float64(sb.Dx()), float64(r.Dy())/float64(sb.Dy()))
+	w := int(float64(sb.Dx()) * scale)
+	h := int(float64(sb.Dy()) * scale)
+	x0 := r.Min.X + (r.Dx()-w)/2
+	y0 := r.Min.Y + (r.Dy()-h)/2
+
+	draw.CatmullRom.Scale(dst, image.Rect(x0, y0, x0+w, y0+h), src, sb, draw.Over, nil)
+}
+
+// encodeComicPDF writes a minimal PDF 1.4 document with one full-bleed JPEG
+// per page and the metadata in the document information dictionary.
+func encodeComicPDF(pages []image.Image, meta ComicMetadata) ([]byte, error) {
+	var buf bytes.Buffer
+	var offsets []int
+	// Objects are numbered 1..n in the order they're written: catalog, page
+	// tree, info, then an image, content stream and page object per page.
+	beginObj := func() int {
+		offsets = append(offsets, buf.Len())
+		n := len(offsets)
+		fmt.Fprintf(&buf, "%d 0 obj\n", n)
+		return n
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	const catalogID, pagesID, infoID = 1, 2, 3
+	firstPageObj := 4
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPageObj+i*3+2))
+	}
+
+	direction := "L2R"
+	if meta.Layout == LayoutManga {
+		direction = "R2L"
+	}
+	beginObj()
+	fmt.Fprintf(&buf, "<< /Type /Catalog /Pages %d 0 R /ViewerPreferences << /Direction /%s >> >>\nendobj\n", pagesID, direction)
+
+	beginObj()
+	fmt.Fprintf(&buf, "<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(pages))
+
+	beginObj()
+	created := "D:" + meta.Created.UTC().Format("20060102150405") + "Z"
+	fmt.Fprintf(&buf, "<< /Title %s /Author %s /Subject %s /Creator (BananaVerse) /Producer (BananaVerse) /CreationDate (%s) /ModDate (%s) >>\nendobj\n",
+		pdfText(meta.Title), pdfText(meta.Author), pdfText("Layout: "+meta.Layout), created, created)
+
+	for i, page := range pages {
+		var jpg bytes.Buffer
+		if err := jpeg.Encode(&jpg, page, &jpeg.Options{Quality: pdfJPEGQuality}); err != nil {
+			return nil, fmt.Errorf("page %d: %v", i+1, err)
+		}
+		b := page.Bounds()
+		w, h := float64(b.Dx())/pdfPixelsPerPoint, float64(b.Dy())/pdfPixelsPerPoint
+
+		imageID := beginObj()
+		fmt.Fprintf(&buf, "<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n",
+			b.Dx(), b.Dy(), jpg.Len())
+		buf.Write(jpg.Bytes())
+		buf.WriteString("\nendstream\nendobj\n")
+
+		content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", w, h)
+		contentID := beginObj()
+		fmt.Fprintf(&buf, "<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+
+		beginObj()
+		fmt.Fprintf(&buf, "<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			pagesID, w, h, imageID, contentID)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(offsets)+1, catalogID, infoID, xref)
+
+	return buf.Bytes(), nil
+}
+
+// pdfText encodes s as a PDF text string. Plain ASCII is written literally;
+// anything else uses UTF-16BE with a byte order mark.
+func pdfText(s string) string {
+	ascii := true
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		r := strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`)
+		return "(" + r.Replace(s) + ")"
+	}
+
+	var hex strings.Builder
+	hex.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&hex, "%04X", u)
+	}
+	hex.WriteString(">")
+	return hex.String()
+}
+
+// comicInfo is the ComicInfo.xml schema understood by most comic readers.
+type comicInfo struct {
+	XMLName   xml.Name        `xml:"ComicInfo"`
+	Title     string          `xml:"Title"`
+	Summary   string          `xml:"Summary,omitempty"`
+	Notes     string          `xml:"Notes"`
+	Year      int             `xml:"Year"`
+	Month     int             `xml:"Month"`
+	Day       int             `xml:"Day"`
+	Writer    string          `xml:"Writer,omitempty"`
+	PageCount int             `xml:"PageCount"`
+	Manga     string          `xml:"Manga"`
+	Pages     []comicInfoPage `xml:"Pages>Page"`
+}
+
+type comicInfoPage struct {
+	Image       int    `xml:"Image,attr"`
+	Type        string `xml:"Type,attr,omitempty"`
+	ImageWidth  int    `xml:"ImageWidth,attr"`
+	ImageHeight int    `xml:"ImageHeight,attr"`
+}
+
+// encodeComicCBZ zips the pages as numbered PNGs alongside ComicInfo.xml.
+func encodeComicCBZ(pages []image.Image, meta ComicMetadata) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	info := comicInfo{
+		Title:     meta.Title,
+		Notes:     fmt.Sprintf("Created with BananaVerse on %s", meta.Created.Format(time.RFC3339)),
+		Year:      meta.Created.Year(),
+		Month:     int(meta.Created.Month()),
+		Day:       meta.Created.Day(),
+		Writer:    meta.Author,
+		PageCount: len(pages),
+		Manga:     "No",
+	}
+	if meta.Layout == LayoutManga {
+		info.Manga = "YesAndRightToLeft"
+	}
+
+	for i, page := range pages {
+		// Images are already compressed, so store them rather than deflate again.
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     fmt.Sprintf("%03d.png", i),
+			Method:   zip.Store,
+			Modified: meta.Created,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := png.Encode(w, page); err != nil {
+			return nil, fmt.Errorf("page %d: %v", i, err)
+		}
+
+		p := comicInfoPage{Image: i, ImageWidth: page.Bounds().Dx(), ImageHeight: page.Bounds().Dy()}
+		if i == 0 {
+			p.Type = "FrontCover"
+		} else {
+			p.Type = "Story"
+		}
+		info.Pages = append(info.Pages, p)
+	}
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "ComicInfo.xml", Method: zip.Deflate, Modified: meta.Created})
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(info); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPages(n int) []image.Image {
+	pages := make([]image.Image, n)
+	for i := range pages {
+		pages[i] = image.NewRGBA(image.Rect(0, 0, 300, 150+i*10))
+	}
+	return pages
+}
+
+func TestEncodeComicPDFXref(t *testing.T) {
+	meta := ComicMetadata{Title: "Banana Quest", Author: "Zoë", Layout: LayoutManga, Created: time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)}
+	data, err := encodeComicPDF(testPages(2), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// startxref must point at the xref table, and every entry at its object.
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(data)
+	if m == nil {
+		t.Fatal("no startxref trailer")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(data[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data[xref:], -1)
+	// Catalog, page tree and info, then three objects per page.
+	if want := 3 + 2*3; len(entries) != want {
+		t.Fatalf("got %d xref entries, want %d", len(entries), want)
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(data[off:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i+1, data[off:off+10])
+		}
+	}
+
+	for _, want := range []string{"/Count 2", "/Direction /R2L", "/Title (Banana Quest)", "/Author <FEFF005A006F00EB>", "/CreationDate (D:20250901120000Z)"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("PDF is missing %s", want)
+		}
+	}
+}
+
+func TestPDFText(t *testing.T) {
+	tests := map[string]string{
+		"Plain":     "(Plain)",
+		`a (b) \ c`: `(a \(b\) \\ c)`,
+		"Café":      "<FEFF00430061006600E9>",
+		"tab\there": "<FEFF00740061006200090068006500720065>",
+		"🍌":         "<FEFFD83CDF4C>",
+	}
+	for in, want := range tests {
+		if got := pdfText(in); got != want {
+			t.Errorf("pdfText(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestEncodeComicCBZ(t *testing.T) {
+	meta := ComicMetadata{Title: "Banana Quest", Author: "Sam", Layout: LayoutManga, Created: time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)}
+	data, err := encodeComicCBZ(testPages(3), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	var info comicInfo
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rc)
+		rc.Close()
+		if strings.HasSuffix(f.Name, ".png") {
+			if f.Method != zip.Store {
+				t.Errorf("%s is compressed again", f.Name)
+			}
+			if _, err := png.Decode(bytes.NewReader(body)); err != nil {
+				t.Errorf("%s: %v", f.Name, err)
+			}
+			continue
+		}
+		if err := xml.Unmarshal(body, &info); err != nil {
+			t.Fatalf("ComicInfo.xml: %v", err)
+		}
+	}
+	if got := strings.Join(names, ","); got != "000.png,001.png,002.png,ComicInfo.xml" {
+		t.Errorf("archive holds %s", got)
+	}
+	if info.Title != meta.Title || info.Writer != "Sam" || info.PageCount != 3 || info.Manga != "YesAndRightToLeft" {
+		t.Errorf("unexpected ComicInfo %+v", info)
+	}
+	if len(info.Pages) != 3 || info.Pages[0].Type != "FrontCover" || info.Pages[2].ImageHeight != 170 {
+		t.Errorf("unexpected pages %+v", info.Pages)
+	}
+}
+
+func TestComicExportRejectsOversizedRequests(t *testing.T) {
+	app := testApp(t)
+	panel := &Asset{ID: newID(), Kind: AssetPanel, Owner: "alice", Filename: "panel.png"}
+	if err := app.store.PutAsset(panel); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{
+		"long caption": `{"format":"pdf","panels":[{"assetId":"` + panel.ID + `","caption":"` + strings.Repeat("x", maxCaptionLength+1) + `"}]}`,
+		"huge body":    `{"format":"cbz","panels":[{"assetId":"` + panel.ID + `","caption":"` + strings.Repeat("x", maxComicRequestSize) + `"}]}`,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/comic/export", strings.NewReader(body))
+		app.apiComicExportHandler(w, asSession(r, "alice"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const galleryPageSize = 12
+
+type GallerySubmitRequest struct {
+	ShareID string `json:"shareId"`
+}
+
+// GalleryView is a gallery entry with the URLs needed to show it.
+type GalleryView struct {
+	*GalleryEntry
+	ImageURL string `json:"imageUrl"`
+	ShareURL string `json:"shareUrl"`
+}
+
+type GalleryResponse struct {
+	Entry   *GalleryEntry `json:"entry,omitempty"`
+	Entries []GalleryView `json:"entries,omitempty"`
+	Page    int           `json:"page,omitempty"`
+	Pages   int           `json:"pages,omitempty"`
+	Success bool          `json:"success"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// galleryPage is what templates/gallery.html renders.
+type galleryPage struct {
+	Entries []GalleryView
+	Theme   string
+	Style   string
+	Themes  []string
+	Styles  []string
+	Page    int
+	Pages   int
+	PrevURL string
+	NextURL string
+}
+
+// galleryFilter picks approved entries by theme and style (the scene's
+// lighting), one page at a time.
+type galleryFilter struct {
+	theme, style string
+	page         int
+}
+
+func parseGalleryFilter(r *http.Request) galleryFilter {
+	q := r.URL.Query()
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return galleryFilter{theme: q.Get("theme"), style: q.Get("style"), page: page}
+}
+
+func (f galleryFilter) url(page int) string {
+	q := url.Values{}
+	if f.theme != "" {
+		q.Set("theme", f.theme)
+	}
+	if f.style != "" {
+		q.Set("style", f.style)
+	}
+	q.Set("page", strconv.Itoa(page))
+	return "/gallery?" + q.Encode()
+}
+
+// apiGalleryHandler lists approved entries (GET) or submits one of the
+// session's shares for moderation (POST).
+func (app *App) apiGalleryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		f := parseGalleryFilter(r)
+		page, err := app.approvedGallery(f)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to list gallery", "err", err)
+			writeJSON(w, http.StatusInternalServerError, GalleryResponse{Error: "Failed to load gallery"})
+			return
+		}
+		writeJSON(w, http.StatusOK, GalleryResponse{Entries: page.Entries, Page: page.Page, Pages: page.Pages, Success: true})
+
+	case http.MethodPost:
+		var req GallerySubmitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, GalleryResponse{Error: "Invalid JSON body"})
+			return
+		}
+		share, err := app.store.GetShare(req.ShareID)
+		if err != nil || !ownedBy(r.Context(), share.Owner) {
+			writeJSON(w, http.StatusNotFound, GalleryResponse{Error: "Share not found"})
+			return
+		}
+
+		entry := &GalleryEntry{
+			ShareID:   share.ID,
+			Owner:     share.Owner,
+			Status:    GalleryPending,
+			Title:     share.Title,
+			Caption:   share.Caption,
+			Submitted: time.Now(),
+		}
+		entry.Theme, entry.Lighting = app.shareStyle(share)
+		err = app.store.SubmitToGallery(entry)
+		if errors.Is(err, ErrExists) {
+			writeJSON(w, http.StatusConflict, GalleryResponse{Error: "Already submitted to the gallery"})
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to submit share to gallery", "share_id", share.ID, "err", err)
+			writeJSON(w, http.StatusInternalServerError, GalleryResponse{Error: "Failed to submit to gallery"})
+			return
+		}
+		writeJSON(w, http.StatusCreated, GalleryResponse{Entry: entry, Success: true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// galleryHandler renders the public gallery page.
+func (app *App) galleryHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := app.approvedGallery(parseGalleryFilter(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list gallery", "err", err)
+		http.Error(w, "Failed to load gallery", http.StatusInternalServerError)
+		return
+	}
+	if err := app.templates.ExecuteTemplate(w, "gallery.html", page); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Template error", "template", "gallery.html", "err", err)
+	}
+}
+
+// approvedGallery returns one page of approved entries, most recently
+// approved first, along with the themes and styles available to filter by.
+func (app *App) approvedGallery(f galleryFilter) (galleryPage, error) {
+	approved, err := app.store.ListGallery(GalleryApproved)
+	if err != nil {
+		return galleryPage{}, err
+	}
+	sort.Slice(approved, func(i, j int) bool { return approved[i].Reviewed.After(approved[j].Reviewed) })
+
+	page := galleryPage{Theme: f.theme, Style: f.style}
+	themes, styles := map[string]bool{}, map[string]bool{}
+	var matched []*GalleryEntry
+	for _, e := range approved {
+		if e.Theme != "" && !themes[e.Theme] {
+			themes[e.Theme] = true
+			page.Themes = append(page.Themes, e.Theme)
+		}
+		if e.Lighting != "" && !styles[e.Lighting] {
+			styles[e.Lighting] = true
+			page.Styles = append(page.Styles, e.Lighting)
+		}
+		if (f.theme == "" || e.Theme == f.theme) && (f.style == "" || e.Lighting == f.style) {
+			matched = append(matched, e)
+		}
+	}
+	sort.Strings(page.Themes)
+	sort.Strings(page.Styles)
+
+	page.Pages = max(1, (len(matched)+galleryPageSize-1)/galleryPageSize)
+	page.Page = min(f.page, page.Pages)
+	start := (page.Page - 1) * galleryPageSize
+	page.Entries = app.galleryViews(matched[start:min(start+galleryPageSize, len(matched))])
+	if page.Page > 1 {
+		page.PrevURL = f.url(page.Page - 1)
+	}
+	if page.Page < page.Pages {
+		page.NextURL = f.url(page.Page + 1)
+	}
+	return page, nil
+}
+
+func (app *App) galleryViews(entries []*GalleryEntry) []GalleryView {
+	views := make([]GalleryView, 0, len(entries))
+	for _, e := range entries {
+		share, err := app.store.GetShare(e.ShareID)
+		if err != nil || len(share.AssetIDs) == 0 {
+			continue
+		}
+		view := GalleryView{GalleryEntry: e, ShareURL: shareURL(share)}
+		if a, err := app.store.GetAsset(share.AssetIDs[0]); err == nil {
+			view.ImageURL = a.URL()
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// shareStyle finds the theme and lighting of the scene behind a share. For a
+// comic the first panel that has them wins.
+func (app *App) shareStyle(share *Share) (theme, lighting string) {
+	if share.Kind == ShareAsset {
+		if a, err := app.store.GetAsset(share.TargetID); err == nil {
+			return a.Theme, a.Lighting
+		}
+		return "", ""
+	}
+
+	panels, err := app.store.Panels(share.TargetID)
+	if err != nil {
+		return "", ""
+	}
+	for _, p := range panels {
+		for _, id := range []string{p.SceneID, p.ComposedID} {
+			if id == "" {
+				continue
+			}
+			if a, err := app.store.GetAsset(id); err == nil && a.Theme != "" {
+				return a.Theme, a.Lighting
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addGalleryEntry shares a new panel and puts it in the gallery as status.
+func addGalleryEntry(t *testing.T, app *App, theme, status string, reviewed time.Time) string {
+	t.Helper()
+	panel := &Asset{ID: newID(), Kind: AssetPanel, Owner: "alice", Filename: "p.png", Theme: theme}
+	share := &Share{ID: newID(), Owner: "alice", Kind: ShareAsset, TargetID: panel.ID, AssetIDs: []string{panel.ID}, Created: reviewed}
+	entry := &GalleryEntry{ShareID: share.ID, Owner: "alice", Status: status, Theme: theme, Lighting: "golden hour", Submitted: reviewed, Reviewed: reviewed}
+	if err := app.store.PutAsset(panel); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.store.CreateShare(share); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.store.SubmitToGallery(entry); err != nil {
+		t.Fatal(err)
+	}
+	return share.ID
+}
+
+func TestApprovedGallery(t *testing.T) {
+	app := testApp(t)
+	now := time.Now()
+	for i := range galleryPageSize + 2 {
+		addGalleryEntry(t, app, "space", GalleryApproved, now.Add(-time.Duration(i)*time.Minute))
+	}
+	newest := addGalleryEntry(t, app, "jungle", GalleryApproved, now.Add(time.Minute))
+	addGalleryEntry(t, app, "jungle", GalleryPending, now)
+	addGalleryEntry(t, app, "jungle", GalleryRejected, now)
+
+	page, err := app.approvedGallery(galleryFilter{page: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Pages != 2 || len(page.Entries) != galleryPageSize || page.NextURL == "" || page.PrevURL != "" {
+		t.Errorf("first page: %d of %d pages with %d entries", page.Page, page.Pages, len(page.Entries))
+	}
+	if page.Entries[0].ShareID != newest {
+		t.Error("most recently approved entry isn't first")
+	}
+	if strings.Join(page.Themes, ",") != "jungle,space" {
+		t.Errorf("themes %v", page.Themes)
+	}
+
+	page, _ = app.approvedGallery(galleryFilter{theme: "jungle", page: 5})
+	if page.Page != 1 || len(page.Entries) != 1 || page.Entries[0].ShareID != newest {
+		t.Errorf("jungle filter: page %d with %d entries", page.Page, len(page.Entries))
+	}
+}
+
+func TestGallerySubmitOnce(t *testing.T) {
+	app := testApp(t)
+	share := &Share{ID: newID(), Owner: "alice", Kind: ShareAsset, Created: time.Now()}
+	if err := app.store.CreateShare(share); err != nil {
+		t.Fatal(err)
+	}
+	submit := func(session string) int {
+		body := fmt.Sprintf(`{"shareId":%q}`, share.ID)
+		w := httptest.NewRecorder()
+		app.apiGalleryHandler(w, asSession(httptest.NewRequest(http.MethodPost, "/api/gallery", strings.NewReader(body)), session))
+		return w.Code
+	}
+	for _, tt := range []struct {
+		session string
+		want    int
+	}{
+		{"bob", http.StatusNotFound},
+		{"alice", http.StatusCreated},
+		{"alice", http.StatusConflict},
+	} {
+		if code := submit(tt.session); code != tt.want {
+			t.Errorf("%s submitting: status %d, want %d", tt.session, code, tt.want)
+		}
+	}
+	if entry, err := app.store.GetGalleryEntry(share.ID); err != nil || entry.Status != GalleryPending {
+		t.Errorf("submission not queued for moderation: %+v, %v", entry, err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	defaultFrameMs  = 1500
+	minFrameMs      = 100
+	maxFrameMs      = 10000
+	fadeSteps       = 4
+	fadeStepMs      = 80
+	maxPaletteColor = 256
+	// Roughly this many pixels are sampled across all frames when building
+	// the shared palette.
+	paletteSamples = 200000
+)
+
+// gifTarget is a size budget for a destination such as a messaging app.
+type gifTarget struct {
+	maxBytes      int
+	width, height int
+}
+
+// Messaging apps tend to re-encode or refuse large GIFs, so that target is
+// kept small; social posts can afford bigger frames.
+var gifTargets = map[string]gifTarget{
+	"messaging": {maxBytes: 5 << 20, width: 480, height: 360},
+	"social":    {maxBytes: 15 << 20, width: 800, height: 600},
+}
+
+type GIFExportRequest struct {
+	ComicID     string       `json:"comicId"`
+	Panels      []ComicPanel `json:"panels"`
+	FrameMs     int          `json:"frameMs"`
+	CaptionFade bool         `json:"captionFade"`
+	// Loop follows image/gif: 0 loops forever, -1 plays once and n repeats
+	// the animation n more times.
+	Loop   int    `json:"loop"`
+	Target string `json:"target"`
+}
+
+type GIFExportResponse struct {
+	URL          string `json:"url"`
+	Bytes        int    `json:"bytes"`
+	WithinTarget bool   `json:"withinTarget"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+}
+
+// gifFrame is a rendered frame and how long it stays on screen.
+type gifFrame struct {
+	img   *image.RGBA
+	delay time.Duration
+}
+
+func (app *App) apiComicGIFHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req GIFExportRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxComicRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, GIFExportResponse{Error: "Invalid JSON body"})
+		return
+	}
+	if req.ComicID != "" {
+		if !app.useStoredComic(r.Context(), w, req.ComicID, &req.Panels, nil) {
+			return
+		}
+	}
+	if len(req.Panels) == 0 || len(req.Panels) > maxComicPanels {
+		writeJSON(w, http.StatusBadRequest, GIFExportResponse{Error: fmt.Sprintf("Between 1 and %d panels required", maxComicPanels)})
+		return
+	}
+	if req.Target == "" {
+		req.Target = "messaging"
+	}
+	if _, ok := gifTargets[req.Target]; !ok {
+		writeJSON(w, http.StatusBadRequest, GIFExportResponse{Error: "target must be messaging or social"})
+		return
+	}
+	if req.Loop < -1 {
+		writeJSON(w, http.StatusBadRequest, GIFExportResponse{Error: "loop must be -1 or greater"})
+		return
+	}
+	if err := app.resolvePanels(r.Context(), req.Panels); err != nil {
+		writeJSON(w, http.StatusBadRequest, GIFExportResponse{Error: err.Error()})
+		return
+	}
+
+	resp, err := app.exportComicGIF(r.Context(), req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GIF export failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, GIFExportResponse{Error: "Failed to export GIF"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// exportComicGIF renders every panel as a frame and encodes them, shrinking
+// the frames and palette until the result fits the target's byte budget.
+func (app *App) exportComicGIF(ctx context.Context, req GIFExportRequest) (GIFExportResponse, error) {
+	target := gifTargets[req.Target]
+
+	loaded := make([]layoutPanel, 0, len(req.Panels))
+	for i, p := range req.Panels {
+		_, data, err := app.loadAsset(ctx, p.AssetID, panelKinds...)
+		if err != nil {
+			return GIFExportResponse{}, fmt.Errorf("failed to load panel %d: %w", i+1, err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return GIFExportResponse{}, fmt.Errorf("failed to decode panel %d: %v", i+1, err)
+		}
+		loaded = append(loaded, layoutPanel{img: img, caption: p.Caption})
+	}
+
+	// Each attempt trades quality for size: first fewer colours, then
+	// smaller frames, and finally no dithering.
+	attempts := []struct {
+		scale  float64
+		colors int
+		dither bool
+	}{
+		{1, 256, true},
+		{1, 128, true},
+		{0.75, 128, true},
+		{0.75, 64, true},
+		{0.5, 64, true},
+		{0.5, 32, false},
+	}
+
+	var data []byte
+	for _, a := range attempts {
+		w := int(float64(target.width) * a.scale)
+		h := int(float64(target.height) * a.scale)
+		frames, err := buildGIFFrames(loaded, req, w, h)
+		if err != nil {
+			return GIFExportResponse{}, err
+		}
+		data, err = encodeComicGIF(frames, req.Loop, a.colors, a.dither)
+		if err != nil {
+			return GIFExportResponse{}, fmt.Errorf("failed to encode GIF: %v", err)
+		}
+		if len(data) <= target.maxBytes {
+			break
+		}
+		slog.DebugContext(ctx, "GIF over budget, retrying smaller", "bytes", len(data), "width", w, "height", h, "colors", a.colors, "target", req.Target, "budget", target.maxBytes)
+	}
+
+	asset := &Asset{Kind: AssetAnimation}
+	if err := app.saveAsset(ctx, asset, data, "gif"); err != nil {
+		return GIFExportResponse{}, fmt.Errorf("failed to save GIF: %v", err)
+	}
+
+	return GIFExportResponse{
+		URL:          asset.URL(),
+		Bytes:        len(data),
+		WithinTarget: len(data) <= target.maxBytes,
+		Success:      true,
+	}, nil
+}
+
+// buildGIFFrames renders one hold frame per panel. With captionFade the
+// caption box is blended in over a few short frames first.
+func buildGIFFrames(panels []layoutPanel, req GIFExportRequest, width, height int) ([]gifFrame, error) {
+	var frames []gifFrame
+	for i, p := range panels {
+		hold := req.FrameMs
+		if ms := req.Panels[i].DurationMs; ms > 0 {
+			hold = ms
+		}
+		if hold == 0 {
+			hold = defaultFrameMs
+		}
+		hold = max(minFrameMs, min(hold, maxFrameMs))
+
+		full, err := drawPanel(p.img, PanelSpec{Width: width, Height: height, Caption: p.caption})
+		if err != nil {
+			return nil, err
+		}
+
+		if req.CaptionFade && p.caption != "" {
+			bare, err := drawPanel(p.img, PanelSpec{Width: width, Height: height})
+			if err != nil {
+				return nil, err
+			}
+			for step := 0; step < fadeSteps; step++ {
+				alpha := uint8(255 * step / fadeSteps)
+				frame := image.NewRGBA(bare.Bounds())
+				draw.Draw(frame, frame.Bounds(), bare, image.Point{}, draw.Src)
+				draw.DrawMask(frame, frame.Bounds(), full, image.Point{}, image.NewUniform(color.Alpha{alpha}), image.Point{}, draw.Over)
+				frames = append(frames, gifFrame{img: frame, delay: fadeStepMs * time.Millisecond})
+			}
+		}
+
+		frames = append(frames, gifFrame{img: full, delay: time.Duration(hold) * time.Millisecond})
+	}
+	return frames, nil
+}
+
+// encodeComicGIF quantises every frame against one shared palette so colours
+// don't shimmer between panels.
+func encodeComicGIF(frames []gifFrame, loop, colors int, dither bool) ([]byte, error) {
+	palette := figurinePalette(frames, colors)
+
+	anim := &gif.GIF{LoopCount: loop}
+	for _, f := range frames {
+		b := f.img.Bounds()
+		pm := image.NewPaletted(b, palette)
+		if dither {
+			draw.FloydSteinberg.Draw(pm, b, f.img, b.Min)
+		} else {
+			draw.Draw(pm, b, f.img, b.Min, draw.Src)
+		}
+		anim.Image = append(anim.Image, pm)
+		anim.Delay = append(anim.Delay, int(f.delay/(10*time.Millisecond)))
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// paletteEntry is a 5-bit-per-channel histogram bucket.
+type paletteEntry struct {
+	r, g, b uint8
+	weight  int
+}
+
+// figurinePalette builds an adaptive palette with median cut. It is tuned for
+// the glossy plastic look: the panel ink and paper colours are always kept,
+// and specular highlights and saturated toy colours are over-weighted so
+// they get their own entries rather than being averaged into muddy mid-tones.
+func figurinePalette(frames []gifFrame, size int) color.Palette {
+	fixed := color.Palette{panelInk, panelPaper, color.RGBA{0, 0, 0, 0xff}}
+	size = max(len(fixed)+1, min(size, maxPaletteColor))
+
+	total := 0
+	for _, f := range frames {
+		total += f.img.Bounds().Dx() * f.img.Bounds().Dy()
+	}
+	stride := max(1, total/paletteSamples)
+
+	hist := make(map[uint16]*paletteEntry)
+	n := 0
+	for _, f := range frames {
+		pix := f.img.Pix
+		for i := 0; i+3 < len(pix); i += 4 {
+			if n++; n%stride != 0 {
+				continue
+			}
+			r, g, b := pix[i], pix[i+1], pix[i+2]
+			key := uint16(r>>3)<<10 | uint16(g>>3)<<5 | uint16(b>>3)
+			e, ok := hist[key]
+			if !ok {
+				e = &paletteEntry{r: r &^ 7, g: g &^ 7, b: b &^ 7}
+				hist[key] = e
+			}
+			e.weight += glossWeight(r, g, b)
+		}
+	}
+
+	entries := make([]paletteEntry, 0, len(hist))
+	for _, e := range hist {
+		entries = append(entries, *e)
+	}
+
+	palette := append(color.Palette{}, fixed...)
+	for _, c := range medianCut(entries, size-len(fixed)) {
+		palette = append(palette, c)
+	}
+	return palette
+}
+
+// glossWeight boosts bright highlights and saturated colours.
+func glossWeight(r, g, b uint8) int {
+	hi := max(r, g, b)
+	lo := min(r, g, b)
+	w := 1
+	if hi > 220 && int(hi)-int(lo) < 40 {
+		w += 2
+	}
+	if int(hi)-int(lo) > 120 {
+		w++
+	}
+	return w
+}
+
+func medianCut(entries []paletteEntry, n int) []color.Color {
+	if len(entries) == 0 || n <= 0 {
+		return nil
+	}
+
+	boxes := [][]paletteEntry{entries}
+	for len(boxes) < n {
+		// Split the box with the widest spread, weighted by population.
+		best, bestScore, bestAxis := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			axis, spread := widestAxis(box)
+			score := spread * boxWeight(box)
+			if score > bestScore {
+				best, bestScore, bestAxis = i, score, axis
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return channel(box[i], bestAxis) < channel(box[j], bestAxis) })
+		half, acc := boxWeight(box)/2, 0
+		split := 1
+		for i, e := range box {
+			acc += e.weight
+			if acc >= half {
+				split = max(1, min(i+1, len(box)-1))
+				break
+			}
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	colors := make([]color.Color, 0, len(boxes))
+	for _, box := range boxes {
+		var r, g, b, w int
+		for _, e := range box {
+			r += int(e.r) * e.weight
+			g += int(e.g) * e.weight
+			b += int(e.b) * e.weight
+			w += e.weight
+		}
+		colors = append(colors, color.RGBA{uint8(r / w), uint8(g / w), uint8(b / w), 0xff})
+	}
+	return colors
+}
+
+func widestAxis(box []paletteEntry) (axis, spread int) {
+	for a := 0; a < 3; a++ {
+		lo, hi := 255, 0
+		for _, e := range box {
+			v := channel(e, a)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		if hi-lo > spread {
+			axis, spread = a, hi-lo
+		}
+	}
+	return axis, spread
+}
+
+func boxWeight(box []paletteEntry) int {
+	w := 0
+	for _, e := range box {
+		w += e.weight
+	}
+	return w
+}
+
+func channel(e paletteEntry, axis int) int {
+	switch axis {
+	case 0:
+		return int(e.r)
+	case 1:
+		return int(e.g)
+	}
+	return int(e.b)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func solidImage(c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestBuildGIFFrames(t *testing.T) {
+	panels := []layoutPanel{
+		{img: solidImage(color.RGBA{0xff, 0xd7, 0x00, 0xff}), caption: "Meanwhile..."},
+		{img: solidImage(color.RGBA{0x20, 0x60, 0xc0, 0xff})},
+	}
+	req := GIFExportRequest{
+		Panels:      []ComicPanel{{DurationMs: 50}, {DurationMs: 0}},
+		FrameMs:     maxFrameMs * 2,
+		CaptionFade: true,
+	}
+	frames, err := buildGIFFrames(panels, req, 160, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The captioned panel fades in over fadeSteps frames; the other doesn't.
+	if want := fadeSteps + 2; len(frames) != want {
+		t.Fatalf("got %d frames, want %d", len(frames), want)
+	}
+	if got := frames[0].delay; got != fadeStepMs*time.Millisecond {
+		t.Errorf("fade frame held %v", got)
+	}
+	if got := frames[fadeSteps].delay; got != minFrameMs*time.Millisecond {
+		t.Errorf("short panel held %v, want it raised to %dms", got, minFrameMs)
+	}
+	if got := frames[fadeSteps+1].delay; got != maxFrameMs*time.Millisecond {
+		t.Errorf("long panel held %v, want it capped at %dms", got, maxFrameMs)
+	}
+	for _, f := range frames {
+		if f.img.Bounds().Size() != image.Pt(160, 120) {
+			t.Errorf("frame is %v", f.img.Bounds())
+		}
+	}
+}
+
+func TestEncodeComicGIF(t *testing.T) {
+	frames := []gifFrame{
+		{img: solidImage(color.RGBA{0xff, 0xd7, 0x00, 0xff}), delay: 1500 * time.Millisecond},
+		{img: solidImage(color.RGBA{0x20, 0x60, 0xc0, 0xff}), delay: 80 * time.Millisecond},
+	}
+	data, err := encodeComicGIF(frames, -1, 16, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 2 || anim.Delay[0] != 150 || anim.Delay[1] != 8 {
+		t.Errorf("got %d frames with delays %v", len(anim.Image), anim.Delay)
+	}
+	if anim.LoopCount != -1 {
+		t.Errorf("loop count %d, want -1", anim.LoopCount)
+	}
+}
+
+func TestFigurinePaletteKeepsInkAndPaper(t *testing.T) {
+	frames := []gifFrame{{img: solidImage(color.RGBA{0xff, 0xd7, 0x00, 0xff})}}
+	palette := figurinePalette(frames, 8)
+	if len(palette) > 8 {
+		t.Errorf("palette has %d colours, want at most 8", len(palette))
+	}
+	for _, c := range []color.Color{panelInk, panelPaper} {
+		if palette.Index(c) >= len(palette) || palette[palette.Index(c)] != c {
+			t.Errorf("palette lost %v", c)
+		}
+	}
+}
+
+func TestComicGIFRejectsOversizedRequests(t *testing.T) {
+	app := testApp(t)
+	panel := &Asset{ID: newID(), Kind: AssetPanel, Owner: "alice", Filename: "panel.png"}
+	if err := app.store.PutAsset(panel); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{
+		"long caption": `{"panels":[{"assetId":"` + panel.ID + `","caption":"` + strings.Repeat("x", maxCaptionLength+1) + `"}]}`,
+		"huge body":    `{"panels":[{"assetId":"` + panel.ID + `","caption":"` + strings.Repeat("x", maxComicRequestSize) + `"}]}`,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/comic/gif", strings.NewReader(body))
+		app.apiComicGIFHandler(w, asSession(r, "alice"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// modelPrice is a model's list price in USD per million tokens.
+type modelPrice struct {
+	Input, Output float64
+}
+
+// modelPrices estimate what each job cost. They are list prices at the time
+// of writing; update them when Google changes its pricing.
+var modelPrices = map[string]modelPrice{
+	geminiTextModel:  {Input: 0.075, Output: 0.30},
+	geminiImageModel: {Input: 0.30, Output: 30},
+}
+
+// Cost estimates the stage's cost in USD from its token counts.
+func (s JobStage) Cost() float64 {
+	p := modelPrices[s.Model]
+	return (float64(s.InputTokens)*p.Input + float64(s.OutputTokens)*p.Output) / 1e6
+}
+
+// Cost estimates the job's cost in USD.
+func (j *Job) Cost() float64 {
+	total := 0.0
+	for _, s := range j.Stages {
+		total += s.Cost()
+	}
+	return total
+}
+
+func (j *Job) Failed() bool {
+	return j.Error != ""
+}
+
+// retryableJobs are the job kinds whose inputs are all kept, so they can be
+// run again. Figurine jobs aren't, since the uploaded photo isn't stored.
+var retryableJobs = map[string]bool{StageScene: true, StageCompose: true}
+
+// Retryable reports whether an admin can run the job again.
+func (j *Job) Retryable() bool {
+	return j.Failed() && retryableJobs[j.Kind]
+}
+
+// startJob starts recording a job. Model calls made with the returned
+// context are added to it as stages, and finishJob saves it.
+func (app *App) startJob(ctx context.Context, kind string, input map[string]string) (context.Context, *Job) {
+	started := time.Now()
+	job := &Job{
+		ID:      newJobID(started),
+		Kind:    kind,
+		Session: sessionID(ctx),
+		Input:   input,
+		Started: started,
+	}
+	return context.WithValue(ctx, jobKey, job), job
+}
+
+// finishJob records the job's outcome. Failing to save it is logged but
+// doesn't fail the request.
+func (app *App) finishJob(ctx context.Context, job *Job, err error) {
+	job.Duration = time.Since(job.Started).Round(time.Millisecond)
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if err := app.store.PutJob(job); err != nil {
+		slog.ErrorContext(ctx, "Failed to record job", "job_id", job.ID, "err", err)
+	}
+}
+
+// jobFromContext returns the job being recorded, or nil.
+func jobFromContext(ctx context.Context) *Job {
+	job, _ := ctx.Value(jobKey).(*Job)
+	return job
+}
+
+// recordStage adds a model call to the context's job, if there is one.
+func recordStage(ctx context.Context, stage, outcome string, took time.Duration, resp *genai.GenerateContentResponse, err error) {
+	job := jobFromContext(ctx)
+	if job == nil {
+		return
+	}
+	s := JobStage{
+		Stage:    stage,
+		Model:    stageModels[stage],
+		Duration: took.Round(time.Millisecond),
+		Outcome:  outcome,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if resp != nil && resp.UsageMetadata != nil {
+		s.InputTokens = resp.UsageMetadata.PromptTokenCount
+		s.OutputTokens = resp.UsageMetadata.CandidatesTokenCount
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Stages = append(job.Stages, s)
+}
+
+// retryJob runs a failed job again with its original inputs, on behalf of
+// the session that started it, and records the new run.
+func (app *App) retryJob(ctx context.Context, old *Job) (*Job, error) {
+	if !old.Retryable() {
+		return nil, fmt.Errorf("%s job %s can't be retried", old.Kind, old.ID)
+	}
+	ctx = context.WithValue(ctx, sessionKey, old.Session)
+	ctx, job := app.startJob(ctx, old.Kind, old.Input)
+	job.RetryOf = old.ID
+
+	var err error
+	switch old.Kind {
+	case StageScene:
+		_, err = app.generateScene(ctx, old.Input["theme"], old.Input["lighting"], old.Input["prompt"], 1)
+	case StageCompose:
+		_, _, err = app.composeScene(ctx, old.Input["figurineId"], old.Input["backgroundId"])
+	}
+	app.finishJob(ctx, job, err)
+	return job, nil
+}
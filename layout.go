@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Named page layouts for multi-panel comics.
+const (
+	LayoutStrip   = "strip"
+	LayoutGrid    = "grid-2x2"
+	LayoutManga   = "manga"
+	LayoutSplash  = "splash"
+	LayoutWebtoon = "webtoon"
+)
+
+const (
+	defaultGutter   = 20
+	maxGutter       = 200
+	minPageSide     = 200
+	maxPageSide     = 6000
+	maxComicPanels  = 64
+	titleBandHeight = 90
+	creditsBand     = 50
+	titleFontSize   = 44
+	creditsFontSize = 18
+
+	// maxPagePixels caps a page's area at that of the largest page the size
+	// limits allow, so a webtoon page can't be stretched past it.
+	maxPagePixels = maxPageSide * maxPageSide
+
+	// maxComicRequestSize bounds the JSON body of the page, export and GIF
+	// endpoints: room for maxComicPanels panels with full captions.
+	maxComicRequestSize = 256 << 10
+)
+
+var pageBackground = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+
+// panelKinds are the assets that can be placed in a comic.
+var panelKinds = []string{AssetComposite, AssetPanel}
+
+// ComicPanel is one lettered panel in a comic, in reading order.
+type ComicPanel struct {
+	AssetID string `json:"assetId"`
+	// Deprecated: send AssetID. URLs are still resolved through the asset
+	// index for older clients.
+	ImageURL string `json:"imageUrl,omitempty"`
+	Caption  string `json:"caption"`
+	// DurationMs is how long the panel is held in animated exports.
+	DurationMs int `json:"durationMs,omitempty"`
+}
+
+// LayoutOptions controls how panels are arranged into pages. Zero values
+// pick the layout's defaults.
+type LayoutOptions struct {
+	Layout     string `json:"layout"`
+	Title      string `json:"title"`
+	Credits    string `json:"credits"`
+	Gutter     int    `json:"gutter"`
+	PageWidth  int    `json:"pageWidth"`
+	PageHeight int    `json:"pageHeight"`
+}
+
+type ComicPagesRequest struct {
+	// ComicID renders a saved comic; otherwise Panels is used as given.
+	ComicID string       `json:"comicId"`
+	Panels  []ComicPanel `json:"panels"`
+	LayoutOptions
+}
+
+type ComicPagesResponse struct {
+	Pages   []string `json:"pages"`
+	Success bool     `json:"success"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// pageGrid is the cell grid used on a single page.
+type pageGrid struct {
+	cols, rows, count int
+}
+
+// pagePlan is a fully resolved page: its pixel size and one cell per panel,
+// in reading order.
+type pagePlan struct {
+	size  image.Point
+	cells []image.Rectangle
+	first bool
+	last  bool
+}
+
+// layoutPanel is a panel whose artwork has already been loaded.
+type layoutPanel struct {
+	img     image.Image
+	caption string
+}
+
+func (app *App) apiComicPagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ComicPagesRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxComicRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicPagesResponse{Error: "Invalid JSON body"})
+		return
+	}
+	if req.ComicID != "" {
+		if !app.useStoredComic(r.Context(), w, req.ComicID, &req.Panels, &req.LayoutOptions) {
+			return
+		}
+	}
+	if len(req.Panels) == 0 {
+		writeJSON(w, http.StatusBadRequest, ComicPagesResponse{Error: "At least one panel required"})
+		return
+	}
+	if len(req.Panels) > maxComicPanels {
+		writeJSON(w, http.StatusBadRequest, ComicPagesResponse{Error: fmt.Sprintf("At most %d panels allowed", maxComicPanels)})
+		return
+	}
+	if err := req.LayoutOptions.validateFor(len(req.Panels)); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicPagesResponse{Error: err.Error()})
+		return
+	}
+	if err := app.resolvePanels(r.Context(), req.Panels); err != nil {
+		writeJSON(w, http.StatusBadRequest, ComicPagesResponse{Error: err.Error()})
+		return
+	}
+
+	pages, err := app.renderComicPages(r.Context(), req.Panels, req.LayoutOptions)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Comic layout failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, ComicPagesResponse{Error: "Failed to lay out comic"})
+		return
+	}
+
+	urls := make([]string, 0, len(pages))
+	for _, page := range pages {
+		urls = append(urls, page.URL())
+	}
+	writeJSON(w, http.StatusOK, ComicPagesResponse{Pages: urls, Success: true})
+}
+
+func (opts LayoutOptions) validate() error {
+	switch opts.Layout {
+	case "", LayoutStrip, LayoutGrid, LayoutManga, LayoutSplash, LayoutWebtoon:
+	default:
+		return fmt.Errorf("unknown layout %q", opts.Layout)
+	}
+	if opts.Gutter < 0 || opts.Gutter > maxGutter {
+		return fmt.Errorf("gutter must be between 0 and %d", maxGutter)
+	}
+	for _, side := range []int{opts.PageWidth, opts.PageHeight} {
+		if side != 0 && (side < minPageSide || side > maxPageSide) {
+			return fmt.Errorf("page sides must be between %d and %dpx", minPageSide, maxPageSide)
+		}
+	}
+	return nil
+}
+
+// validateFor checks the options like validate and that n panels fit: a
+// webtoon's single page grows with every panel, so it is limited to
+// maxPagePixels.
+func (opts LayoutOptions) validateFor(n int) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if opts.Layout == LayoutWebtoon {
+		size := planWebtoon(n, opts).size
+		if size.X*size.Y > maxPagePixels {
+			return fmt.Errorf("a webtoon %dpx wide fits at most %dpx of height; use fewer panels or a narrower page", size.X, maxPagePixels/size.X)
+		}
+	}
+	return nil
+}
+
+// resolvePanels fills in each panel's AssetID from its deprecated ImageURL
+// and checks that every panel is artwork the session created, with a
+// caption no longer than a stored panel's.
+func (app *App) resolvePanels(ctx context.Context, panels []ComicPanel) error {
+	for i := range panels {
+		if len(panels[i].Caption) > maxCaptionLength {
+			return fmt.Errorf("panel %d: caption must be at most %d characters", i+1, maxCaptionLength)
+		}
+		id, err := app.resolveAssetRef(panels[i].AssetID, panels[i].ImageURL, "assetId")
+		if err != nil {
+			return fmt.Errorf("panel %d: %v", i+1, err)
+		}
+		if _, err := app.checkAsset(ctx, id, panelKinds...); err != nil {
+			return fmt.Errorf("panel %d: %v", i+1, err)
+		}
+		panels[i].AssetID = id
+	}
+	return nil
+}
+
+// renderComicPages lays the panels out and stores each page as a PNG upload,
+// returning the page assets in order.
+func (app *App) renderComicPages(ctx context.Context, panels []ComicPanel, opts LayoutOptions) ([]*Asset, error) {
+	pages, err := app.layoutComic(ctx, panels, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var assets []*Asset
+	for i, page := range pages {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, page); err != nil {
+			return nil, fmt.Errorf("failed to encode page %d: %v", i+1, err)
+		}
+		asset := &Asset{Kind: AssetPage}
+		if err := app.saveAsset(ctx, asset, buf.Bytes(), "png"); err != nil {
+			return nil, fmt.Errorf("failed to save page %d: %v", i+1, err)
+		}
+		assets = append(assets, asset)
+	}
+	return assets, nil
+}
+
+// layoutComic loads the artwork for every panel and draws the pages.
+func (app *App) layoutComic(ctx context.Context, panels []ComicPanel, opts LayoutOptions) ([]*image.RGBA, error) {
+	loaded := make([]layoutPanel, 0, len(panels))
+	for i, p := range panels {
+		_, data, err := app.loadAsset(ctx, p.AssetID, panelKinds...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load panel %d: %w", i+1, err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode panel %d: %v", i+1, err)
+		}
+		loaded = append(loaded, layoutPanel{img: img, caption: p.Caption})
+	}
+	return drawComicPages(loaded, opts)
+}
+
+func drawComicPages(panels []layoutPanel, opts LayoutOptions) ([]*image.RGBA, error) {
+	plans, err := planComic(len(panels), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []*image.RGBA
+	next := 0
+	for _, plan := range plans {
+		page := image.NewRGBA(image.Rectangle{Max: plan.size})
+		draw.Draw(page, page.Bounds(), image.NewUniform(pageBackground), image.Point{}, draw.Src)
+
+		if plan.first && strings.TrimSpace(opts.Title) != "" {
+			band := image.Rect(0, opts.gutter(), plan.size.X, opts.gutter()+titleBandHeight)
+			if err := drawBandText(page, band, opts.Title, false, titleFontSize); err != nil {
+				return nil, err
+			}
+		}
+		if plan.last && strings.TrimSpace(opts.Credits) != "" {
+			band := image.Rect(0, plan.size.Y-opts.gutter()-creditsBand, plan.size.X, plan.size.Y-opts.gutter())
+			if err := drawBandText(page, band, opts.Credits, true, creditsFontSize); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, cell := range plan.cells {
+			p := panels[next]
+			next++
+			rendered, err := drawPanel(p.img, PanelSpec{Width: cell.Dx(), Height: cell.Dy(), Caption: p.caption})
+			if err != nil {
+				return nil, err
+			}
+			draw.Draw(page, cell, rendered, image.Point{}, draw.Src)
+		}
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
+
+func drawBandText(dst draw.Image, band image.Rectangle, text string, italic bool, size float64) error {
+	face, err := letteringFace(italic, size)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	lines := wrapText(face, text, band.Dx()-2*defaultGutter)
+	drawLines(dst, face, lines, band, panelInk)
+	return nil
+}
+
+func (opts LayoutOptions) gutter() int {
+	if opts.Gutter == 0 {
+		return defaultGutter
+	}
+	return opts.Gutter
+}
+
+// pageSize returns the requested page size, falling back to the layout's
+// default for any side left at zero.
+func (opts LayoutOptions) pageSize(defaultW, defaultH int) image.Point {
+	size := image.Pt(defaultW, defaultH)
+	if opts.PageWidth > 0 {
+		size.X = opts.PageWidth
+	}
+	if opts.PageHeight > 0 {
+		size.Y = opts.PageHeight
+	}
+	return size
+}
+
+// planComic decides how many pages are needed and where each panel goes.
+func planComic(n int, opts LayoutOptions) ([]pagePlan, error) {
+	if n == 0 {
+		return nil, fmt.Errorf("no panels to lay out")
+	}
+
+	switch opts.Layout {
+	case LayoutStrip:
+		return planGrids(opts.pageSize(1800, 700), splitGrids(n, 3, 1), opts, false), nil
+	case "", LayoutGrid:
+		return planGrids(opts.pageSize(1200, 1600), splitGrids(n, 2, 2), opts, false), nil
+	case LayoutManga:
+		return planGrids(opts.pageSize(1200, 1700), splitGrids(n, 2, 3), opts, true), nil
+	case LayoutSplash:
+		grids := []pageGrid{{cols: 1, rows: 1, count: 1}}
+		if n > 1 {
+			grids = append(grids, splitGrids(n-1, 2, 2)...)
+		}
+		return planGrids(opts.pageSize(1200, 1600), grids, opts, false), nil
+	case LayoutWebtoon:
+		return []pagePlan{planWebtoon(n, opts)}, nil
+	}
+	return nil, fmt.Errorf("unknown layout %q", opts.Layout)
+}
+
+// splitGrids fills as many cols×rows pages as needed for n panels.
+func splitGrids(n, cols, rows int) []pageGrid {
+	var grids []pageGrid
+	for n > 0 {
+		count := cols * rows
+		if n < count {
+			count = n
+		}
+		grids = append(grids, pageGrid{cols: cols, rows: rows, count: count})
+		n -= count
+	}
+	return grids
+}
+
+func planGrids(size image.Point, grids []pageGrid, opts LayoutOptions, rightToLeft bool) []pagePlan {
+	g := opts.gutter()
+	plans := make([]pagePlan, len(grids))
+	for i, grid := range grids {
+		plan := pagePlan{size: size, first: i == 0, last: i == len(grids)-1}
+		content := contentRect(plan, opts)
+
+		cellW := (content.Dx() - (grid.cols-1)*g) / grid.cols
+		cellH := (content.Dy() - (grid.rows-1)*g) / grid.rows
+		for j := 0; j < grid.count; j++ {
+			col, row := j%grid.cols, j/grid.cols
+			if rightToLeft {
+				col = grid.cols - 1 - col
+			}
+			x := content.Min.X + col*(cellW+g)
+			y := content.Min.Y + row*(cellH+g)
+			plan.cells = append(plan.cells, image.Rect(x, y, x+cellW, y+cellH))
+		}
+		plans[i] = plan
+	}
+	return plans
+}
+
+// planWebtoon stacks every panel in one tall page for vertical scrolling.
+// Only the page width is configurable; the height follows from the panels.
+func planWebtoon(n int, opts LayoutOptions) pagePlan {
+	g := opts.gutter()
+	width := opts.pageSize(800, 0).X
+	cellW := width - 2*g
+	cellH := cellW * 3 / 4
+
+	height := n*cellH + (n+1)*g
+	if strings.TrimSpace(opts.Title) != "" {
+		height += titleBandHeight + g
+	}
+	if strings.TrimSpace(opts.Credits) != "" {
+		height += creditsBand + g
+	}
+
+	plan := pagePlan{size: image.Pt(width, height), first: true, last: true}
+	content := contentRect(plan, opts)
+	for i := 0; i < n; i++ {
+		y := content.Min.Y + i*(cellH+g)
+		plan.cells = append(plan.cells, image.Rect(content.Min.X, y, content.Min.X+cellW, y+cellH))
+	}
+	return plan
+}
+
+// contentRect is the area of a page left for panels once the margins and the
+// title and credits bands are taken out.
+func contentRect(plan pagePlan, opts LayoutOptions) image.Rectangle {
+	g := opts.gutter()
+	r := image.Rect(0, 0, plan.size.X, plan.size.Y).Inset(g)
+	if plan.first && strings.TrimSpace(opts.Title) != "" {
+		r.Min.Y += titleBandHeight + g
+	}
+	if plan.last && strings.TrimSpace(opts.Credits) != "" {
+		r.Max.Y -= creditsBand + g
+	}
+	return r
+}
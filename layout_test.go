@@ -0,0 +1,102 @@
+package main
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlanComicPageCounts(t *testing.T) {
+	tests := []struct {
+		layout string
+		n      int
+		pages  int
+	}{
+		{LayoutStrip, 7, 3},
+		{LayoutGrid, 4, 1},
+		{LayoutGrid, 5, 2},
+		{LayoutManga, 6, 1},
+		{LayoutSplash, 5, 2},
+		{LayoutWebtoon, 10, 1},
+	}
+	for _, tt := range tests {
+		plans, err := planComic(tt.n, LayoutOptions{Layout: tt.layout})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.layout, err)
+		}
+		if len(plans) != tt.pages {
+			t.Errorf("%s with %d panels: got %d pages, want %d", tt.layout, tt.n, len(plans), tt.pages)
+		}
+		cells := 0
+		for _, plan := range plans {
+			page := image.Rect(0, 0, plan.size.X, plan.size.Y)
+			for _, cell := range plan.cells {
+				if cell.Empty() || !cell.In(page) {
+					t.Errorf("%s: cell %v is not inside page %v", tt.layout, cell, page)
+				}
+			}
+			cells += len(plan.cells)
+		}
+		if cells != tt.n {
+			t.Errorf("%s: got %d cells, want %d", tt.layout, cells, tt.n)
+		}
+	}
+	if _, err := planComic(0, LayoutOptions{}); err == nil {
+		t.Error("planned a comic with no panels")
+	}
+}
+
+func TestPlanGridsRightToLeft(t *testing.T) {
+	manga, err := planComic(2, LayoutOptions{Layout: LayoutManga})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, second := manga[0].cells[0], manga[0].cells[1]; first.Min.X <= second.Min.X {
+		t.Errorf("manga panels read left to right: %v then %v", first, second)
+	}
+}
+
+func TestPlanWebtoonTitleAndCredits(t *testing.T) {
+	bare := planWebtoon(3, LayoutOptions{})
+	titled := planWebtoon(3, LayoutOptions{Title: "Banana Quest", Credits: "by me"})
+	g := LayoutOptions{}.gutter()
+	if want := bare.size.Y + titleBandHeight + creditsBand + 2*g; titled.size.Y != want {
+		t.Errorf("titled webtoon is %dpx tall, want %d", titled.size.Y, want)
+	}
+	if titled.cells[0].Min.Y < titleBandHeight {
+		t.Errorf("first panel %v overlaps the title band", titled.cells[0])
+	}
+}
+
+func TestValidateForCapsWebtoonHeight(t *testing.T) {
+	if err := (LayoutOptions{Layout: LayoutWebtoon}).validateFor(maxComicPanels); err != nil {
+		t.Errorf("default webtoon width with %d panels: %v", maxComicPanels, err)
+	}
+	if err := (LayoutOptions{Layout: LayoutWebtoon, PageWidth: maxPageSide}).validateFor(maxComicPanels); err == nil {
+		t.Errorf("a %dpx wide webtoon of %d panels was accepted", maxPageSide, maxComicPanels)
+	}
+	if err := (LayoutOptions{Layout: LayoutGrid, PageWidth: maxPageSide, PageHeight: maxPageSide}).validateFor(maxComicPanels); err != nil {
+		t.Errorf("largest grid pages: %v", err)
+	}
+}
+
+func TestComicPagesRejectsOversizedRequests(t *testing.T) {
+	app := testApp(t)
+	panel := &Asset{ID: newID(), Kind: AssetPanel, Owner: "alice", Filename: "panel.png"}
+	if err := app.store.PutAsset(panel); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{
+		"long caption": `{"panels":[{"assetId":"` + panel.ID + `","caption":"` + strings.Repeat("x", maxCaptionLength+1) + `"}]}`,
+		"huge body":    `{"panels":[{"assetId":"` + panel.ID + `","caption":"` + strings.Repeat("x", maxComicRequestSize) + `"}]}`,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/comic/pages", strings.NewReader(body))
+		app.apiComicPagesHandler(w, asSession(r, "alice"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", name, w.Code)
+		}
+	}
+}
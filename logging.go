@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logUserText is set from LOG_USER_TEXT. Prompts, captions and the image
+// analysis describe the people in uploaded photos, so they stay out of the
+// logs unless it is turned on for debugging.
+var logUserText bool
+
+// setupLogging installs the default slog logger. LOG_LEVEL takes debug,
+// info, warn or error (default info) and LOG_FORMAT json or text (default
+// json, for log aggregation).
+func setupLogging() error {
+	var level slog.Level
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		if err := level.UnmarshalText([]byte(s)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q: %v", s, err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, want json or text", format)
+	}
+
+	logUserText = os.Getenv("LOG_USER_TEXT") == "true"
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// fatal logs err and exits, for failures during startup.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID and trace ID from the context to every
+// record, so a request can be followed through the pipeline with the
+// *Context logging functions.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// userText is text that came from, or describes, a user. It logs as its
+// length only, unless LOG_USER_TEXT is on.
+type userText string
+
+func (t userText) LogValue() slog.Value {
+	if logUserText {
+		return slog.StringValue(string(t))
+	}
+	return slog.StringValue(fmt.Sprintf("[redacted %d chars]", len(t)))
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits IDs accepted from a proxy to something safe to echo
+// into logs and headers.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the ID withRequestID gave the request, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withRequestID tags each request with an ID, reusing the one set by a
+// proxy when there is one, echoes it in the response and logs the request
+// when it finishes.
+func (app *App) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		// Static assets would drown out everything else at info
+		level := slog.LevelInfo
+		if strings.HasPrefix(r.URL.Path, "/static/") {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds())
+	})
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
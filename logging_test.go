@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserTextRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	defer func(old bool) { logUserText = old }(logUserText)
+	logUserText = false
+	logger.Info("Scene", "prompt", userText("a red-haired girl on a beach"))
+	if strings.Contains(buf.String(), "girl") || !strings.Contains(buf.String(), `"prompt":"[redacted 28 chars]"`) {
+		t.Errorf("user text leaked: %s", buf.String())
+	}
+
+	buf.Reset()
+	logUserText = true
+	logger.Info("Scene", "prompt", userText("a red-haired girl on a beach"))
+	if !strings.Contains(buf.String(), `"prompt":"a red-haired girl on a beach"`) {
+		t.Errorf("LOG_USER_TEXT didn't log the text: %s", buf.String())
+	}
+}
+
+func TestContextHandlerAddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}).With("component", "test")
+	ctx := context.WithValue(context.Background(), requestIDKey, "req-42")
+	logger.InfoContext(ctx, "Hello")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["request_id"] != "req-42" || record["component"] != "test" {
+		t.Errorf("got record %v", record)
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	app := &App{}
+	var seen string
+	handler := app.withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	}))
+
+	for incoming, keep := range map[string]bool{
+		"abc-123.proxy_1":       true,
+		"":                      false,
+		"bad id\nwith newline":  false,
+		strings.Repeat("a", 65): false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if incoming != "" {
+			r.Header.Set(requestIDHeader, incoming)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		echoed := w.Header().Get(requestIDHeader)
+		if echoed == "" || echoed != seen {
+			t.Errorf("%q: echoed %q but handler saw %q", incoming, echoed, seen)
+		}
+		if (echoed == incoming) != keep {
+			t.Errorf("%q: got request ID %q", incoming, echoed)
+		}
+	}
+}
@@ -2,22 +2,40 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/generative-ai-go/genai"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/option"
 )
 
 type App struct {
-	geminiClient *genai.Client
-	templates    *template.Template
+	geminiClient  *genai.Client
+	templates     *template.Template
+	store         *Store
+	sessionSecret []byte
+	adminPassword string
+	safety        *SafetyPolicy
+	policy        *PromptPolicy
+	draining      atomic.Bool
+	modelCheck    cachedCheck
+	retention     *RetentionPolicy
+	leases        assetLeases
+	stories       storyRunner
 }
 
 type FigurineResponse struct {
@@ -40,7 +58,24 @@ type CompositionResponse struct {
 }
 
 func main() {
+	if err := setupLogging(); err != nil {
+		fatal("Failed to configure logging", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "render-panel" {
+		if err := runRenderPanelCommand(os.Args[2:]); err != nil {
+			fatal("Failed to render panel", err)
+		}
+		return
+	}
+
 	ctx := context.Background()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		fatal("Failed to configure tracing", err)
+	}
+	defer shutdownTracing(ctx)
 	
 	apiKey := os.Getenv("GOOGLE_AI_API_KEY")
 	if apiKey == "" {
@@ -51,43 +86,137 @@ func main() {
 
 	geminiClient, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
-		log.Fatal("Failed to create Gemini client:", err)
+		fatal("Failed to create Gemini client", err)
 	}
 	defer geminiClient.Close()
 
-	// Using local file storage only
+	// Using local file storage only, with the asset index and comic
+	// projects kept in an embedded database
+	dbPath := os.Getenv("BANANAVERSE_DB")
+	if dbPath == "" {
+		dbPath = "data/bananaverse.db"
+	}
+	store, err := openStore(dbPath)
+	if err != nil {
+		fatal("Failed to open database", err)
+	}
+	defer store.Close()
 
 	templates, err := template.ParseGlob("templates/*.html")
 	if err != nil {
-		log.Fatal("Failed to parse templates:", err)
+		fatal("Failed to parse templates", err)
+	}
+	// HTMX fragments are named partials so they get the same contextual
+	// escaping as full pages
+	if _, err := templates.ParseGlob("templates/partials/*.html"); err != nil {
+		fatal("Failed to parse partials", err)
+	}
+
+	// Sessions are signed with SESSION_SECRET when set, otherwise with a
+	// key generated once and kept in the database
+	sessionSecret := []byte(os.Getenv("SESSION_SECRET"))
+	if len(sessionSecret) == 0 {
+		sessionSecret, err = store.SessionSecret()
+		if err != nil {
+			fatal("Failed to load session secret", err)
+		}
+	}
+
+	safety, err := loadSafetyPolicy(store)
+	if err != nil {
+		fatal("Failed to load safety settings", err)
+	}
+
+	retention, err := loadRetentionPolicy()
+	if err != nil {
+		fatal("Failed to load retention policy", err)
 	}
 
 	app := &App{
-		geminiClient: geminiClient,
-		templates:    templates,
+		geminiClient:  geminiClient,
+		templates:     templates,
+		store:         store,
+		sessionSecret: sessionSecret,
+		adminPassword: os.Getenv("ADMIN_PASSWORD"),
+		safety:        safety,
+		policy:        loadPromptPolicy(),
+		retention:     retention,
 	}
 
 	http.HandleFunc("/", app.indexHandler)
 	http.HandleFunc("/hx/figurine", app.figurineHandler)
+	http.HandleFunc("/hx/figurine/{id}", app.figurineVersionHandler)
+	http.HandleFunc("/hx/figurine/{id}/edit", app.figurineEditHandler)
 	http.HandleFunc("/hx/scene", app.sceneHandler)
+	http.HandleFunc("/hx/scene/{id}/edit", app.sceneEditHandler)
+	http.HandleFunc("/hx/candidates/{id}/choose", app.chooseCandidateHandler)
 	http.HandleFunc("/hx/compose", app.composeHandler)
 	http.HandleFunc("/hx/caption", app.captionHandler)
 	http.HandleFunc("/hx/random-adventures", app.randomAdventuresHandler)
+	http.HandleFunc("/hx/panel", app.panelHandler)
+	http.HandleFunc("/api/panel", app.apiPanelHandler)
+	http.HandleFunc("/api/comic/pages", app.apiComicPagesHandler)
+	http.HandleFunc("/api/comic/export", app.apiComicExportHandler)
+	http.HandleFunc("/api/comic/gif", app.apiComicGIFHandler)
+	http.HandleFunc("/api/comics", app.apiComicsHandler)
+	http.HandleFunc("/api/comics/{id}", app.apiComicHandler)
+	http.HandleFunc("/api/comics/{id}/panels", app.apiComicPanelsHandler)
+	http.HandleFunc("/api/comics/{id}/panels/{panelID}", app.apiComicPanelHandler)
+	http.HandleFunc("/api/comics/{id}/order", app.apiComicOrderHandler)
+	http.HandleFunc("/api/creations", app.apiCreationsHandler)
+	http.HandleFunc("/api/stories", app.apiStoriesHandler)
+	http.HandleFunc("/api/stories/{id}", app.apiStoryHandler)
+	http.HandleFunc("/api/assets/{id}/pin", app.apiAssetPinHandler)
+	http.HandleFunc("/api/shares", app.apiSharesHandler)
+	http.HandleFunc("/api/shares/{id}", app.apiShareHandler)
+	http.HandleFunc("/s/{id}", app.sharePageHandler)
+	http.HandleFunc("/api/gallery", app.apiGalleryHandler)
+	http.HandleFunc("/gallery", app.galleryHandler)
+	http.HandleFunc("/admin", app.requireAdmin(app.adminDashboardHandler))
+	http.HandleFunc("/admin/jobs/{id}/retry", app.requireAdmin(app.adminRetryHandler))
+	http.HandleFunc("/admin/assets/{id}/purge", app.requireAdmin(app.adminPurgeHandler))
+	http.HandleFunc("/admin/sessions/{id}/{action}", app.requireAdmin(app.adminBanHandler))
+	http.HandleFunc("/admin/moderation", app.requireAdmin(app.moderationHandler))
+	http.HandleFunc("/admin/gallery/{id}/{action}", app.requireAdmin(app.moderateHandler))
+	http.HandleFunc("/admin/safety", app.requireAdmin(app.adminSafetyHandler))
+	http.HandleFunc("/admin/policy", app.requireAdmin(app.adminPolicyLogHandler))
+	http.HandleFunc("/static/uploads/", app.uploadsHandler)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", app.healthzHandler)
+	http.HandleFunc("/readyz", app.readyzHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("Starting BananaVerse on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	go app.runRetention(ctx)
+	app.resumeStories(ctx)
+
+	slog.Info("Starting BananaVerse", "port", port)
+	handler := app.withRequestID(app.withSession(app.withCSRF(app.withTracing(withMetrics(http.DefaultServeMux)))))
+	if err := app.serve(":"+port, handler); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server stopped", "err", err)
+	} else {
+		slog.Info("Server stopped")
+	}
+	// Stories write to the store, so stop them before it is closed
+	if !app.stories.stop(storyStopTimeout) {
+		slog.Warn("Stories still running at shutdown")
+	}
+}
+
+// indexPage is the data for index.html.
+type indexPage struct {
+	CSRFToken string
 }
 
 func (app *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	if err := app.templates.ExecuteTemplate(w, "index.html", nil); err != nil {
+	page := indexPage{CSRFToken: app.csrfToken(r.Context())}
+	if err := app.templates.ExecuteTemplate(w, "index.html", page); err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
-		log.Printf("Template error: %v", err)
+		slog.ErrorContext(r.Context(), "Template error", "template", "index.html", "err", err)
 	}
 }
 
@@ -115,15 +244,24 @@ func (app *App) figurineHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to read image", http.StatusInternalServerError)
 		return
 	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.Int("bananaverse.upload_bytes", len(imageData)))
+
+	candidates, err := parseCandidates(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	figurineURL, err := app.transformToFigurine(r.Context(), imageData)
+	ctx, job := app.startJob(r.Context(), StageFigurine, nil)
+	figurines, err := app.transformToFigurine(ctx, imageData, candidates)
+	app.finishJob(ctx, job, err)
 	if err != nil {
-		log.Printf("Figurine transformation error: %v", err)
-		app.renderFigurineError(w, "Failed to transform image")
+		slog.ErrorContext(r.Context(), "Figurine transformation failed", "err", err)
+		app.renderFigurineError(w, userMessage(err, "Failed to transform image"))
 		return
 	}
 
-	app.renderFigurineSuccess(w, figurineURL)
+	app.renderCandidates(w, StageFigurine, figurines)
 }
 
 func (app *App) sceneHandler(w http.ResponseWriter, r *http.Request) {
@@ -136,57 +274,68 @@ func (app *App) sceneHandler(w http.ResponseWriter, r *http.Request) {
 	timeOfDay := r.FormValue("timeOfDay")
 	prompt := r.FormValue("prompt")
 
-	log.Printf("Scene request - Theme: '%s', TimeOfDay: '%s', Prompt: '%s'", theme, timeOfDay, prompt)
+	slog.DebugContext(r.Context(), "Scene request",
+		"theme", userText(theme), "lighting", userText(timeOfDay), "prompt", userText(prompt))
 
 	if theme == "" || timeOfDay == "" {
-		log.Printf("Scene request failed - missing required fields. Theme: '%s', TimeOfDay: '%s'", theme, timeOfDay)
 		http.Error(w, "Theme and time of day required", http.StatusBadRequest)
 		return
 	}
+	candidates, err := parseCandidates(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cleaned, err := app.checkPrompt(r.Context(), SourceUser, StageScene,
+		promptField{"theme", theme}, promptField{"lighting", timeOfDay}, promptField{"prompt", prompt})
+	if err != nil {
+		app.renderSceneError(w, userMessage(err, "Invalid scene description"))
+		return
+	}
+	theme, timeOfDay, prompt = cleaned[0], cleaned[1], cleaned[2]
 
-	sceneURL, err := app.generateScene(r.Context(), theme, timeOfDay, prompt)
+	ctx, job := app.startJob(r.Context(), StageScene, map[string]string{"theme": theme, "lighting": timeOfDay, "prompt": prompt})
+	scenes, err := app.generateScene(ctx, theme, timeOfDay, prompt, candidates)
+	app.finishJob(ctx, job, err)
 	if err != nil {
-		log.Printf("Scene generation error: %v", err)
-		app.renderSceneError(w, "Failed to generate scene")
+		slog.ErrorContext(r.Context(), "Scene generation failed", "err", err)
+		app.renderSceneError(w, userMessage(err, "Failed to generate scene"))
 		return
 	}
 
-	app.renderSceneSuccess(w, sceneURL)
+	app.renderCandidates(w, StageScene, scenes)
 }
 
 func (app *App) composeHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("=== COMPOSE HANDLER CALLED ===")
-	log.Printf("Method: %s", r.Method)
-	log.Printf("Content-Type: %s", r.Header.Get("Content-Type"))
-	log.Printf("User-Agent: %s", r.Header.Get("User-Agent"))
-	
 	if r.Method != http.MethodPost {
-		log.Printf("ERROR: Wrong method - expected POST, got %s", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	figurineURL := r.FormValue("figurineUrl")
-	backgroundURL := r.FormValue("backgroundUrl")
-
-	log.Printf("Form values received:")
-	log.Printf("  - figurineUrl: '%s'", figurineURL)
-	log.Printf("  - backgroundUrl: '%s'", backgroundURL)
-
-	if figurineURL == "" || backgroundURL == "" {
-		log.Printf("ERROR: Missing parameters - figurineUrl='%s', backgroundUrl='%s'", figurineURL, backgroundURL)
-		http.Error(w, "Both figurine and background URLs required", http.StatusBadRequest)
+	figurineID, err := app.resolveAssetRef(r.FormValue("figurineId"), r.FormValue("figurineUrl"), "figurineId")
+	if err != nil {
+		slog.WarnContext(r.Context(), "Bad figurine reference", "err", err)
+		http.Error(w, "A figurine you created is required", http.StatusBadRequest)
+		return
+	}
+	backgroundID, err := app.resolveAssetRef(r.FormValue("backgroundId"), r.FormValue("backgroundUrl"), "backgroundId")
+	if err != nil {
+		slog.WarnContext(r.Context(), "Bad background reference", "err", err)
+		http.Error(w, "A scene you created is required", http.StatusBadRequest)
 		return
 	}
 
-	composedURL, _, err := app.composeScene(r.Context(), figurineURL, backgroundURL)
+	ctx, job := app.startJob(r.Context(), StageCompose, map[string]string{"figurineId": figurineID, "backgroundId": backgroundID})
+	composed, _, err := app.composeScene(ctx, figurineID, backgroundID)
+	app.finishJob(ctx, job, err)
 	if err != nil {
-		log.Printf("Composition error: %v", err)
-		app.renderCompositionError(w, "Failed to compose scene")
+		slog.ErrorContext(r.Context(), "Composition failed", "err", err)
+		app.renderCompositionError(w, userMessage(err, "Failed to compose scene"))
 		return
 	}
 
-	app.renderCompositionSuccess(w, composedURL, "")
+	app.renderCompositionSuccess(w, composed, "")
 }
 
 func (app *App) captionHandler(w http.ResponseWriter, r *http.Request) {
@@ -196,50 +345,84 @@ func (app *App) captionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	prompt := r.FormValue("prompt")
+	// A scene the session generated can stand in for the description
+	if sceneID := r.FormValue("sceneId"); sceneID != "" {
+		scene, err := app.checkAsset(r.Context(), sceneID, AssetScene, AssetComposite, AssetPanel)
+		if err != nil {
+			http.Error(w, "Unknown scene", http.StatusBadRequest)
+			return
+		}
+		prompt = strings.TrimSpace(fmt.Sprintf("%s with %s lighting %s", scene.Theme, scene.Lighting, scene.Prompt))
+	}
 	if prompt == "" {
 		http.Error(w, "Prompt required", http.StatusBadRequest)
 		return
 	}
 
-	caption, err := app.generateCaption(r.Context(), prompt)
+	cleaned, err := app.checkPrompt(r.Context(), SourceUser, StageCaption, promptField{"prompt", prompt})
+	if err != nil {
+		app.renderPartial(w, "caption-error", userMessage(err, "Invalid scene description"))
+		return
+	}
+
+	ctx, job := app.startJob(r.Context(), StageCaption, map[string]string{"prompt": cleaned[0]})
+	caption, err := app.generateCaption(ctx, cleaned[0])
+	app.finishJob(ctx, job, err)
 	if err != nil {
-		log.Printf("Caption generation error: %v", err)
-		w.Write([]byte("Failed to generate caption"))
+		slog.ErrorContext(r.Context(), "Caption generation failed", "err", err)
+		app.renderPartial(w, "caption-error", userMessage(err, "Failed to generate caption"))
 		return
 	}
 
-	w.Write([]byte(caption))
+	app.renderPartial(w, "caption", caption)
+}
+
+// adventureButton is one suggestion rendered by the "adventures" partial.
+type adventureButton struct {
+	Theme, Lighting, Prompt string
+	Emoji, Title, Desc      string
+	Gradient                template.CSS
 }
 
 func (app *App) randomAdventuresHandler(w http.ResponseWriter, r *http.Request) {
-	adventures := app.generateRandomAdventures()
+	// Failures fall back to built-in suggestions, so only the job's stage
+	// shows them
+	ctx, job := app.startJob(r.Context(), StageAdventures, nil)
+	adventures := app.generateRandomAdventures(ctx)
+	app.finishJob(ctx, job, nil)
 	
-	var html strings.Builder
+	buttons := make([]adventureButton, 0, len(adventures))
 	for _, adventure := range adventures {
-		html.WriteString(fmt.Sprintf(`
-			<button onclick="generateDemoScene('%s', '%s', '%s')" class="btn-adventure" style="padding: 15px; border: 2px solid #ddd; border-radius: 12px; background: %s; color: white; font-size: 1rem; cursor: pointer; transition: transform 0.2s;">
-				%s<br><strong>%s</strong><br><small>%s</small>
-			</button>
-		`, adventure["theme"], adventure["lighting"], adventure["prompt"], adventure["gradient"], adventure["emoji"], adventure["title"], adventure["desc"]))
-	}
-	
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html.String()))
+		buttons = append(buttons, adventureButton{
+			Theme:    adventure["theme"],
+			Lighting: adventure["lighting"],
+			Prompt:   adventure["prompt"],
+			Emoji:    adventure["emoji"],
+			Title:    adventure["title"],
+			Desc:     adventure["desc"],
+			// Gradients come from our own list, never from the model
+			Gradient: template.CSS(adventure["gradient"]),
+		})
+	}
+	
+	app.renderPartial(w, "adventures", buttons)
 }
 
-func (app *App) transformToFigurine(ctx context.Context, imageData []byte) (string, error) {
+// transformToFigurine analyses the photo once, then generates that many
+// candidate figurines from the description at once.
+func (app *App) transformToFigurine(ctx context.Context, imageData []byte, candidates int) ([]*Asset, error) {
 	// Step 1: Use Gemini to analyze the image and create a detailed description
-	analysisModel := app.geminiClient.GenerativeModel("gemini-1.5-flash")
+	analysisModel := app.model(StageAnalysis)
 	analysisModel.SetTemperature(0.3)
 	
 	analysisPrompt := "Analyze this person's appearance in detail. Describe their facial features, hair style, clothing, pose, and any distinctive characteristics. Be specific about colors, textures, and style elements."
 	
-	analysisResp, err := analysisModel.GenerateContent(ctx, 
+	analysisResp, err := app.generate(ctx, analysisModel, StageAnalysis,
 		genai.Text(analysisPrompt),
 		genai.ImageData("jpeg", imageData),
 	)
 	if err != nil {
-		return "", fmt.Errorf("failed to analyze image: %v", err)
+		return nil, fmt.Errorf("failed to analyze image: %w", err)
 	}
 	
 	var description string = "a person"
@@ -257,173 +440,181 @@ func (app *App) transformToFigurine(ctx context.Context, imageData []byte) (stri
 		}
 	}
 	
-	log.Printf("Image analysis: %s", description)
-	log.Printf("Person detected: %t", hasPersonDetected)
+	slog.InfoContext(ctx, "Image analysed", "description", userText(description), "person_detected", hasPersonDetected)
 	
 	// If no person is detected, offer a demo experience
 	if !hasPersonDetected {
-		log.Println("No person detected - creating demo figurine")
-		return "", fmt.Errorf("person not detected in image")
+		return nil, fmt.Errorf("person not detected in image")
 	}
 	
 	// Step 2: Generate figurine using the exact Google documentation approach
-	log.Printf("Generating figurine using Gemini 2.5 Flash Image Preview")
+	slog.DebugContext(ctx, "Generating figurine")
 	
 	figurinePrompt := fmt.Sprintf("Create a picture of a collectible toy figurine based on this person: %s. Style: chibi proportions, glossy plastic texture, colorful, studio lighting", description)
 	
-	// Use the generative model approach as shown in documentation
-	imageModel := app.geminiClient.GenerativeModel("gemini-2.5-flash-image-preview")
-	imageResp, err := imageModel.GenerateContent(ctx, genai.Text(figurinePrompt))
-	if err != nil {
-		log.Printf("Figurine generation failed: %v", err)
-		return "", fmt.Errorf("figurine generation failed: %v", err)
-	}
-	
-	log.Printf("Figurine generation response received, processing parts...")
-	
-	// Check response parts for generated content
-	log.Printf("Response has %d candidates", len(imageResp.Candidates))
-	if len(imageResp.Candidates) == 0 {
-		log.Println("No candidates in figurine response")
-		return "", fmt.Errorf("no candidates returned from AI")
-	}
-	
-	log.Printf("First candidate has %d parts", len(imageResp.Candidates[0].Content.Parts))
-	for i, part := range imageResp.Candidates[0].Content.Parts {
-		log.Printf("Part %d type: %T", i, part)
+	images, err := generateCandidates(ctx, candidates, func(ctx context.Context) ([]byte, error) {
+		// Use the generative model approach as shown in documentation
+		imageModel := app.model(StageFigurine)
+		imageResp, err := app.generate(ctx, imageModel, StageFigurine, genai.Text(figurinePrompt))
+		if err != nil {
+			return nil, fmt.Errorf("figurine generation failed: %w", err)
+		}
 		
-		// Try different ways to access the data based on the actual SDK structure
-		if textPart, ok := part.(genai.Text); ok {
-			log.Printf("Generated text: %s", string(textPart))
-		} else if blobPart, ok := part.(genai.Blob); ok {
-			log.Printf("Generated figurine image! MIME type: %s, size: %d bytes", blobPart.MIMEType, len(blobPart.Data))
-			filename := fmt.Sprintf("figurine_%d.png", time.Now().Unix())
-			return app.uploadToStorage(ctx, blobPart.Data, filename)
-		} else {
-			log.Printf("Unknown part type, trying reflection...")
+		// Check response parts for generated content
+		if len(imageResp.Candidates) == 0 {
+			return nil, fmt.Errorf("no candidates returned from AI")
 		}
+		
+		for i, part := range imageResp.Candidates[0].Content.Parts {
+			slog.DebugContext(ctx, "Figurine response part", "index", i, "type", fmt.Sprintf("%T", part))
+			
+			// Try different ways to access the data based on the actual SDK structure
+			if textPart, ok := part.(genai.Text); ok {
+				slog.DebugContext(ctx, "Figurine model text", "text", userText(textPart))
+			} else if blobPart, ok := part.(genai.Blob); ok {
+				slog.InfoContext(ctx, "Generated figurine", "mime_type", blobPart.MIMEType, "bytes", len(blobPart.Data))
+				return blobPart.Data, nil
+			}
+		}
+		
+		// If no image was generated, return error
+		return nil, fmt.Errorf("no figurine image generated")
+	})
+	if err != nil {
+		return nil, err
 	}
 	
-	// If no image was generated, return error
-	log.Println("No image generated")
-	return "", fmt.Errorf("no figurine image generated")
+	// The photo and its description stay private; the analysis prompt
+	// version says which description prompt the choice was made under
+	input := map[string]string{"analysisPromptVersion": promptVersions[StageAnalysis]}
+	return app.saveCandidates(ctx, StageFigurine, input, images, func() *Asset {
+		return &Asset{Kind: AssetFigurine, Version: 1}
+	})
 }
 
-func (app *App) generateScene(ctx context.Context, theme, timeOfDay, userPrompt string) (string, error) {
-	log.Printf("Generating scene using Gemini 2.5 Flash Image Preview")
+// generateScene generates that many candidate scenes at once; the user
+// chooses between them when there is more than one.
+func (app *App) generateScene(ctx context.Context, theme, timeOfDay, userPrompt string, candidates int) ([]*Asset, error) {
+	slog.DebugContext(ctx, "Generating scene", "candidates", candidates)
 	
 	// Use the Google documentation approach for scene generation
 	prompt := fmt.Sprintf("Create a picture of a %s scene with %s lighting, cinematic style, space for character placement. Additional details: %s", theme, timeOfDay, userPrompt)
 	
-	// Use the generative model approach
-	sceneModel := app.geminiClient.GenerativeModel("gemini-2.5-flash-image-preview") 
-	resp, err := sceneModel.GenerateContent(ctx, genai.Text(prompt))
-	if err != nil {
-		log.Printf("Scene generation failed: %v", err)
-		return "", fmt.Errorf("scene generation failed: %v", err)
-	}
-	
-	log.Printf("Scene generation response received, processing parts...")
-	
-	// Check if we have candidates before accessing
-	if len(resp.Candidates) == 0 {
-		log.Println("No candidates in scene response")
-		return "", fmt.Errorf("no candidates returned from AI")
-	}
-	
-	// Check response parts for generated content
-	for i, part := range resp.Candidates[0].Content.Parts {
-		log.Printf("Scene part %d type: %T", i, part)
+	images, err := generateCandidates(ctx, candidates, func(ctx context.Context) ([]byte, error) {
+		// Use the generative model approach
+		sceneModel := app.model(StageScene)
+		resp, err := app.generate(ctx, sceneModel, StageScene, genai.Text(prompt))
+		if err != nil {
+			return nil, fmt.Errorf("scene generation failed: %w", err)
+		}
 		
-		if textPart, ok := part.(genai.Text); ok {
-			log.Printf("Generated text: %s", string(textPart))
-		} else if blobPart, ok := part.(genai.Blob); ok {
-			log.Printf("Generated scene image! MIME type: %s, size: %d bytes", blobPart.MIMEType, len(blobPart.Data))
-			filename := fmt.Sprintf("scene_%d.png", time.Now().Unix())
-			return app.uploadToStorage(ctx, blobPart.Data, filename)
+		// Check if we have candidates before accessing
+		if len(resp.Candidates) == 0 {
+			return nil, fmt.Errorf("no candidates returned from AI")
 		}
+		
+		// Check response parts for generated content
+		for i, part := range resp.Candidates[0].Content.Parts {
+			slog.DebugContext(ctx, "Scene response part", "index", i, "type", fmt.Sprintf("%T", part))
+			
+			if textPart, ok := part.(genai.Text); ok {
+				slog.DebugContext(ctx, "Scene model text", "text", userText(textPart))
+			} else if blobPart, ok := part.(genai.Blob); ok {
+				slog.InfoContext(ctx, "Generated scene", "mime_type", blobPart.MIMEType, "bytes", len(blobPart.Data))
+				return blobPart.Data, nil
+			}
+		}
+		
+		// Fallback if no image was generated
+		return nil, fmt.Errorf("no scene image generated")
+	})
+	if err != nil {
+		return nil, err
 	}
 	
-	// Fallback if no image was generated
-	log.Println("No scene image generated")
-	return "", fmt.Errorf("no scene image generated")
+	input := map[string]string{"theme": theme, "lighting": timeOfDay, "prompt": userPrompt}
+	return app.saveCandidates(ctx, StageScene, input, images, func() *Asset {
+		return &Asset{Kind: AssetScene, Theme: theme, Lighting: timeOfDay, Prompt: userPrompt}
+	})
 }
 
-func (app *App) composeScene(ctx context.Context, figurineURL, backgroundURL string) (string, string, error) {
-	log.Printf("🎭 Composing scene with figurine: %s and background: %s", figurineURL, backgroundURL)
+func (app *App) composeScene(ctx context.Context, figurineID, backgroundID string) (*Asset, string, error) {
+	slog.DebugContext(ctx, "Composing scene", "figurine_id", figurineID, "background_id", backgroundID)
 	
 	// Load both images
-	figurineData, err := app.loadImageFromURL(figurineURL)
+	_, figurineData, err := app.loadAsset(ctx, figurineID, AssetFigurine)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to load figurine: %v", err)
+		return nil, "", fmt.Errorf("failed to load figurine: %w", err)
 	}
 	
-	backgroundData, err := app.loadImageFromURL(backgroundURL)
+	background, backgroundData, err := app.loadAsset(ctx, backgroundID, AssetScene)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to load background: %v", err)
+		return nil, "", fmt.Errorf("failed to load background: %w", err)
 	}
 	
-	log.Printf("🖼️ Loaded figurine (%d bytes) and background (%d bytes)", len(figurineData), len(backgroundData))
+	// The character sheet keeps the figurine from drifting between panels;
+	// without one the composition still works, just less consistently
+	sheet, sheetData, err := app.ensureCharacterSheet(ctx, figurineID, figurineData)
+	if err != nil {
+		slog.WarnContext(ctx, "Composing without a character sheet", "figurine_id", figurineID, "err", err)
+	}
 	
 	// Use Gemini 2.5 Flash Image Preview to compose the figurine onto the background
-	log.Printf("🎨 Generating composition using Gemini 2.5 Flash Image Preview...")
-	
-	imageModel := app.geminiClient.GenerativeModel("gemini-2.5-flash-image-preview")
+	imageModel := app.model(StageCompose)
 	
 	compositionPrompt := "Using the provided images, place the toy figurine from image 2 onto the background scene from image 1. Ensure that the figurine is positioned naturally in the scene with appropriate scaling, lighting, and shadows. The figurine should look like it belongs in this environment."
 	
-	// Generate composition with both images - background first, then figurine
-	imageResp, err := imageModel.GenerateContent(ctx, 
+	// Background first, then figurine, then its character sheet
+	parts := []genai.Part{
 		genai.Text(compositionPrompt),
 		genai.ImageData("png", backgroundData),
 		genai.ImageData("png", figurineData),
-	)
-	if err != nil {
-		log.Printf("❌ Composition generation failed: %v", err)
-		return "", "", fmt.Errorf("composition generation failed: %v", err)
 	}
-	
-	log.Printf("📸 Composition response received, processing parts...")
-	
-	// Check response for generated image
-	if len(imageResp.Candidates) == 0 {
-		log.Println("❌ No candidates in composition response")
-		return "", "", fmt.Errorf("no candidates returned from AI")
+	if sheet != nil {
+		compositionPrompt += " Image 3 is a character reference sheet of the same figurine from the front, side and back and with different expressions: keep its face, hair, outfit, colors and proportions exactly as shown there."
+		parts = append(parts, genai.ImageData("png", sheetData))
 	}
 	
-	var composedImageData []byte
-	for i, part := range imageResp.Candidates[0].Content.Parts {
-		log.Printf("Part %d type: %T", i, part)
-		
-		if blobPart, ok := part.(genai.Blob); ok {
-			log.Printf("✅ Generated composed image! MIME type: %s, size: %d bytes", blobPart.MIMEType, len(blobPart.Data))
-			composedImageData = blobPart.Data
-			break
+	// The composed image keeps the scene's theme and lighting
+	composed := &Asset{Kind: AssetComposite, Theme: background.Theme, Lighting: background.Lighting}
+	
+	generate := func(ctx context.Context, prompt string) ([]byte, error) {
+		parts[0] = genai.Text(prompt)
+		resp, err := app.generate(ctx, imageModel, StageCompose, parts...)
+		if err != nil {
+			return nil, err
 		}
+		return responseImage(resp), nil
 	}
-	
-	if len(composedImageData) == 0 {
-		log.Println("❌ No composed image generated, falling back to background only")
-		composedImageData = backgroundData
+	verify := func(ctx context.Context, data []byte) (*compositionReport, error) {
+		return app.verifyComposition(ctx, backgroundData, figurineData, data)
 	}
-	
-	// Save the composed image
-	filename := fmt.Sprintf("composed_%d.png", time.Now().Unix())
-	composedURL, err := app.uploadToStorage(ctx, composedImageData, filename)
+	composedImageData, err := composeVerified(ctx, composed, compositionPrompt, generate, verify)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to save composed image: %v", err)
+		return nil, "", err
+	}
+	if sheet != nil {
+		// A failed check only costs the score
+		if score, err := app.checkConsistency(ctx, sheetData, composedImageData); err != nil {
+			slog.WarnContext(ctx, "Character consistency check failed", "err", err)
+		} else {
+			composed.Consistency = &score
+		}
+	}
+	if err := app.saveAsset(ctx, composed, composedImageData, "png"); err != nil {
+		return nil, "", fmt.Errorf("failed to save composed image: %v", err)
 	}
 	
-	log.Printf("✅ Composition complete! URL: %s", composedURL)
-	return composedURL, "", nil
+	slog.InfoContext(ctx, "Composition complete", "asset_id", composed.ID)
+	return composed, "", nil
 }
 
 func (app *App) generateCaption(ctx context.Context, scenePrompt string) (string, error) {
-	model := app.geminiClient.GenerativeModel("gemini-1.5-flash")
+	model := app.model(StageCaption)
 	
 	prompt := fmt.Sprintf("Create a witty, one-liner caption for a comic panel with this scene: %s. Keep it under 10 words and make it funny.", scenePrompt)
 	
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	resp, err := app.generate(ctx, model, StageCaption, genai.Text(prompt))
 	if err != nil {
 		return "", err
 	}
@@ -444,6 +635,39 @@ func (app *App) uploadToStorage(ctx context.Context, data []byte, filename strin
 	return app.saveLocally(data, filename)
 }
 
+// saveAsset stores data under a name derived from a fresh asset ID and
+// records the asset in the index. Kind and any provenance fields should be
+// set by the caller.
+func (app *App) saveAsset(ctx context.Context, a *Asset, data []byte, ext string) error {
+	ctx, span := tracer.Start(ctx, "store asset", trace.WithAttributes(
+		attribute.String("bananaverse.asset_kind", a.Kind),
+		attribute.Int("bananaverse.output_bytes", len(data)),
+	))
+	defer span.End()
+
+	a.ID = newID()
+	a.Owner = sessionID(ctx)
+	a.Created = time.Now()
+	a.Filename = fmt.Sprintf("%s_%s.%s", a.Kind, a.ID, ext)
+	a.Trace = traceRef(ctx)
+	if job := jobFromContext(ctx); job != nil {
+		job.mu.Lock()
+		job.AssetID = a.ID
+		job.mu.Unlock()
+	}
+	span.SetAttributes(attribute.String("bananaverse.asset_id", a.ID))
+	if _, err := app.uploadToStorage(ctx, data, a.Filename); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	storedBytes.WithLabelValues(a.Kind).Add(float64(len(data)))
+	if err := app.store.PutAsset(a); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
 func (app *App) saveLocally(data []byte, filename string) (string, error) {
 	// Create uploads directory if it doesn't exist
 	os.MkdirAll("static/uploads", 0755)
@@ -464,9 +688,9 @@ func (app *App) saveLocally(data []byte, filename string) (string, error) {
 	return fmt.Sprintf("/static/uploads/%s", filename), nil
 }
 
-func (app *App) generateRandomAdventures() []map[string]string {
+func (app *App) generateRandomAdventures(ctx context.Context) []map[string]string {
 	// Use Gemini to generate random adventure ideas
-	model := app.geminiClient.GenerativeModel("gemini-1.5-flash")
+	model := app.model(StageAdventures)
 	
 	prompt := `Generate 4 unique, creative adventure scenarios for a toy figurine. For each adventure, provide:
 1. A theme (2-3 words, kebab-case like "underwater-temple")
@@ -482,9 +706,9 @@ Examples:
 neon-cyberpunk-alley|golden-hour-sunset|ninja pizza heist|🌃|Neon Alley|Cyberpunk ninja heist
 crystal-ice-caves|aurora-borealis-glow|frozen dragon rescue|❄️|Ice Caves|Frozen dragon rescue`
 
-	resp, err := model.GenerateContent(context.Background(), genai.Text(prompt))
+	resp, err := app.generate(ctx, model, StageAdventures, genai.Text(prompt))
 	if err != nil {
-		log.Printf("Failed to generate random adventures: %v", err)
+		slog.WarnContext(ctx, "Failed to generate random adventures, using defaults", "err", err)
 		// Fallback to a few hardcoded ones
 		return []map[string]string{
 			{"theme": "mysterious-jungle", "lighting": "dappled-sunlight", "prompt": "ancient artifact hunt", "emoji": "🌿", "title": "Jungle Quest", "desc": "Ancient artifact hunt", "gradient": "linear-gradient(135deg, #11998e 0%, #38ef7d 100%)"},
@@ -515,13 +739,25 @@ crystal-ice-caves|aurora-borealis-glow|frozen dragon rescue|❄️|Ice Caves|Fro
 				}
 				parts := strings.Split(line, "|")
 				if len(parts) >= 6 {
+					// Model output is untrusted too: drop any idea the
+					// prompt policy wouldn't accept from a user
+					cleaned, err := app.checkPrompt(ctx, SourceModel, StageAdventures,
+						promptField{"theme", parts[0]}, promptField{"lighting", parts[1]}, promptField{"prompt", parts[2]},
+						promptField{"title", parts[4]}, promptField{"desc", parts[5]})
+					if err != nil {
+						continue
+					}
+					emoji := strings.TrimSpace(parts[3])
+					if !isEmoji(emoji) {
+						emoji = "✨"
+					}
 					adventure := map[string]string{
-						"theme":    strings.TrimSpace(parts[0]),
-						"lighting": strings.TrimSpace(parts[1]),
-						"prompt":   strings.TrimSpace(parts[2]),
-						"emoji":    strings.TrimSpace(parts[3]),
-						"title":    strings.TrimSpace(parts[4]),
-						"desc":     strings.TrimSpace(parts[5]),
+						"theme":    cleaned[0],
+						"lighting": cleaned[1],
+						"prompt":   cleaned[2],
+						"emoji":    emoji,
+						"title":    cleaned[3],
+						"desc":     cleaned[4],
 						"gradient": gradients[i%len(gradients)],
 					}
 					adventures = append(adventures, adventure)
@@ -552,103 +788,118 @@ crystal-ice-caves|aurora-borealis-glow|frozen dragon rescue|❄️|Ice Caves|Fro
 
 // Removed unused background generation - using AI only
 
-// Helper function to load image data from URL
-func (app *App) loadImageFromURL(imageURL string) ([]byte, error) {
-	log.Printf("🔍 Loading image from URL: %s", imageURL)
-	
-	// Handle both relative and full URLs
-	var filePath string
-	
-	if strings.HasPrefix(imageURL, "/static/uploads/") {
-		// Relative URL: /static/uploads/filename.png
-		filename := strings.TrimPrefix(imageURL, "/static/uploads/")
-		filePath = fmt.Sprintf("static/uploads/%s", filename)
-	} else if strings.Contains(imageURL, "/static/uploads/") {
-		// Full URL: http://localhost:8080/static/uploads/filename.png
-		parts := strings.Split(imageURL, "/static/uploads/")
-		if len(parts) >= 2 {
-			filename := parts[1]
-			filePath = fmt.Sprintf("static/uploads/%s", filename)
-		} else {
-			return nil, fmt.Errorf("could not extract filename from URL: %s", imageURL)
-		}
-	} else {
-		return nil, fmt.Errorf("unsupported URL format: %s", imageURL)
+// loadAsset fetches an asset the session owns and reads its file. kinds, if
+// given, limits which kinds of asset are acceptable. Bad references wrap
+// ErrBadAsset.
+func (app *App) loadAsset(ctx context.Context, id string, kinds ...string) (*Asset, []byte, error) {
+	// Hold the asset so the retention sweeper can't delete the file
+	// between the lookup and the read
+	if !app.leases.acquire(id) {
+		return nil, nil, fmt.Errorf("%w: unknown asset %q", ErrBadAsset, id)
 	}
-	
-	log.Printf("📁 Reading file: %s", filePath)
+	defer app.leases.release(id)
+
+	asset, err := app.checkAsset(ctx, id, kinds...)
+	if err != nil {
+		return nil, nil, err
+	}
+	linkAsset(ctx, asset)
+
+	// Filenames are generated by saveAsset, but never let one leave the
+	// uploads directory
+	filePath := filepath.Join("static", "uploads", filepath.Base(asset.Filename))
 	data, err := os.ReadFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file %s: %v", filePath, err)
+		return nil, nil, fmt.Errorf("failed to read file %s: %v", filePath, err)
 	}
-	
-	log.Printf("✅ Successfully loaded %d bytes from %s", len(data), filePath)
-	return data, nil
+
+	slog.DebugContext(ctx, "Loaded asset", "asset_id", asset.ID, "bytes", len(data))
+	return asset, data, nil
+}
+
+// checkAsset makes sure id names an asset the session owns, of one of the
+// given kinds, and not a candidate the user didn't choose.
+func (app *App) checkAsset(ctx context.Context, id string, kinds ...string) (*Asset, error) {
+	asset, err := app.store.GetAsset(id)
+	if err != nil || !ownedBy(ctx, asset.Owner) {
+		return nil, fmt.Errorf("%w: unknown asset %q", ErrBadAsset, id)
+	}
+	if len(kinds) > 0 && !slices.Contains(kinds, asset.Kind) {
+		return nil, fmt.Errorf("%w: asset %s is a %s, not a %s", ErrBadAsset, id, asset.Kind, strings.Join(kinds, " or "))
+	}
+	// Candidates the user passed over are only shown in the picker
+	if asset.Candidate {
+		return nil, fmt.Errorf("%w: asset %s is a candidate that wasn't chosen", ErrBadAsset, id)
+	}
+	return asset, nil
+}
+
+// resolveAssetRef returns the asset ID a request refers to. Older clients
+// send the image URL instead; that still works, through the asset index
+// rather than the path, but is logged so it can be removed.
+func (app *App) resolveAssetRef(id, legacyURL, field string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	if legacyURL == "" {
+		return "", fmt.Errorf("%w: %s required", ErrBadAsset, field)
+	}
+	slog.Warn("Deprecated asset URL reference, clients should send the asset ID", "field", field)
+	asset, err := app.assetFromURL(legacyURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBadAsset, err)
+	}
+	return asset.ID, nil
 }
 
-func (app *App) renderFigurineSuccess(w http.ResponseWriter, url string) {
-	html := fmt.Sprintf(`
-		<div id="figurine-result" class="result-panel">
-			<img src="%s" alt="Transformed Figurine" class="figurine-image">
-			<p class="success">Figurine created successfully! Now choose an adventure below.</p>
-		</div>
-	`, url)
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+// assetFromURL looks up the asset behind a relative or full upload URL such
+// as /static/uploads/figurine_<id>.png.
+func (app *App) assetFromURL(imageURL string) (*Asset, error) {
+	_, filename, ok := strings.Cut(imageURL, "/static/uploads/")
+	if !ok || filename == "" {
+		return nil, fmt.Errorf("unsupported URL format: %s", imageURL)
+	}
+	asset, err := app.store.GetAsset(assetIDFromFilename(filename))
+	if err != nil || asset.Filename != filename {
+		return nil, fmt.Errorf("unknown asset: %s", imageURL)
+	}
+	return asset, nil
+}
+
+// assetIDFromFilename extracts the ID from a "<kind>_<id>.<ext>" filename.
+func assetIDFromFilename(filename string) string {
+	name, _, _ := strings.Cut(filename, ".")
+	return name[strings.LastIndex(name, "_")+1:]
+}
+
+// renderPartial writes one of the HTMX fragments in templates/partials.
+func (app *App) renderPartial(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := app.templates.ExecuteTemplate(w, name, data); err != nil {
+		slog.Error("Template error", "template", name, "err", err)
+	}
+}
+
+func (app *App) renderFigurineSuccess(w http.ResponseWriter, figurine *Asset) {
+	app.renderPartial(w, "figurine-success", figurineView{Asset: figurine, Versions: []*Asset{figurine}})
 }
 
 func (app *App) renderFigurineError(w http.ResponseWriter, message string) {
-	html := fmt.Sprintf(`
-		<div id="figurine-result" class="error-panel">
-			<p class="error">%s</p>
-			<button onclick="location.reload()" class="btn-secondary">Try Again</button>
-		</div>
-	`, message)
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
-}
-
-func (app *App) renderSceneSuccess(w http.ResponseWriter, url string) {
-	html := fmt.Sprintf(`
-		<div id="scene-result" class="result-panel">
-			<img src="%s" alt="Generated Scene" class="scene-image">
-			<p class="success">Scene generated! Auto-composing your comic panel...</p>
-		</div>
-	`, url)
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+	app.renderPartial(w, "figurine-error", message)
+}
+
+func (app *App) renderSceneSuccess(w http.ResponseWriter, scene *Asset) {
+	app.renderPartial(w, "scene-success", sceneView{Asset: scene})
 }
 
 func (app *App) renderSceneError(w http.ResponseWriter, message string) {
-	html := fmt.Sprintf(`
-		<div id="scene-result" class="error-panel">
-			<p class="error">%s</p>
-			<button onclick="location.reload()" class="btn-secondary">Try Again</button>
-		</div>
-	`, message)
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
-}
-
-func (app *App) renderCompositionSuccess(w http.ResponseWriter, url, caption string) {
-	html := fmt.Sprintf(`
-		<div id="composition-result" class="result-panel">
-			<p class="success">✅ Figurine merged into scene!</p>
-			<img src="%s" alt="Merged Scene" class="composed-image">
-			<button onclick="downloadImage('%s')" class="btn-primary">📥 Download Image</button>
-		</div>
-	`, url, url)
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+	app.renderPartial(w, "scene-error", message)
+}
+
+func (app *App) renderCompositionSuccess(w http.ResponseWriter, composed *Asset, caption string) {
+	app.renderPartial(w, "composition-success", composed)
 }
 
 func (app *App) renderCompositionError(w http.ResponseWriter, message string) {
-	html := fmt.Sprintf(`
-		<div id="composition-result" class="error-panel">
-			<p class="error">%s</p>
-			<button onclick="location.reload()" class="btn-secondary">Try Again</button>
-		</div>
-	`, message)
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+	app.renderPartial(w, "composition-error", message)
 }
\ No newline at end of file
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// saveTestAsset saves a and its file for session, and removes the file when
+// the test ends.
+func saveTestAsset(t *testing.T, app *App, session string, a *Asset, data []byte) {
+	t.Helper()
+	ctx := context.WithValue(context.Background(), sessionKey, session)
+	if err := app.saveAsset(ctx, a, data, "png"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(filepath.Join("static", "uploads", a.Filename)) })
+}
+
+func TestAssetIDFromFilename(t *testing.T) {
+	for filename, want := range map[string]string{
+		"figurine_abc123.png":     "abc123",
+		"comic_page_def456.png":   "def456",
+		"noprefix.png":            "noprefix",
+		"scene_ghi789.tar.gz":     "ghi789",
+		"../../etc/passwd_x1.png": "",
+		"composite_jkl012":        "jkl012",
+	} {
+		if got := assetIDFromFilename(filename); got != want {
+			t.Errorf("assetIDFromFilename(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
+
+func TestResolveAssetRef(t *testing.T) {
+	app := testApp(t)
+	scene := &Asset{ID: "abc123", Kind: AssetScene, Owner: "alice", Filename: "scene_abc123.png"}
+	if err := app.store.PutAsset(scene); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id, url string
+		want    string
+	}{
+		{"xyz", "/static/uploads/scene_abc123.png", "xyz"},
+		{"", "/static/uploads/scene_abc123.png", "abc123"},
+		{"", "https://example.com/static/uploads/scene_abc123.png", "abc123"},
+		{"", "/static/uploads/figurine_abc123.png", ""},
+		{"", "/static/uploads/", ""},
+		{"", "/elsewhere/scene_abc123.png", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		got, err := app.resolveAssetRef(tt.id, tt.url, "imageId")
+		if tt.want == "" {
+			if !errors.Is(err, ErrBadAsset) {
+				t.Errorf("resolveAssetRef(%q, %q) = %q, %v; want ErrBadAsset", tt.id, tt.url, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveAssetRef(%q, %q) = %q, %v; want %q", tt.id, tt.url, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckAsset(t *testing.T) {
+	app := testApp(t)
+	scene := &Asset{ID: newID(), Kind: AssetScene, Owner: "alice", Filename: "scene.png"}
+	if err := app.store.PutAsset(scene); err != nil {
+		t.Fatal(err)
+	}
+	alice := context.WithValue(context.Background(), sessionKey, "alice")
+	bob := context.WithValue(context.Background(), sessionKey, "bob")
+
+	if a, err := app.checkAsset(alice, scene.ID, AssetScene, AssetComposite); err != nil || a.ID != scene.ID {
+		t.Errorf("owner's scene: %v", err)
+	}
+	for name, err := range map[string]error{
+		"other session": func() error { _, err := app.checkAsset(bob, scene.ID); return err }(),
+		"wrong kind":    func() error { _, err := app.checkAsset(alice, scene.ID, AssetFigurine); return err }(),
+		"unknown ID":    func() error { _, err := app.checkAsset(alice, "nope"); return err }(),
+	} {
+		if !errors.Is(err, ErrBadAsset) {
+			t.Errorf("%s: got %v, want ErrBadAsset", name, err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Gemini call outcomes, as reported by bananaverse_gemini_calls_total.
+const (
+	OutcomeSuccess     = "success"
+	OutcomeSafetyBlock = "safety_block"
+	OutcomeNoImage     = "no_image"
+	OutcomeError       = "error"
+)
+
+// Image generation takes seconds rather than milliseconds, so both latency
+// histograms reach further than prometheus.DefBuckets.
+var latencyBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bananaverse_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: latencyBuckets,
+	}, []string{"handler"})
+
+	geminiCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_gemini_calls_total",
+		Help: "Gemini calls by pipeline stage and outcome (success, safety_block, no_image, error).",
+	}, []string{"stage", "outcome"})
+
+	geminiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bananaverse_gemini_call_duration_seconds",
+		Help:    "Gemini call latency by pipeline stage.",
+		Buckets: latencyBuckets,
+	}, []string{"stage"})
+
+	// Generation runs inline in the request, so calls waiting on Gemini
+	// are the pipeline's queue.
+	geminiInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bananaverse_gemini_queue_depth",
+		Help: "Gemini calls in progress by pipeline stage.",
+	}, []string{"stage"})
+
+	storedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_stored_bytes_total",
+		Help: "Bytes written to upload storage by asset kind.",
+	}, []string{"kind"})
+
+	uploadCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_upload_cache_requests_total",
+		Help: "Upload requests answered from the client's cache (hit, 304 Not Modified) or with the file (miss).",
+	}, []string{"result"})
+
+	retentionAssets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_retention_assets_total",
+		Help: "Expired assets removed by the retention sweeper by kind and action (deleted, or would_delete in dry-run mode).",
+	}, []string{"kind", "action"})
+
+	retentionBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_retention_bytes_total",
+		Help: "Bytes of upload storage freed by the retention sweeper by kind and action (deleted, or would_delete in dry-run mode).",
+	}, []string{"kind", "action"})
+
+	characterConsistency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bananaverse_character_consistency_score",
+		Help:    "How closely composed figurines match their character sheet, from 0 (drifted) to 100.",
+		Buckets: prometheus.LinearBuckets(10, 10, 10),
+	})
+
+	compositionVerification = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bananaverse_composition_verification_score",
+		Help:    "How well composites show the figurine at a believable scale and lighting, from 0 (missing) to 100, for every attempt.",
+		Buckets: prometheus.LinearBuckets(10, 10, 10),
+	})
+
+	compositionRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_composition_retries_total",
+		Help: "Compositions generated again after failing verification, by reason (no_image, missing, scale, lighting).",
+	}, []string{"reason"})
+
+	candidateChoices = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananaverse_candidate_choices_total",
+		Help: "Candidates chosen by stage and position in the picker, 1 being the first shown.",
+	}, []string{"stage", "position"})
+
+	retentionLastSweep = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bananaverse_retention_last_sweep_timestamp_seconds",
+		Help: "When the retention sweeper last finished, as a Unix time.",
+	})
+)
+
+// imageStages are the stages whose response should contain an image.
+var imageStages = map[string]bool{StageFigurine: true, StageScene: true, StageCompose: true, StageCharacter: true, StageRefine: true, StageSceneEdit: true}
+
+// withMetrics records request counts and latency by route pattern. It wraps
+// the mux directly, since the mux sets r.Pattern on the request it is given.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		handler := r.Pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		httpRequests.WithLabelValues(handler, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+	})
+}
+
+// generate calls model for one pipeline stage, checks the response with
+// checkResponse and records the call's latency and outcome, in metrics, as a
+// span and as a stage of the context's job.
+func (app *App) generate(ctx context.Context, model *genai.GenerativeModel, stage string, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	return app.instrument(ctx, stage, func(ctx context.Context) (*genai.GenerateContentResponse, error) {
+		return model.GenerateContent(ctx, parts...)
+	})
+}
+
+// sendChat is generate for the next turn of a chat session.
+func (app *App) sendChat(ctx context.Context, cs *genai.ChatSession, stage string, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	return app.instrument(ctx, stage, func(ctx context.Context) (*genai.GenerateContentResponse, error) {
+		return cs.SendMessage(ctx, parts...)
+	})
+}
+
+// judgingStages score images rather than write, so they answer at
+// temperature 0 and the same image gets the same score.
+var judgingStages = map[string]bool{StageVerify: true, StageDrift: true}
+
+// generateJSON calls the stage's model for a JSON reply and decodes it into
+// out.
+func (app *App) generateJSON(ctx context.Context, stage string, out any, parts ...genai.Part) error {
+	model := app.model(stage)
+	model.ResponseMIMEType = "application/json"
+	if judgingStages[stage] {
+		model.SetTemperature(0)
+	}
+	resp, err := app.generate(ctx, model, stage, parts...)
+	if err != nil {
+		return err
+	}
+	return decodeJSONReply(resp, out)
+}
+
+// decodeJSONReply decodes the text of the first candidate of resp into out.
+// Models sometimes fence JSON as markdown even when asked not to.
+func decodeJSONReply(resp *genai.GenerateContentResponse, out any) error {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		return errors.New("no reply returned")
+	}
+	text, ok := resp.Candidates[0].Content.Parts[0].(genai.Text)
+	if !ok {
+		return errors.New("reply is not text")
+	}
+	raw := strings.TrimSpace(string(text))
+	if strings.HasPrefix(raw, "```") {
+		// Drop the fences, whatever language the opening one names
+		if _, body, ok := strings.Cut(raw, "\n"); ok {
+			raw = body
+		} else {
+			raw = strings.TrimPrefix(raw, "```")
+		}
+		raw = strings.TrimSuffix(strings.TrimSpace(raw), "```")
+	}
+	if err := json.Unmarshal([]byte(raw), out); err != nil {
+		return fmt.Errorf("invalid JSON reply: %v", err)
+	}
+	return nil
+}
+
+// instrument makes one model call for a stage and records it.
+func (app *App) instrument(ctx context.Context, stage string, call func(context.Context) (*genai.GenerateContentResponse, error)) (*genai.GenerateContentResponse, error) {
+	ctx, span := tracer.Start(ctx, "gemini "+stage, trace.WithAttributes(
+		attribute.String("bananaverse.stage", stage),
+		attribute.String("gen_ai.request.model", stageModels[stage]),
+		attribute.String("bananaverse.prompt_version", promptVersions[stage]),
+	))
+	defer span.End()
+
+	inFlight := geminiInFlight.WithLabelValues(stage)
+	inFlight.Inc()
+	start := time.Now()
+	resp, err := call(ctx)
+	inFlight.Dec()
+	geminiDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+
+	err = checkResponse(stage, resp, err)
+	var safetyErr *SafetyError
+	outcome := OutcomeSuccess
+	switch {
+	case errors.As(err, &safetyErr):
+		outcome = OutcomeSafetyBlock
+	case err != nil:
+		outcome = OutcomeError
+	case imageStages[stage] && !hasImage(resp):
+		outcome = OutcomeNoImage
+	}
+	geminiCalls.WithLabelValues(stage, outcome).Inc()
+	recordStage(ctx, stage, outcome, time.Since(start), resp, err)
+
+	span.SetAttributes(
+		attribute.String("bananaverse.outcome", outcome),
+		attribute.Int("bananaverse.output_bytes", outputSize(resp)),
+	)
+	if outcome != OutcomeSuccess {
+		span.SetStatus(codes.Error, outcome)
+	}
+	return resp, err
+}
+
+// outputSize is the number of bytes of text and images in resp's first
+// candidate.
+func outputSize(resp *genai.GenerateContentResponse) int {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return 0
+	}
+	n := 0
+	for _, part := range resp.Candidates[0].Content.Parts {
+		switch p := part.(type) {
+		case genai.Text:
+			n += len(p)
+		case genai.Blob:
+			n += len(p.Data)
+		}
+	}
+	return n
+}
+
+// responseImage returns the first image in the first candidate of resp, or
+// nil if there is none. A candidate cut short, say by MAX_TOKENS, can come
+// back without any content.
+func responseImage(resp *genai.GenerateContentResponse) []byte {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return nil
+	}
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if blob, ok := part.(genai.Blob); ok {
+			return blob.Data
+		}
+	}
+	return nil
+}
+
+// hasImage reports whether the first candidate of resp contains an image.
+func hasImage(resp *genai.GenerateContentResponse) bool {
+	return responseImage(resp) != nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentOutcomes(t *testing.T) {
+	app := &App{}
+	image := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: []genai.Part{genai.Blob{MIMEType: "image/png", Data: []byte("png")}}}}}}
+	text := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: []genai.Part{genai.Text("just words")}}}}}
+	blocked := &genai.GenerateContentResponse{PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockReasonSafety}}
+
+	tests := []struct {
+		stage   string
+		resp    *genai.GenerateContentResponse
+		err     error
+		outcome string
+	}{
+		{StageScene, image, nil, OutcomeSuccess},
+		{StageScene, text, nil, OutcomeNoImage},
+		{StageCaption, text, nil, OutcomeSuccess},
+		{StageScene, blocked, nil, OutcomeSafetyBlock},
+		{StageScene, nil, errors.New("quota exceeded"), OutcomeError},
+	}
+	for _, tt := range tests {
+		counter := geminiCalls.WithLabelValues(tt.stage, tt.outcome)
+		before := testutil.ToFloat64(counter)
+		app.instrument(context.Background(), tt.stage, func(context.Context) (*genai.GenerateContentResponse, error) {
+			return tt.resp, tt.err
+		})
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s call counted %v times as %s", tt.stage, got, tt.outcome)
+		}
+		if got := testutil.ToFloat64(geminiInFlight.WithLabelValues(tt.stage)); got != 0 {
+			t.Errorf("%s queue depth left at %v", tt.stage, got)
+		}
+	}
+}
+
+func TestWithMetricsLabelsByPattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/comics/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := withMetrics(mux)
+
+	matched := httpRequests.WithLabelValues("/api/comics/{id}", http.MethodGet, "418")
+	unmatched := httpRequests.WithLabelValues("unmatched", http.MethodGet, "404")
+	beforeMatched, beforeUnmatched := testutil.ToFloat64(matched), testutil.ToFloat64(unmatched)
+	for _, path := range []string{"/api/comics/a", "/api/comics/b", "/nowhere"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := testutil.ToFloat64(matched) - beforeMatched; got != 2 {
+		t.Errorf("route counted %v requests, want 2", got)
+	}
+	if got := testutil.ToFloat64(unmatched) - beforeUnmatched; got != 1 {
+		t.Errorf("unmatched counted %v requests, want 1", got)
+	}
+}
+
+func TestOutputSize(t *testing.T) {
+	resp := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: []genai.Part{genai.Text("hello"), genai.Blob{Data: make([]byte, 10)}}}}}}
+	if got := outputSize(resp); got != 15 {
+		t.Errorf("outputSize = %d, want 15", got)
+	}
+	if outputSize(nil) != 0 || hasImage(nil) {
+		t.Error("nil response has output")
+	}
+}
+
+func TestDecodeJSONReply(t *testing.T) {
+	reply := func(parts ...genai.Part) *genai.GenerateContentResponse {
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: parts}}}}
+	}
+	tests := []struct {
+		resp    *genai.GenerateContentResponse
+		want    int
+		wantErr bool
+	}{
+		{reply(genai.Text(`{"score": 87}`)), 87, false},
+		{reply(genai.Text("```json\n{\"score\": 42}\n```\n")), 42, false},
+		{reply(genai.Text("```\n{\"score\": 7}\n```")), 7, false},
+		{reply(genai.Text("```JSON\n{\"score\": 9}```")), 9, false},
+		{reply(genai.Text("```{\"score\": 3}```")), 3, false},
+		{reply(genai.Text(`the score is 87`)), 0, true},
+		{reply(genai.Blob{Data: []byte("png")}), 0, true},
+		{reply(), 0, true},
+		{&genai.GenerateContentResponse{}, 0, true},
+		{nil, 0, true},
+	}
+	for i, tt := range tests {
+		var report driftReport
+		err := decodeJSONReply(tt.resp, &report)
+		if (err != nil) != tt.wantErr || report.Score != tt.want {
+			t.Errorf("%d: got %d, %v", i, report.Score, err)
+		}
+	}
+}
+
+func TestResponseImage(t *testing.T) {
+	withParts := func(parts ...genai.Part) *genai.GenerateContentResponse {
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: parts}}}}
+	}
+	tests := []struct {
+		name string
+		resp *genai.GenerateContentResponse
+		want string
+	}{
+		{"image after text", withParts(genai.Text("here you go"), genai.Blob{Data: []byte("png")}), "png"},
+		{"text only", withParts(genai.Text("sorry")), ""},
+		{"cut short without content", &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{FinishReason: genai.FinishReasonMaxTokens}}}, ""},
+		{"no candidates", &genai.GenerateContentResponse{}, ""},
+		{"nil", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := responseImage(tt.resp); string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if hasImage(tt.resp) != (tt.want != "") {
+			t.Errorf("%s: hasImage disagrees", tt.name)
+		}
+	}
+}
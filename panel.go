@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomediumitalic"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// Bubble kinds understood by the panel renderer.
+const (
+	BubbleSpeech  = "speech"
+	BubbleThought = "thought"
+)
+
+// Bubble is a speech or thought balloon drawn over a panel. Positions are
+// relative to the panel (0..1) so the same spec works at any page size.
+type Bubble struct {
+	Kind  string  `json:"kind"`
+	Text  string  `json:"text"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	TailX float64 `json:"tailX"`
+	TailY float64 `json:"tailY"`
+}
+
+// PanelSpec describes how a composed image should be lettered.
+type PanelSpec struct {
+	Width   int      `json:"width,omitempty"`
+	Height  int      `json:"height,omitempty"`
+	Caption string   `json:"caption,omitempty"`
+	Bubbles []Bubble `json:"bubbles,omitempty"`
+}
+
+type PanelRequest struct {
+	ImageID string `json:"imageId"`
+	// Deprecated: send ImageID. URLs are still resolved through the asset
+	// index for older clients.
+	ImageURL string `json:"imageUrl,omitempty"`
+	PanelSpec
+}
+
+type PanelResponse struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	defaultPanelWidth  = 800
+	defaultPanelHeight = 600
+	panelBorder        = 8
+	captionFontSize    = 22
+	bubbleFontSize     = 20
+
+	// Limits on what a client may ask to have lettered. The whole panel is
+	// held in memory while it is drawn, so its sides are capped well below
+	// anything that could exhaust it.
+	minPanelSide        = 100
+	maxPanelSide        = 4000
+	maxPanelBubbles     = 8
+	maxBubbleTextLength = 200
+	maxPanelRequestSize = 64 << 10
+)
+
+var (
+	panelInk   = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	panelPaper = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	// Caption boxes are slightly translucent, matching the old canvas export.
+	captionPaper = color.RGBA{0xf2, 0xf2, 0xf2, 0xf2}
+)
+
+// bundledFonts holds the comic lettering fonts built into the binary; see
+// fonts/README.md.
+//
+//go:embed fonts
+var bundledFonts embed.FS
+
+// The bundled comic fonts used for lettering by default.
+const (
+	bundledBoldFont   = "fonts/ComicNeue-Bold.ttf"
+	bundledItalicFont = "fonts/ComicNeue-BoldItalic.ttf"
+)
+
+// Lettering uses the bundled comic fonts, or the files named by
+// LETTERING_FONT and LETTERING_FONT_ITALIC to override them. A build without
+// the comic fonts falls back to the Go fonts in x/image, so rendering works
+// on every deployment without system fonts installed.
+var (
+	letteringOnce   sync.Once
+	letteringBold   *opentype.Font
+	letteringItalic *opentype.Font
+	letteringErr    error
+)
+
+func letteringFace(italic bool, size float64) (font.Face, error) {
+	letteringOnce.Do(func() {
+		if letteringBold, letteringErr = loadLetteringFont("LETTERING_FONT", bundledBoldFont, gobold.TTF); letteringErr != nil {
+			return
+		}
+		letteringItalic, letteringErr = loadLetteringFont("LETTERING_FONT_ITALIC", bundledItalicFont, gomediumitalic.TTF)
+	})
+	if letteringErr != nil {
+		return nil, fmt.Errorf("failed to load lettering font: %v", letteringErr)
+	}
+
+	f := letteringBold
+	if italic {
+		f = letteringItalic
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// loadLetteringFont parses the TrueType or OpenType file named by the env
+// var, or the bundled font when it isn't set, or fallback when that wasn't
+// built in.
+func loadLetteringFont(env, bundled string, fallback []byte) (*opentype.Font, error) {
+	path := os.Getenv(env)
+	if path == "" {
+		data, err := bundledFonts.ReadFile(bundled)
+		if err != nil {
+			slog.Warn("Comic lettering font not bundled, using the Go font", "font", bundled)
+			return opentype.Parse(fallback)
+		}
+		f, err := opentype.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bundled %s: %v", bundled, err)
+		}
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", env, err)
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to parse %s: %v", env, path, err)
+	}
+	return f, nil
+}
+
+// validate checks a spec against the panel limits. Zero sides use the
+// defaults.
+func (spec PanelSpec) validate() error {
+	for _, side := range []int{spec.Width, spec.Height} {
+		if side != 0 && (side < minPanelSide || side > maxPanelSide) {
+			return fmt.Errorf("panel sides must be between %d and %dpx", minPanelSide, maxPanelSide)
+		}
+	}
+	if len(spec.Caption) > maxCaptionLength {
+		return fmt.Errorf("caption must be at most %d characters", maxCaptionLength)
+	}
+	if len(spec.Bubbles) > maxPanelBubbles {
+		return fmt.Errorf("a panel can have at most %d bubbles", maxPanelBubbles)
+	}
+	for _, b := range spec.Bubbles {
+		if len(b.Text) > maxBubbleTextLength {
+			return fmt.Errorf("bubble text must be at most %d characters", maxBubbleTextLength)
+		}
+	}
+	return nil
+}
+
+func (app *App) panelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPanelRequestSize)
+	imageID, err := app.resolveAssetRef(r.FormValue("imageId"), r.FormValue("imageUrl"), "imageId")
+	if err != nil {
+		http.Error(w, "Image ID required", http.StatusBadRequest)
+		return
+	}
+
+	spec := PanelSpec{Caption: r.FormValue("caption")}
+	if text := r.FormValue("bubbleText"); text != "" {
+		spec.Bubbles = append(spec.Bubbles, Bubble{Kind: r.FormValue("bubbleKind"), Text: text})
+	}
+	if err := spec.validate(); err != nil {
+		app.renderPanelError(w, err.Error())
+		return
+	}
+
+	panel, err := app.renderPanel(r.Context(), imageID, spec)
+	if errors.Is(err, ErrBadAsset) {
+		app.renderPanelError(w, "That image isn't one of your compositions")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Panel rendering failed", "err", err)
+		app.renderPanelError(w, "Failed to render panel")
+		return
+	}
+
+	app.renderPanelSuccess(w, panel)
+}
+
+func (app *App) apiPanelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PanelRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxPanelRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, PanelResponse{Error: "Invalid JSON body"})
+		return
+	}
+	if err := req.PanelSpec.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, PanelResponse{Error: err.Error()})
+		return
+	}
+	imageID, err := app.resolveAssetRef(req.ImageID, req.ImageURL, "imageId")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, PanelResponse{Error: "imageId required"})
+		return
+	}
+
+	panel, err := app.renderPanel(r.Context(), imageID, req.PanelSpec)
+	if errors.Is(err, ErrBadAsset) {
+		writeJSON(w, http.StatusBadRequest, PanelResponse{Error: "imageId must be a composite or panel you created"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Panel rendering failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, PanelResponse{Error: "Failed to render panel"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PanelResponse{ID: panel.ID, URL: panel.URL(), Success: true})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write JSON response", "err", err)
+	}
+}
+
+// renderPanel letters the composite or panel imageID and stores the result
+// as a new PNG upload asset.
+func (app *App) renderPanel(ctx context.Context, imageID string, spec PanelSpec) (*Asset, error) {
+	ctx, span := tracer.Start(ctx, "render panel")
+	defer span.End()
+
+	source, data, err := app.loadAsset(ctx, imageID, AssetComposite, AssetPanel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load panel image: %w", err)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode panel image: %v", err)
+	}
+
+	panel, err := drawPanel(src, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, panel); err != nil {
+		return nil, fmt.Errorf("failed to encode panel: %v", err)
+	}
+
+	asset := &Asset{Kind: AssetPanel, Theme: source.Theme, Lighting: source.Lighting}
+	if err := app.saveAsset(ctx, asset, buf.Bytes(), "png"); err != nil {
+		return nil, err
+	}
+	return asset, nil
+}
+
+// drawPanel renders a finished comic panel: the artwork cropped to fill the
+// frame, any speech or thought bubbles, a caption box and the panel border.
+func drawPanel(src image.Image, spec PanelSpec) (*image.RGBA, error) {
+	width, height := spec.Width, spec.Height
+	if width <= 0 {
+		width = defaultPanelWidth
+	}
+	if height <= 0 {
+		height = defaultPanelHeight
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(panelPaper), image.Point{}, draw.Src)
+
+	inner := dst.Bounds().Inset(panelBorder)
+	drawCover(dst, inner, src)
+
+	for _, b := range spec.Bubbles {
+		if strings.TrimSpace(b.Text) == "" {
+			continue
+		}
+		if err := drawBubble(dst, inner, b); err != nil {
+			return nil, err
+		}
+	}
+
+	if caption := strings.TrimSpace(spec.Caption); caption != "" {
+		if err := drawCaptionBox(dst, inner, caption); err != nil {
+			return nil, err
+		}
+	}
+
+	drawFrame(dst, dst.Bounds(), panelBorder, panelInk)
+	return dst, nil
+}
+
+// drawCover scales src to cover r completely, cropping whatever overflows.
+func drawCover(dst draw.Image, r image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if sb.Empty() || r.Empty() {
+		return
+	}
+
+	scale := math.Max(float64(r.Dx())/float64(sb.Dx()), float64(r.Dy())/float64(sb.Dy()))
+	cropW := int(float64(r.Dx()) / scale)
+	cropH := int(float64(r.Dy()) / scale)
+	x0 := sb.Min.X + (sb.Dx()-cropW)/2
+	y0 := sb.Min.Y + (sb.Dy()-cropH)/2
+
+	draw.CatmullRom.Scale(dst, r, src, image.Rect(x0, y0, x0+cropW, y0+cropH), draw.Over, nil)
+}
+
+func drawFrame(dst draw.Image, r image.Rectangle, thickness int, c color.Color) {
+	fill := image.NewUniform(c)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+thickness), fill, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Max.Y-thickness, r.Max.X, r.Max.Y), fill, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Min.X+thickness, r.Max.Y), fill, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Max.X-thickness, r.Min.Y, r.Max.X, r.Max.Y), fill, image.Point{}, draw.Src)
+}
+
+func drawCaptionBox(dst draw.Image, inner image.Rectangle, text string) error {
+	face, err := letteringFace(false, captionFontSize)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	const margin, padding, stroke = 15, 12, 3
+	maxTextWidth := inner.Dx() - 2*(margin+padding)
+	lines := wrapText(face, text, maxTextWidth)
+	lineHeight := face.Metrics().Height.Ceil()
+
+	boxHeight := len(lines)*lineHeight + 2*padding
+	box := image.Rect(inner.Min.X+margin, inner.Max.Y-margin-boxHeight, inner.Max.X-margin, inner.Max.Y-margin)
+
+	draw.Draw(dst, box, image.NewUniform(captionPaper), image.Point{}, draw.Over)
+	drawFrame(dst, box, stroke, panelInk)
+	drawLines(dst, face, lines, box.Inset(padding), panelInk)
+	return nil
+}
+
+func drawBubble(dst draw.Image, inner image.Rectangle, b Bubble) error {
+	thought := b.Kind == BubbleThought
+	face, err := letteringFace(thought, bubbleFontSize)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	// Default placement: balloon upper left, tail pointing at the middle of
+	// the frame where the figurine is usually composed.
+	cx, cy := b.X, b.Y
+	if cx == 0 && cy == 0 {
+		cx, cy = 0.3, 0.2
+	}
+	tx, ty := b.TailX, b.TailY
+	if tx == 0 && ty == 0 {
+		tx, ty = 0.5, 0.55
+	}
+
+	lines := wrapText(face, b.Text, inner.Dx()*2/5)
+	lineHeight := face.Metrics().Height.Ceil()
+	textW := 0
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > textW {
+			textW = w
+		}
+	}
+	textH := len(lines) * lineHeight
+
+	// An ellipse circumscribing a w×h rectangle has radii w/√2 and h/√2.
+	rx := float32(textW)/math.Sqrt2 + 14
+	ry := float32(textH)/math.Sqrt2 + 12
+	centre := [2]float32{
+		float32(inner.Min.X) + float32(cx)*float32(inner.Dx()),
+		float32(inner.Min.Y) + float32(cy)*float32(inner.Dy()),
+	}
+	centre[0] = clampf(centre[0], float32(inner.Min.X)+rx+4, float32(inner.Max.X)-rx-4)
+	centre[1] = clampf(centre[1], float32(inner.Min.Y)+ry+4, float32(inner.Max.Y)-ry-4)
+	tail := [2]float32{
+		float32(inner.Min.X) + float32(tx)*float32(inner.Dx()),
+		float32(inner.Min.Y) + float32(ty)*float32(inner.Dy()),
+	}
+
+	const stroke = 3
+	if thought {
+		// Trail of shrinking puffs from the balloon towards the thinker.
+		dx, dy := tail[0]-centre[0], tail[1]-centre[1]
+		for i, t := range []float32{0.55, 0.72, 0.88} {
+			r := float32(10 - 3*i)
+			px, py := centre[0]+dx*t, centre[1]+dy*t
+			fillShape(dst, panelInk, func(z *vector.Rasterizer) { ellipsePath(z, px, py, r+stroke, r+stroke) })
+			fillShape(dst, panelPaper, func(z *vector.Rasterizer) { ellipsePath(z, px, py, r, r) })
+		}
+	} else {
+		fillShape(dst, panelInk, func(z *vector.Rasterizer) { tailPath(z, centre, tail, ry*0.45+stroke) })
+	}
+
+	fillShape(dst, panelInk, func(z *vector.Rasterizer) { ellipsePath(z, centre[0], centre[1], rx+stroke, ry+stroke) })
+	if !thought {
+		fillShape(dst, panelPaper, func(z *vector.Rasterizer) { tailPath(z, centre, insetPoint(centre, tail, stroke*2), ry*0.45) })
+	}
+	fillShape(dst, panelPaper, func(z *vector.Rasterizer) { ellipsePath(z, centre[0], centre[1], rx, ry) })
+
+	textBox := image.Rect(
+		int(centre[0])-textW/2, int(centre[1])-textH/2,
+		int(centre[0])+textW/2+1, int(centre[1])+textH/2+1,
+	)
+	drawLines(dst, face, lines, textBox, panelInk)
+	return nil
+}
+
+// wrapText breaks text into lines no wider than maxWidth pixels. Words that
+// are wider than a whole line on their own are split between runes.
+func wrapText(face font.Face, text string, maxWidth int) []string {
+	limit := fixed.I(maxWidth)
+	var lines []string
+	var current string
+
+	for _, word := range strings.Fields(text) {
+		for font.MeasureString(face, word) > limit && len([]rune(word)) > 1 {
+			if current != "" {
+				lines = append(lines, current)
+				current = ""
+			}
+			runes := []rune(word)
+			n := len(runes) - 1
+			for n > 1 && font.MeasureString(face, string(runes[:n])) > limit {
+				n--
+			}
+			lines = append(lines, string(runes[:n]))
+			word = string(runes[n:])
+		}
+
+		candidate := word
+		if current != "" {
+			candidate = current + " " + word
+		}
+		if current != "" && font.MeasureString(face, candidate) > limit {
+			lines = append(lines, current)
+			current = word
+		} else {
+			current = candidate
+		}
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// drawLines draws lines centred horizontally and vertically inside r.
+func drawLines(dst draw.Image, face font.Face, lines []string, r image.Rectangle, c color.Color) {
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	top := r.Min.Y + (r.Dy()-len(lines)*lineHeight)/2
+
+	d := &font.Drawer{Dst: dst, Src: image.NewUniform(c), Face: face}
+	for i, line := range lines {
+		w := font.MeasureString(face, line).Ceil()
+		x := r.Min.X + (r.Dx()-w)/2
+		y := top + i*lineHeight + metrics.Ascent.Ceil()
+		d.Dot = fixed.P(x, y)
+		d.DrawString(line)
+	}
+}
+
+func fillShape(dst draw.Image, c color.Color, path func(z *vector.Rasterizer)) {
+	b := dst.Bounds()
+	z := vector.NewRasterizer(b.Max.X, b.Max.Y)
+	path(z)
+	z.Draw(dst, dst.Bounds(), image.NewUniform(c), image.Point{})
+}
+
+// ellipsePath approximates an ellipse with four cubic Bézier curves.
+func ellipsePath(z *vector.Rasterizer, cx, cy, rx, ry float32) {
+	const k = 0.5522847
+	z.MoveTo(cx+rx, cy)
+	z.CubeTo(cx+rx, cy+k*ry, cx+k*rx, cy+ry, cx, cy+ry)
+	z.CubeTo(cx-k*rx, cy+ry, cx-rx, cy+k*ry, cx-rx, cy)
+	z.CubeTo(cx-rx, cy-k*ry, cx-k*rx, cy-ry, cx, cy-ry)
+	z.CubeTo(cx+k*rx, cy-ry, cx+rx, cy-k*ry, cx+rx, cy)
+	z.ClosePath()
+}
+
+// tailPath is a wedge from the balloon centre to tip, halfWidth wide at the
+// base.
+func tailPath(z *vector.Rasterizer, centre, tip [2]float32, halfWidth float32) {
+	dx, dy := tip[0]-centre[0], tip[1]-centre[1]
+	length := float32(math.Hypot(float64(dx), float64(dy)))
+	if length == 0 {
+		return
+	}
+	nx, ny := -dy/length*halfWidth, dx/length*halfWidth
+	z.MoveTo(centre[0]+nx, centre[1]+ny)
+	z.LineTo(tip[0], tip[1])
+	z.LineTo(centre[0]-nx, centre[1]-ny)
+	z.ClosePath()
+}
+
+// insetPoint moves tip towards centre by d pixels.
+func insetPoint(centre, tip [2]float32, d float32) [2]float32 {
+	dx, dy := tip[0]-centre[0], tip[1]-centre[1]
+	length := float32(math.Hypot(float64(dx), float64(dy)))
+	if length <= d {
+		return centre
+	}
+	return [2]float32{tip[0] - dx/length*d, tip[1] - dy/length*d}
+}
+
+func clampf(v, lo, hi float32) float32 {
+	if hi < lo {
+		return (lo + hi) / 2
+	}
+	return float32(math.Min(math.Max(float64(v), float64(lo)), float64(hi)))
+}
+
+func (app *App) renderPanelSuccess(w http.ResponseWriter, panel *Asset) {
+	app.renderPartial(w, "panel-success", panel)
+}
+
+func (app *App) renderPanelError(w http.ResponseWriter, message string) {
+	app.renderPartial(w, "panel-error", message)
+}
+
+// runRenderPanelCommand implements `bananaverse render-panel`, which letters a
+// local image without starting the server or talking to Gemini.
+func runRenderPanelCommand(args []string) error {
+	fs := flag.NewFlagSet("render-panel", flag.ExitOnError)
+	in := fs.String("in", "", "composed image to letter (PNG or JPEG)")
+	out := fs.String("out", "panel.png", "where to write the finished PNG panel")
+	caption := fs.String("caption", "", "caption box text")
+	bubbleText := fs.String("bubble", "", "speech or thought bubble text")
+	bubbleKind := fs.String("bubble-kind", BubbleSpeech, "bubble kind: speech or thought")
+	width := fs.Int("width", defaultPanelWidth, "panel width in pixels")
+	height := fs.Int("height", defaultPanelHeight, "panel height in pixels")
+	fs.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %v", *in, err)
+	}
+
+	spec := PanelSpec{Width: *width, Height: *height, Caption: *caption}
+	if *bubbleText != "" {
+		spec.Bubbles = []Bubble{{Kind: *bubbleKind, Text: *bubbleText}}
+	}
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	panel, err := drawPanel(src, spec)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return png.Encode(dst, panel)
+}
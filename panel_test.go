@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/math/fixed"
+)
+
+func TestWrapText(t *testing.T) {
+	face, err := letteringFace(false, captionFontSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer face.Close()
+
+	const width = 200
+	text := "The figurine climbed the tallest tower in the city " + strings.Repeat("a", 60)
+	lines := wrapText(face, text, width)
+	if len(lines) < 3 {
+		t.Fatalf("got %d lines, want the text wrapped", len(lines))
+	}
+	for _, line := range lines {
+		if font.MeasureString(face, line) > fixed.I(width) {
+			t.Errorf("line %q is wider than %dpx", line, width)
+		}
+	}
+	if got := strings.Join(lines, ""); strings.ReplaceAll(text, " ", "") != strings.ReplaceAll(got, " ", "") {
+		t.Errorf("wrapping lost text: %q", got)
+	}
+	if lines := wrapText(face, "   ", width); len(lines) != 0 {
+		t.Errorf("blank text wrapped to %q", lines)
+	}
+}
+
+func TestPanelSpecValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		spec PanelSpec
+		ok   bool
+	}{
+		{"defaults", PanelSpec{}, true},
+		{"largest", PanelSpec{Width: maxPanelSide, Height: maxPanelSide}, true},
+		{"too wide", PanelSpec{Width: maxPanelSide + 1}, false},
+		{"too small", PanelSpec{Height: minPanelSide - 1}, false},
+		{"negative", PanelSpec{Width: -1}, false},
+		{"long caption", PanelSpec{Caption: strings.Repeat("x", maxCaptionLength+1)}, false},
+		{"long bubble", PanelSpec{Bubbles: []Bubble{{Text: strings.Repeat("x", maxBubbleTextLength+1)}}}, false},
+		{"many bubbles", PanelSpec{Bubbles: make([]Bubble, maxPanelBubbles+1)}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.spec.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v", tt.name, err)
+		}
+	}
+}
+
+func TestAPIPanelRejectsOversizedPanels(t *testing.T) {
+	app := &App{}
+	for _, body := range []string{
+		`{"imageId":"x","width":100000,"height":100000}`,
+		`{"imageId":"x","caption":"` + strings.Repeat("x", maxPanelRequestSize) + `"}`,
+	} {
+		w := httptest.NewRecorder()
+		app.apiPanelHandler(w, httptest.NewRequest(http.MethodPost, "/api/panel", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d, want 400", w.Code)
+		}
+	}
+}
+
+func TestDrawPanel(t *testing.T) {
+	spec := PanelSpec{Width: 300, Height: 200, Caption: "Meanwhile...", Bubbles: []Bubble{{Kind: BubbleThought, Text: "Hmm", X: 0.5, Y: 0.3}}}
+	panel, err := drawPanel(image.NewRGBA(image.Rect(0, 0, 40, 30)), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := panel.Bounds().Size(); got != image.Pt(300, 200) {
+		t.Errorf("panel is %v, want 300x200", got)
+	}
+	if got := panel.RGBAAt(0, 0); got != panelInk {
+		t.Errorf("border pixel is %v, want ink", got)
+	}
+}
+
+func TestLoadLetteringFont(t *testing.T) {
+	t.Setenv("LETTERING_FONT", "")
+	for _, bundled := range []string{bundledBoldFont, "fonts/missing.ttf"} {
+		if _, err := loadLetteringFont("LETTERING_FONT", bundled, gobold.TTF); err != nil {
+			t.Errorf("%s: %v", bundled, err)
+		}
+	}
+	if _, err := loadLetteringFont("LETTERING_FONT", "fonts/README.md", gobold.TTF); err == nil {
+		t.Error("a bundled file that isn't a font loaded")
+	}
+
+	override := filepath.Join(t.TempDir(), "override.ttf")
+	if err := os.WriteFile(override, gobold.TTF, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LETTERING_FONT", override)
+	if _, err := loadLetteringFont("LETTERING_FONT", bundledBoldFont, nil); err != nil {
+		t.Errorf("override: %v", err)
+	}
+	t.Setenv("LETTERING_FONT", filepath.Join(t.TempDir(), "missing.ttf"))
+	if _, err := loadLetteringFont("LETTERING_FONT", bundledBoldFont, gobold.TTF); err == nil {
+		t.Error("a missing font file loaded")
+	}
+}
+
+func TestPanelHandlerRejectsScenes(t *testing.T) {
+	app := testApp(t)
+	scene := &Asset{ID: newID(), Kind: AssetScene, Owner: "alice", Filename: "scene.png"}
+	if err := app.store.PutAsset(scene); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/hx/panel", strings.NewReader("imageId="+scene.ID+"&caption=Meanwhile"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	app.panelHandler(w, asSession(r, "alice"))
+	if body := w.Body.String(); !strings.Contains(body, "one of your compositions") {
+		t.Errorf("lettering a scene: %s", body)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderPartials(t *testing.T) {
+	app := testApp(t)
+	asset := &Asset{ID: "abc123", Kind: AssetComposite, Filename: "abc123.png"}
+	const hostile = `<img src=x onerror="alert(1)">`
+
+	tests := []struct {
+		name   string
+		render func(w *httptest.ResponseRecorder)
+		want   []string
+	}{
+		{"figurine", func(w *httptest.ResponseRecorder) { app.renderFigurineSuccess(w, asset) },
+			[]string{`id="figurine-result"`, `src="/static/uploads/abc123.png"`, `data-asset-id="abc123"`}},
+		{"scene", func(w *httptest.ResponseRecorder) { app.renderSceneSuccess(w, asset) },
+			[]string{`id="scene-result"`, `data-asset-id="abc123"`}},
+		{"composition", func(w *httptest.ResponseRecorder) { app.renderCompositionSuccess(w, asset, "") },
+			[]string{`downloadImage(&#34;/static/uploads/abc123.png&#34;)`, `name="imageId" value="abc123"`}},
+		{"panel", func(w *httptest.ResponseRecorder) { app.renderPanelSuccess(w, asset) },
+			[]string{`id="panel-result"`, `shareAsset(this, &#34;abc123&#34;)`}},
+		{"figurine error", func(w *httptest.ResponseRecorder) { app.renderFigurineError(w, hostile) },
+			[]string{`&lt;img src=x onerror=&#34;alert(1)&#34;&gt;`}},
+		{"scene error", func(w *httptest.ResponseRecorder) { app.renderSceneError(w, hostile) },
+			[]string{`class="error-panel"`, `&lt;img`}},
+		{"panel error", func(w *httptest.ResponseRecorder) { app.renderPanelError(w, hostile) },
+			[]string{`&lt;img`}},
+		{"caption", func(w *httptest.ResponseRecorder) { app.renderPartial(w, "caption", hostile) },
+			[]string{`<span class="generated-caption">&lt;img`}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.render(w)
+		body := w.Body.String()
+		if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q", tt.name, ct)
+		}
+		if strings.Contains(body, hostile) {
+			t.Errorf("%s: message was not escaped", tt.name)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: missing %s in\n%s", tt.name, want, body)
+			}
+		}
+	}
+}
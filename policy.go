@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Where checked text came from.
+const (
+	SourceUser  = "user"
+	SourceModel = "model"
+)
+
+// promptField is one piece of text on its way into a model prompt.
+type promptField struct {
+	name  string
+	value string
+}
+
+// fieldRule limits a field's length and characters. Slug fields such as
+// themes only take letters, digits, spaces and hyphens; free text also
+// allows everyday punctuation.
+type fieldRule struct {
+	maxRunes int
+	slug     bool
+	optional bool
+}
+
+var promptFieldRules = map[string]fieldRule{
+	"theme":       {maxRunes: 60, slug: true},
+	"lighting":    {maxRunes: 60, slug: true},
+	"prompt":      {maxRunes: 300, optional: true},
+	"title":       {maxRunes: 40},
+	"desc":        {maxRunes: 80},
+	"premise":     {maxRunes: 200},
+	"caption":     {maxRunes: 120},
+	"instruction": {maxRunes: 200},
+}
+
+const textPunctuation = "-,.!?'():"
+
+// defaultBlocklist holds terms that never belong in a family-friendly toy
+// scene. PROMPT_BLOCKLIST adds more, comma-separated.
+var defaultBlocklist = []string{
+	"nsfw", "nude", "nudity", "naked", "porn", "pornographic", "sexual", "sexy",
+	"explicit", "gore", "gory", "decapitated", "beheading", "torture", "suicide",
+	"self harm", "swastika", "nazi",
+}
+
+// injectionPatterns catch attempts to talk over the instructions the text is
+// embedded in.
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(ignore|disregard|forget|override)\b.{0,30}\b(instructions?|prompts?|rules|directions|above|previous)\b`),
+	regexp.MustCompile(`\bsystem\s+(prompt|message|instructions?)\b`),
+	regexp.MustCompile(`\b(new|real|actual)\s+instructions?\b`),
+	regexp.MustCompile(`\byou\s+are\s+(now|no\s+longer)\b`),
+	regexp.MustCompile(`\b(jailbreak|developer\s+mode|dan\s+mode)\b`),
+	regexp.MustCompile(`\b(do\s+not|don't)\s+follow\b`),
+}
+
+// PromptPolicy vets user and model text before it is put into a prompt.
+type PromptPolicy struct {
+	blocklist []string
+}
+
+func loadPromptPolicy() *PromptPolicy {
+	p := &PromptPolicy{}
+	terms := append([]string{}, defaultBlocklist...)
+	if extra := os.Getenv("PROMPT_BLOCKLIST"); extra != "" {
+		terms = append(terms, strings.Split(extra, ",")...)
+	}
+	for _, t := range terms {
+		if t = normalizeWords(t); t != "" {
+			p.blocklist = append(p.blocklist, t)
+		}
+	}
+	return p
+}
+
+// PolicyError is a rejection, with a message that can be shown to the user.
+type PolicyError struct {
+	Field   string
+	Rule    string
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s rejected by %s rule: %s", e.Field, e.Rule, e.Message)
+}
+
+// check vets one field and returns the cleaned-up value.
+func (p *PromptPolicy) check(f promptField) (string, *PolicyError) {
+	rule, ok := promptFieldRules[f.name]
+	if !ok {
+		rule = fieldRule{maxRunes: 300}
+	}
+	value := strings.Join(strings.Fields(f.value), " ")
+
+	if value == "" {
+		if rule.optional {
+			return "", nil
+		}
+		return "", &PolicyError{Field: f.name, Rule: "required", Message: fmt.Sprintf("Please enter a %s.", f.name)}
+	}
+	if n := utf8.RuneCountInString(value); n > rule.maxRunes {
+		return "", &PolicyError{Field: f.name, Rule: "length", Message: fmt.Sprintf("The %s can be at most %d characters.", f.name, rule.maxRunes)}
+	}
+	for _, r := range value {
+		if !allowedRune(r, rule.slug) {
+			allowed := "letters, numbers, spaces and hyphens"
+			if !rule.slug {
+				allowed = "letters, numbers, spaces and " + strings.Join(strings.Split(textPunctuation, ""), " ")
+			}
+			return "", &PolicyError{Field: f.name, Rule: "charset", Message: fmt.Sprintf("The %s can only contain %s.", f.name, allowed)}
+		}
+	}
+
+	words := " " + normalizeWords(value) + " "
+	for _, term := range p.blocklist {
+		if strings.Contains(words, " "+term+" ") {
+			return "", &PolicyError{Field: f.name, Rule: "blocklist", Message: fmt.Sprintf("The %s contains words we don't allow in BananaVerse adventures.", f.name)}
+		}
+	}
+	lower := strings.ToLower(value)
+	for _, re := range injectionPatterns {
+		if re.MatchString(lower) {
+			return "", &PolicyError{Field: f.name, Rule: "injection", Message: fmt.Sprintf("The %s looks like it is trying to change our instructions. Please just describe your scene.", f.name)}
+		}
+	}
+	return value, nil
+}
+
+func allowedRune(r rune, slug bool) bool {
+	switch {
+	case unicode.IsLetter(r), unicode.IsDigit(r), unicode.Is(unicode.Mn, r), r == ' ', r == '-':
+		return true
+	case slug:
+		return false
+	}
+	return strings.ContainsRune(textPunctuation, r)
+}
+
+// normalizeWords lowercases text and turns anything that isn't a letter or
+// digit into single spaces, so terms match whole words whatever punctuation
+// surrounds them.
+func normalizeWords(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// checkPrompt runs every field through the policy, logs the decision and
+// returns the cleaned values in order. The first rejection stops the check.
+func (app *App) checkPrompt(ctx context.Context, source, stage string, fields ...promptField) ([]string, error) {
+	decision := &PolicyDecision{
+		Time:    time.Now(),
+		Session: sessionID(ctx),
+		Source:  source,
+		Stage:   stage,
+		Allowed: true,
+		Input:   make(map[string]string, len(fields)),
+	}
+	cleaned := make([]string, 0, len(fields))
+	var rejection *PolicyError
+	for _, f := range fields {
+		// The log keeps what was checked only as far as logs may: redacted
+		// unless LOG_USER_TEXT is on
+		decision.Input[f.name] = userText(truncateRunes(f.value, 200)).LogValue().String()
+		if rejection != nil {
+			continue
+		}
+		value, perr := app.policy.check(f)
+		if perr != nil {
+			rejection = perr
+			decision.Allowed, decision.Field, decision.Rule = false, perr.Field, perr.Rule
+			continue
+		}
+		cleaned = append(cleaned, value)
+	}
+
+	slog.InfoContext(ctx, "Prompt policy decision", "source", source, "stage", stage, "allowed", decision.Allowed, "field", decision.Field, "rule", decision.Rule)
+	if err := app.store.AddPolicyDecision(decision); err != nil {
+		slog.ErrorContext(ctx, "Failed to record policy decision", "err", err)
+	}
+
+	if rejection != nil {
+		return nil, rejection
+	}
+	return cleaned, nil
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
+
+// policyLogPage is what templates/policy.html renders.
+type policyLogPage struct {
+	Decisions    []*PolicyDecision
+	RejectedOnly bool
+}
+
+// adminPolicyLogHandler lists recent policy decisions for review.
+func (app *App) adminPolicyLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page := policyLogPage{RejectedOnly: r.URL.Query().Get("rejected") != ""}
+	decisions, err := app.store.ListPolicyDecisions(200, page.RejectedOnly)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list policy decisions", "err", err)
+		http.Error(w, "Failed to load policy log", http.StatusInternalServerError)
+		return
+	}
+	page.Decisions = decisions
+	if err := app.templates.ExecuteTemplate(w, "policy.html", page); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Template error", "template", "policy.html", "err", err)
+	}
+}
+
+// isEmoji reports whether s is a short run of emoji, as asked of the model
+// for adventure buttons.
+func isEmoji(s string) bool {
+	if s == "" || utf8.RuneCountInString(s) > 8 {
+		return false
+	}
+	for _, r := range s {
+		if r < utf8.RuneSelf || !(unicode.IsSymbol(r) || unicode.Is(unicode.Mn, r) || r == '\u200d' || r == '\ufe0f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// maxRefineTurns is how many earlier edits are replayed to the model as chat
+// history. Each turn carries an image, so the window stays small.
+const maxRefineTurns = 3
+
+const refineIntro = "This is a collectible toy figurine. I will ask you for changes to it one at a time. Each time, reply with the edited figurine image, changing only what I ask and keeping its face, pose, proportions, style and plain background the same."
+
+// figurineView is what the figurine partial renders: the version being
+// shown and every version of the same figurine, to revert to.
+type figurineView struct {
+	*Asset
+	Versions []*Asset
+	Error    string
+}
+
+// figurineVersions returns every version of the figurine's lineage, oldest
+// first.
+func (app *App) figurineVersions(ctx context.Context, figurine *Asset) ([]*Asset, error) {
+	root := figurine.RootID
+	if root == "" {
+		root = figurine.ID
+	}
+	assets, err := app.store.ListAssets(sessionID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var versions []*Asset
+	for _, a := range assets {
+		if a.Kind == AssetFigurine && (a.ID == root || a.RootID == root) {
+			versions = append(versions, a)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// refineFigurine edits a figurine as the next turn of a chat, so the model
+// sees the edits that led to it, and saves the result as a new version.
+// Earlier versions are kept for reverting.
+func (app *App) refineFigurine(ctx context.Context, figurineID, instruction string) (*Asset, error) {
+	current, data, err := app.loadAsset(ctx, figurineID, AssetFigurine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk back through the edits that produced this version
+	type turn struct {
+		asset *Asset
+		data  []byte
+	}
+	chain := []turn{{current, data}}
+	for len(chain) <= maxRefineTurns && chain[0].asset.ParentID != "" {
+		parent, parentData, err := app.loadAsset(ctx, chain[0].asset.ParentID, AssetFigurine)
+		if err != nil {
+			// The rest of the history may have expired; start from here
+			break
+		}
+		chain = append([]turn{{parent, parentData}}, chain...)
+	}
+
+	// The first message shows the oldest version in the window, every
+	// later version is the model's reply to the instruction that made it
+	first := []genai.Part{genai.Text(refineIntro), genai.ImageData("png", chain[0].data)}
+	cs := app.model(StageRefine).StartChat()
+	message := first
+	for _, t := range chain[1:] {
+		message = append(message, genai.Text(t.asset.Instruction))
+		cs.History = append(cs.History,
+			&genai.Content{Role: "user", Parts: message},
+			&genai.Content{Role: "model", Parts: []genai.Part{genai.ImageData("png", t.data)}},
+		)
+		message = nil
+	}
+	message = append(message, genai.Text(instruction))
+
+	resp, err := app.sendChat(ctx, cs, StageRefine, message...)
+	if err != nil {
+		return nil, fmt.Errorf("figurine edit failed: %w", err)
+	}
+	if !hasImage(resp) {
+		return nil, errors.New("no edited figurine image generated")
+	}
+
+	root := current.RootID
+	if root == "" {
+		root = current.ID
+	}
+
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if blob, ok := part.(genai.Blob); ok {
+			// The store numbers it, after whatever version was saved last
+			revision := &Asset{Kind: AssetFigurine, ParentID: current.ID, RootID: root, Instruction: instruction}
+			if err := app.saveAsset(ctx, revision, blob.Data, "png"); err != nil {
+				return nil, err
+			}
+			slog.InfoContext(ctx, "Figurine edited", "asset_id", revision.ID, "parent_id", current.ID, "version", revision.Version)
+			return revision, nil
+		}
+	}
+	return nil, errors.New("no edited figurine image generated")
+}
+
+// figurineEditHandler applies a chat instruction such as "make the jacket
+// red" to a figurine and shows the new version.
+func (app *App) figurineEditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current, err := app.checkAsset(r.Context(), r.PathValue("id"), AssetFigurine)
+	if err != nil {
+		http.Error(w, "Unknown figurine", http.StatusBadRequest)
+		return
+	}
+
+	cleaned, err := app.checkPrompt(r.Context(), SourceUser, StageRefine, promptField{"instruction", r.FormValue("instruction")})
+	if err != nil {
+		app.renderFigurineVersion(w, r, current, userMessage(err, "Invalid instruction"))
+		return
+	}
+
+	ctx, job := app.startJob(r.Context(), StageRefine, map[string]string{"figurineId": current.ID, "instruction": cleaned[0]})
+	revision, err := app.refineFigurine(ctx, current.ID, cleaned[0])
+	app.finishJob(ctx, job, err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Figurine edit failed", "err", err)
+		app.renderFigurineVersion(w, r, current, userMessage(err, "Failed to edit figurine"))
+		return
+	}
+	app.renderFigurineVersion(w, r, revision, "")
+}
+
+// figurineVersionHandler shows an earlier version of a figurine, which
+// reverts to it: later edits and compositions start from the version shown.
+func (app *App) figurineVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	figurine, err := app.checkAsset(r.Context(), r.PathValue("id"), AssetFigurine)
+	if err != nil {
+		http.Error(w, "Unknown figurine", http.StatusBadRequest)
+		return
+	}
+	app.renderFigurineVersion(w, r, figurine, "")
+}
+
+func (app *App) renderFigurineVersion(w http.ResponseWriter, r *http.Request, figurine *Asset, message string) {
+	versions, err := app.figurineVersions(r.Context(), figurine)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list figurine versions", "err", err)
+	}
+	app.renderPartial(w, "figurine-success", figurineView{Asset: figurine, Versions: versions, Error: message})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestRevisionVersions(t *testing.T) {
+	app := testApp(t)
+	root := &Asset{ID: "root", Kind: AssetFigurine, Owner: "alice", Version: 1}
+	if err := app.store.PutAsset(root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Edits that finish at the same time still get their own numbers
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			revision := &Asset{ID: fmt.Sprint("edit", i), Kind: AssetFigurine, Owner: "alice", ParentID: "root", RootID: "root"}
+			if err := app.store.PutAsset(revision); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Another session's lineage is numbered on its own
+	other := &Asset{ID: "other", Kind: AssetFigurine, Owner: "bob", RootID: "elsewhere"}
+	if err := app.store.PutAsset(other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Version != 2 {
+		t.Errorf("first revision of another lineage is version %d", other.Version)
+	}
+
+	ctx := context.WithValue(context.Background(), sessionKey, "alice")
+	versions, err := app.figurineVersions(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, v := range versions {
+		got = append(got, v.Version)
+	}
+	if !slices.Equal(got, []int{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("versions = %v", got)
+	}
+
+	// Saving an existing version again keeps its number
+	versions[2].Instruction = "make it red"
+	if err := app.store.PutAsset(versions[2]); err != nil || versions[2].Version != 3 {
+		t.Errorf("resaving version 3: %d, %v", versions[2].Version, err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRetentionDays is how long each kind of asset is kept once nothing
+// uses it. Exports are rendered again on request, so they go first.
+var defaultRetentionDays = map[string]int{
+	AssetFigurine:  30,
+	AssetScene:     30,
+	AssetComposite: 30,
+	AssetPanel:     90,
+	AssetPage:      7,
+	AssetComicBook: 7,
+	AssetAnimation: 7,
+	AssetCharacter: 30,
+}
+
+const defaultRetentionInterval = time.Hour
+
+// defaultCandidateTTL is how long candidates the user didn't choose are kept.
+const defaultCandidateTTL = 24 * time.Hour
+
+// defaultPolicyLogTTL is how long prompt policy decisions are kept for review.
+const defaultPolicyLogTTL = 30 * 24 * time.Hour
+
+// RetentionPolicy decides which uploads the sweeper deletes. An asset goes
+// once it is older than its kind's TTL, unless it is pinned, used by a comic
+// panel or shown on a share page.
+type RetentionPolicy struct {
+	// TTLs by asset kind; kinds without one are kept forever.
+	TTLs map[string]time.Duration
+	// CandidateTTL applies instead to candidates that weren't chosen; 0
+	// leaves them to their kind's TTL.
+	CandidateTTL time.Duration
+	// PolicyLogTTL is how long prompt policy decisions are kept; 0 keeps
+	// them forever.
+	PolicyLogTTL time.Duration
+	// Interval between sweeps; 0 turns the sweeper off.
+	Interval time.Duration
+	// DryRun logs and counts what would be deleted without deleting it.
+	DryRun bool
+}
+
+// loadRetentionPolicy reads RETENTION_DAYS (kind=days pairs, where 0 keeps
+// that kind forever), RETENTION_CANDIDATES, RETENTION_POLICY_LOG,
+// RETENTION_INTERVAL and RETENTION_DRY_RUN.
+func loadRetentionPolicy() (*RetentionPolicy, error) {
+	days := make(map[string]int)
+	for kind, d := range defaultRetentionDays {
+		days[kind] = d
+	}
+	if env := os.Getenv("RETENTION_DAYS"); env != "" {
+		for _, pair := range strings.Split(env, ",") {
+			kind, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if _, ok := defaultRetentionDays[kind]; !ok {
+				return nil, fmt.Errorf("invalid RETENTION_DAYS: unknown asset kind %q", kind)
+			}
+			d, err := strconv.Atoi(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid RETENTION_DAYS: bad day count %q for %s", value, kind)
+			}
+			days[kind] = d
+		}
+	}
+
+	p := &RetentionPolicy{
+		TTLs:         make(map[string]time.Duration),
+		CandidateTTL: defaultCandidateTTL,
+		PolicyLogTTL: defaultPolicyLogTTL,
+		Interval:     defaultRetentionInterval,
+		DryRun:       os.Getenv("RETENTION_DRY_RUN") == "true",
+	}
+	for kind, d := range days {
+		if d > 0 {
+			p.TTLs[kind] = time.Duration(d) * 24 * time.Hour
+		}
+	}
+	if s := os.Getenv("RETENTION_INTERVAL"); s != "" {
+		interval, err := time.ParseDuration(s)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid RETENTION_INTERVAL %q", s)
+		}
+		p.Interval = interval
+	}
+	if s := os.Getenv("RETENTION_CANDIDATES"); s != "" {
+		ttl, err := time.ParseDuration(s)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid RETENTION_CANDIDATES %q", s)
+		}
+		p.CandidateTTL = ttl
+	}
+	if s := os.Getenv("RETENTION_POLICY_LOG"); s != "" {
+		ttl, err := time.ParseDuration(s)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid RETENTION_POLICY_LOG %q", s)
+		}
+		p.PolicyLogTTL = ttl
+	}
+	return p, nil
+}
+
+// Expired reports whether a has outlived its kind's TTL, or the candidate
+// TTL if it is a candidate the user didn't choose.
+func (p *RetentionPolicy) Expired(a *Asset, now time.Time) bool {
+	if a.Candidate && p.CandidateTTL > 0 {
+		return now.Sub(a.Created) > p.CandidateTTL
+	}
+	ttl, ok := p.TTLs[a.Kind]
+	return ok && now.Sub(a.Created) > ttl
+}
+
+// assetLeases keeps the sweeper from deleting a file while it is being read.
+// Readers lease the asset before looking it up and the sweeper claims it
+// before deleting the record, so a reader either sees the asset gone or
+// holds it until it has finished with the file.
+type assetLeases struct {
+	mu       sync.Mutex
+	readers  map[string]int
+	deleting map[string]bool
+}
+
+// acquire leases id for reading. It fails if the asset is being deleted.
+func (l *assetLeases) acquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.deleting[id] {
+		return false
+	}
+	if l.readers == nil {
+		l.readers = make(map[string]int)
+	}
+	l.readers[id]++
+	return true
+}
+
+func (l *assetLeases) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readers[id]--; l.readers[id] <= 0 {
+		delete(l.readers, id)
+	}
+}
+
+// claim reserves id for deletion. It fails if the asset is being read.
+func (l *assetLeases) claim(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readers[id] > 0 {
+		return false
+	}
+	if l.deleting == nil {
+		l.deleting = make(map[string]bool)
+	}
+	l.deleting[id] = true
+	return true
+}
+
+func (l *assetLeases) unclaim(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.deleting, id)
+}
+
+// runRetention sweeps uploads every policy interval until ctx is done.
+func (app *App) runRetention(ctx context.Context) {
+	if app.retention.Interval == 0 {
+		slog.Info("Retention sweeper disabled")
+		return
+	}
+	ticker := time.NewTicker(app.retention.Interval)
+	defer ticker.Stop()
+	for {
+		if err := app.sweep(ctx); err != nil {
+			slog.ErrorContext(ctx, "Retention sweep failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep deletes the expired, unused assets and their files, or in dry-run
+// mode only reports them.
+func (app *App) sweep(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "retention sweep")
+	defer span.End()
+
+	now := time.Now()
+	action := "deleted"
+	var assets []*Asset
+	var err error
+	if app.retention.DryRun {
+		action = "would_delete"
+		assets, err = app.store.ExpiredAssets(func(a *Asset) bool {
+			return app.retention.Expired(a, now)
+		})
+	} else {
+		var claimed []string
+		assets, err = app.store.DeleteExpiredAssets(func(a *Asset) bool {
+			if !app.retention.Expired(a, now) || !app.leases.claim(a.ID) {
+				return false
+			}
+			claimed = append(claimed, a.ID)
+			return true
+		})
+		// The records are gone by now, so new readers find nothing even
+		// after the claims are dropped
+		defer func() {
+			for _, id := range claimed {
+				app.leases.unclaim(id)
+			}
+		}()
+	}
+	if err != nil {
+		return err
+	}
+
+	var freed int64
+	for _, a := range assets {
+		path := filepath.Join("static", "uploads", filepath.Base(a.Filename))
+		var size int64
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		}
+		if !app.retention.DryRun {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.ErrorContext(ctx, "Failed to delete expired asset file", "asset_id", a.ID, "err", err)
+				continue
+			}
+		}
+		slog.DebugContext(ctx, "Expired asset", "asset_id", a.ID, "kind", a.Kind, "created", a.Created, "action", action)
+		retentionAssets.WithLabelValues(a.Kind, action).Inc()
+		retentionBytes.WithLabelValues(a.Kind, action).Add(float64(size))
+		freed += size
+	}
+
+	decisions := 0
+	if app.retention.PolicyLogTTL > 0 && !app.retention.DryRun {
+		if decisions, err = app.store.DeletePolicyDecisions(now.Add(-app.retention.PolicyLogTTL)); err != nil {
+			return err
+		}
+	}
+
+	retentionLastSweep.SetToCurrentTime()
+	slog.InfoContext(ctx, "Retention sweep finished",
+		"assets", len(assets), "bytes", freed, "policy_decisions", decisions, "dry_run", app.retention.DryRun,
+		"duration_ms", time.Since(now).Milliseconds())
+	return nil
+}
+
+// AssetResponse is the JSON body for requests on a single asset.
+type AssetResponse struct {
+	Asset   *Asset `json:"asset,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// apiAssetPinHandler pins (POST) or unpins (DELETE) one of the session's
+// assets, so the sweeper keeps it.
+func (app *App) apiAssetPinHandler(w http.ResponseWriter, r *http.Request) {
+	var pinned bool
+	switch r.Method {
+	case http.MethodPost:
+		pinned = true
+	case http.MethodDelete:
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, AssetResponse{Error: "Method not allowed"})
+		return
+	}
+	id := r.PathValue("id")
+	if _, err := app.checkAsset(r.Context(), id); err != nil {
+		writeJSON(w, http.StatusNotFound, AssetResponse{Error: "Asset not found"})
+		return
+	}
+	asset, err := app.store.PinAsset(id, pinned)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to pin asset", "asset_id", id, "err", err)
+		writeJSON(w, http.StatusInternalServerError, AssetResponse{Error: "Failed to update asset"})
+		return
+	}
+	writeJSON(w, http.StatusOK, AssetResponse{Asset: asset, Success: true})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoadRetentionPolicy(t *testing.T) {
+	t.Setenv("RETENTION_DAYS", "figurine=2, page=0")
+	t.Setenv("RETENTION_CANDIDATES", "1h")
+	t.Setenv("RETENTION_POLICY_LOG", "")
+	t.Setenv("RETENTION_INTERVAL", "0")
+	p, err := loadRetentionPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TTLs[AssetFigurine] != 48*time.Hour || p.TTLs[AssetPanel] != 90*24*time.Hour {
+		t.Errorf("TTLs = %v", p.TTLs)
+	}
+	if _, ok := p.TTLs[AssetPage]; ok {
+		t.Error("pages kept forever still have a TTL")
+	}
+	if p.CandidateTTL != time.Hour || p.PolicyLogTTL != defaultPolicyLogTTL || p.Interval != 0 {
+		t.Errorf("policy = %+v", p)
+	}
+
+	for env, value := range map[string]string{
+		"RETENTION_DAYS":       "hologram=3",
+		"RETENTION_CANDIDATES": "soon",
+		"RETENTION_POLICY_LOG": "-1h",
+		"RETENTION_INTERVAL":   "hourly",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := loadRetentionPolicy(); err == nil {
+				t.Errorf("%s=%s accepted", env, value)
+			}
+		})
+	}
+}
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Now()
+	p := &RetentionPolicy{
+		TTLs:         map[string]time.Duration{AssetScene: 24 * time.Hour},
+		CandidateTTL: time.Hour,
+	}
+	tests := []struct {
+		asset Asset
+		want  bool
+	}{
+		{Asset{Kind: AssetScene, Created: now.Add(-25 * time.Hour)}, true},
+		{Asset{Kind: AssetScene, Created: now.Add(-23 * time.Hour)}, false},
+		{Asset{Kind: AssetScene, Candidate: true, Created: now.Add(-2 * time.Hour)}, true},
+		{Asset{Kind: AssetPanel, Created: now.Add(-1000 * time.Hour)}, false},
+		{Asset{Kind: AssetPanel, Candidate: true, Created: now.Add(-2 * time.Hour)}, true},
+	}
+	for _, tt := range tests {
+		if got := p.Expired(&tt.asset, now); got != tt.want {
+			t.Errorf("Expired(%s, candidate=%v, age %v) = %v", tt.asset.Kind, tt.asset.Candidate, now.Sub(tt.asset.Created).Round(time.Hour), got)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	app := testApp(t)
+	app.retention = &RetentionPolicy{
+		TTLs:         map[string]time.Duration{AssetScene: 24 * time.Hour},
+		PolicyLogTTL: 24 * time.Hour,
+		DryRun:       true,
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	asset := func(id string, pinned bool) *Asset {
+		a := &Asset{ID: id, Kind: AssetScene, Owner: "alice", Filename: "missing-" + id + ".png", Created: old, Pinned: pinned}
+		if err := app.store.PutAsset(a); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	asset("expired", false)
+	asset("pinned", true)
+	asset("in-panel", false)
+	asset("shared", false)
+	asset("leased", false)
+	fresh := asset("fresh", false)
+	fresh.Created = time.Now()
+	if err := app.store.PutAsset(fresh); err != nil {
+		t.Fatal(err)
+	}
+	comic := &Comic{ID: newID(), Owner: "alice", Created: old}
+	if err := app.store.CreateComic(comic); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.store.AddPanel(&Panel{ID: newID(), ComicID: comic.ID, SceneID: "in-panel", ComposedID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.store.CreateShare(&Share{ID: newID(), Owner: "alice", AssetIDs: []string{"shared"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.store.AddPolicyDecision(&PolicyDecision{Time: old, Stage: StageScene}); err != nil {
+		t.Fatal(err)
+	}
+	if !app.leases.acquire("leased") {
+		t.Fatal("couldn't lease")
+	}
+	defer app.leases.release("leased")
+
+	exists := func(id string) bool {
+		_, err := app.store.GetAsset(id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// A dry run deletes nothing
+	if err := app.sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("expired") {
+		t.Error("dry run deleted an asset")
+	}
+	if decisions, _ := app.store.ListPolicyDecisions(10, false); len(decisions) != 1 {
+		t.Errorf("dry run deleted policy decisions: %v", decisions)
+	}
+
+	app.retention.DryRun = false
+	if err := app.sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{
+		"expired":  false,
+		"pinned":   true,
+		"in-panel": true,
+		"shared":   true,
+		"leased":   true,
+		"fresh":    true,
+	} {
+		if got := exists(id); got != want {
+			t.Errorf("%s: exists = %v, want %v", id, got, want)
+		}
+	}
+	if decisions, _ := app.store.ListPolicyDecisions(10, false); len(decisions) != 0 {
+		t.Errorf("old policy decisions kept: %v", decisions)
+	}
+	if !app.leases.acquire("expired") {
+		t.Error("sweep left a deleted asset claimed")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Model call stages. Each has its own safety thresholds.
+const (
+	StageAnalysis   = "analysis"
+	StageFigurine   = "figurine"
+	StageScene      = "scene"
+	StageCompose    = "compose"
+	StageCaption    = "caption"
+	StageAdventures = "adventures"
+	StageStory      = "story"
+	StageCharacter  = "character"
+	StageDrift      = "drift"
+	StageRefine     = "refine"
+	StageSceneEdit  = "scene_edit"
+	StageVerify     = "verify"
+)
+
+var safetyStages = []string{StageAnalysis, StageFigurine, StageScene, StageCompose, StageCaption, StageAdventures, StageStory, StageCharacter, StageDrift, StageRefine, StageSceneEdit, StageVerify}
+
+const (
+	geminiTextModel  = "gemini-1.5-flash"
+	geminiImageModel = "gemini-2.5-flash-image-preview"
+)
+
+// stageModels is the Gemini model each stage calls.
+var stageModels = map[string]string{
+	StageAnalysis:   geminiTextModel,
+	StageFigurine:   geminiImageModel,
+	StageScene:      geminiImageModel,
+	StageCompose:    geminiImageModel,
+	StageCaption:    geminiTextModel,
+	StageAdventures: geminiTextModel,
+	StageStory:      geminiTextModel,
+	StageCharacter:  geminiImageModel,
+	StageDrift:      geminiTextModel,
+	StageRefine:     geminiImageModel,
+	StageSceneEdit:  geminiImageModel,
+	StageVerify:     geminiTextModel,
+}
+
+// safetyLevels maps the names admins pick from to Gemini thresholds. "low"
+// is the strictest: anything rated low risk or above is blocked.
+var safetyLevels = map[string]genai.HarmBlockThreshold{
+	"low":    genai.HarmBlockLowAndAbove,
+	"medium": genai.HarmBlockMediumAndAbove,
+	"high":   genai.HarmBlockOnlyHigh,
+	"none":   genai.HarmBlockNone,
+}
+
+var safetyLevelNames = []string{"low", "medium", "high", "none"}
+
+// Selfies go through the analysis and figurine stages, so they start out
+// stricter than the rest.
+var defaultSafetyLevels = map[string]string{
+	StageAnalysis:   "low",
+	StageFigurine:   "low",
+	StageScene:      "medium",
+	StageCompose:    "medium",
+	StageCaption:    "medium",
+	StageAdventures: "medium",
+	StageStory:      "medium",
+	StageCharacter:  "medium",
+	StageDrift:      "medium",
+	StageRefine:     "low",
+	StageSceneEdit:  "medium",
+	StageVerify:     "medium",
+}
+
+var safetyCategories = []genai.HarmCategory{
+	genai.HarmCategoryHarassment,
+	genai.HarmCategoryHateSpeech,
+	genai.HarmCategorySexuallyExplicit,
+	genai.HarmCategoryDangerousContent,
+}
+
+// Finish reasons newer than the SDK's enum that also mean the output was
+// withheld by policy.
+const (
+	finishBlocklist         genai.FinishReason = 7
+	finishProhibitedContent genai.FinishReason = 8
+	finishSPII              genai.FinishReason = 9
+	finishImageSafety       genai.FinishReason = 11
+)
+
+const safetySettingKey = "safety_levels"
+
+// SafetyPolicy holds the current threshold for every stage.
+type SafetyPolicy struct {
+	mu     sync.RWMutex
+	levels map[string]string
+}
+
+// loadSafetyPolicy starts from the defaults, then applies SAFETY_LEVELS
+// (e.g. "scene=high,caption=low") and finally whatever an admin saved.
+func loadSafetyPolicy(store *Store) (*SafetyPolicy, error) {
+	p := &SafetyPolicy{levels: make(map[string]string)}
+	for stage, level := range defaultSafetyLevels {
+		p.levels[stage] = level
+	}
+
+	if env := os.Getenv("SAFETY_LEVELS"); env != "" {
+		overrides := make(map[string]string)
+		for _, pair := range strings.Split(env, ",") {
+			stage, level, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			overrides[stage] = level
+		}
+		if err := p.Set(overrides); err != nil {
+			return nil, fmt.Errorf("invalid SAFETY_LEVELS: %v", err)
+		}
+	}
+
+	var saved map[string]string
+	if err := store.GetSetting(safetySettingKey, &saved); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := p.Set(saved); err != nil {
+		slog.Warn("Ignoring saved safety levels", "err", err)
+	}
+	return p, nil
+}
+
+// Set changes the levels for the given stages, leaving the others alone.
+func (p *SafetyPolicy) Set(levels map[string]string) error {
+	for stage, level := range levels {
+		if _, ok := defaultSafetyLevels[stage]; !ok {
+			return fmt.Errorf("unknown stage %q", stage)
+		}
+		if _, ok := safetyLevels[level]; !ok {
+			return fmt.Errorf("unknown level %q for %s", level, stage)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for stage, level := range levels {
+		p.levels[stage] = level
+	}
+	return nil
+}
+
+// Levels returns a copy of the current levels.
+func (p *SafetyPolicy) Levels() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	levels := make(map[string]string, len(p.levels))
+	for stage, level := range p.levels {
+		levels[stage] = level
+	}
+	return levels
+}
+
+func (p *SafetyPolicy) settings(stage string) []*genai.SafetySetting {
+	p.mu.RLock()
+	threshold := safetyLevels[p.levels[stage]]
+	p.mu.RUnlock()
+
+	settings := make([]*genai.SafetySetting, 0, len(safetyCategories))
+	for _, c := range safetyCategories {
+		settings = append(settings, &genai.SafetySetting{Category: c, Threshold: threshold})
+	}
+	return settings
+}
+
+// model returns the stage's Gemini model configured with its safety
+// settings.
+func (app *App) model(stage string) *genai.GenerativeModel {
+	m := app.geminiClient.GenerativeModel(stageModels[stage])
+	m.SafetySettings = app.safety.settings(stage)
+	return m
+}
+
+// SafetyError means Gemini refused a prompt or withheld its output.
+type SafetyError struct {
+	Stage  string
+	Reason string
+}
+
+func (e *SafetyError) Error() string {
+	return fmt.Sprintf("%s blocked by safety filters: %s", e.Stage, e.Reason)
+}
+
+// checkResponse turns prompt blocks and policy finish reasons into a
+// SafetyError. Other errors are returned unchanged.
+func checkResponse(stage string, resp *genai.GenerateContentResponse, err error) error {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		if blocked.PromptFeedback != nil {
+			return &SafetyError{Stage: stage, Reason: "prompt " + blocked.PromptFeedback.BlockReason.String()}
+		}
+		if blocked.Candidate != nil {
+			return &SafetyError{Stage: stage, Reason: "candidate " + blocked.Candidate.FinishReason.String()}
+		}
+		return &SafetyError{Stage: stage, Reason: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != genai.BlockReasonUnspecified {
+		return &SafetyError{Stage: stage, Reason: "prompt " + resp.PromptFeedback.BlockReason.String()}
+	}
+	if len(resp.Candidates) > 0 {
+		switch reason := resp.Candidates[0].FinishReason; reason {
+		case genai.FinishReasonSafety, genai.FinishReasonRecitation,
+			finishBlocklist, finishProhibitedContent, finishSPII, finishImageSafety:
+			return &SafetyError{Stage: stage, Reason: "candidate " + reason.String()}
+		}
+	}
+	return nil
+}
+
+var safetyMessages = map[string]string{
+	StageAnalysis:   "🛡️ This photo was flagged by our content filters. Please try a different photo.",
+	StageFigurine:   "🛡️ This photo was flagged by our content filters. Please try a different photo.",
+	StageScene:      "🛡️ That scene idea was flagged by our content filters. Try a different theme or description.",
+	StageCompose:    "🛡️ This combination was flagged by our content filters. Try a different scene.",
+	StageCaption:    "🛡️ We couldn't caption this scene. Try describing it differently.",
+	StageAdventures: "🛡️ We couldn't come up with adventures right now.",
+	StageStory:      "🛡️ That story idea was flagged by our content filters. Try a different premise.",
+	StageCharacter:  "🛡️ This figurine was flagged by our content filters. Please try a different photo.",
+	StageDrift:      "🛡️ We couldn't check this panel against your character.",
+	StageRefine:     "🛡️ That change was flagged by our content filters. Try asking for something different.",
+	StageSceneEdit:  "🛡️ That change was flagged by our content filters. Try asking for something different.",
+	StageVerify:     "🛡️ We couldn't check how your figurine was placed in this panel.",
+}
+
+// userMessage explains a failed generation to the user: policy rejections
+// and safety blocks get advice on what to change, anything else gets the
+// technical message.
+func userMessage(err error, technical string) string {
+	var rejected *PolicyError
+	if errors.As(err, &rejected) {
+		return rejected.Message
+	}
+	var safety *SafetyError
+	if errors.As(err, &safety) {
+		return safetyMessages[safety.Stage]
+	}
+	return technical
+}
+
+// safetyPage is what templates/safety.html renders.
+type safetyPage struct {
+	Stages []string
+	Levels map[string]string
+	Names  []string
+	Saved  bool
+}
+
+// adminSafetyHandler shows (GET) and updates (POST) the per-stage safety
+// thresholds. Changes apply to the next model call and survive restarts.
+func (app *App) adminSafetyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		levels := make(map[string]string)
+		for _, stage := range safetyStages {
+			if level := r.FormValue(stage); level != "" {
+				levels[stage] = level
+			}
+		}
+		if err := app.safety.Set(levels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := app.store.PutSetting(safetySettingKey, app.safety.Levels()); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save safety levels", "err", err)
+			http.Error(w, "Failed to save safety levels", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Safety levels updated", "levels", app.safety.Levels())
+		http.Redirect(w, r, "/admin/safety?saved=1", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := safetyPage{
+		Stages: safetyStages,
+		Levels: app.safety.Levels(),
+		Names:  safetyLevelNames,
+		Saved:  r.URL.Query().Get("saved") != "",
+	}
+	if err := app.templates.ExecuteTemplate(w, "safety.html", page); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Template error", "template", "safety.html", "err", err)
+	}
+}
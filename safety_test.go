@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestEveryStageIsConfigured(t *testing.T) {
+	for _, stage := range safetyStages {
+		if stageModels[stage] == "" {
+			t.Errorf("%s has no model", stage)
+		}
+		if _, ok := safetyLevels[defaultSafetyLevels[stage]]; !ok {
+			t.Errorf("%s has no default safety level", stage)
+		}
+		if safetyMessages[stage] == "" {
+			t.Errorf("%s has no safety message", stage)
+		}
+	}
+}
+
+func TestLoadSafetyPolicy(t *testing.T) {
+	store := testStore(t)
+	t.Setenv("SAFETY_LEVELS", "scene=high, caption=none")
+	if err := store.PutSetting(safetySettingKey, map[string]string{"caption": "low"}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadSafetyPolicy(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels := p.Levels()
+	// Saved admin choices win over the environment, which wins over the
+	// defaults.
+	if levels[StageScene] != "high" || levels[StageCaption] != "low" || levels[StageFigurine] != defaultSafetyLevels[StageFigurine] {
+		t.Errorf("got levels %v", levels)
+	}
+	for _, s := range p.settings(StageScene) {
+		if s.Threshold != safetyLevels["high"] {
+			t.Errorf("scene %v threshold is %v", s.Category, s.Threshold)
+		}
+	}
+
+	if err := p.Set(map[string]string{"scene": "extreme"}); err == nil {
+		t.Error("accepted an unknown level")
+	}
+	if err := p.Set(map[string]string{"nonsense": "low"}); err == nil {
+		t.Error("accepted an unknown stage")
+	}
+	t.Setenv("SAFETY_LEVELS", "scene=extreme")
+	if _, err := loadSafetyPolicy(store); err == nil {
+		t.Error("accepted an invalid SAFETY_LEVELS")
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	blocked := &genai.GenerateContentResponse{PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockReasonSafety}}
+	withheld := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{FinishReason: finishImageSafety}}}
+	fine := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{FinishReason: genai.FinishReasonStop}}}
+	network := errors.New("connection reset")
+
+	var safety *SafetyError
+	for name, err := range map[string]error{
+		"blocked prompt":   checkResponse(StageScene, blocked, nil),
+		"withheld image":   checkResponse(StageScene, withheld, nil),
+		"blocked by error": checkResponse(StageScene, nil, &genai.BlockedError{PromptFeedback: blocked.PromptFeedback}),
+	} {
+		if !errors.As(err, &safety) || safety.Stage != StageScene {
+			t.Errorf("%s: got %v, want a SafetyError", name, err)
+		}
+	}
+	if err := checkResponse(StageScene, fine, nil); err != nil {
+		t.Errorf("finished response: %v", err)
+	}
+	if err := checkResponse(StageScene, nil, network); err != network {
+		t.Errorf("other errors should pass through, got %v", err)
+	}
+
+	wrapped := fmt.Errorf("scene generation failed: %w", checkResponse(StageScene, blocked, nil))
+	if got := userMessage(wrapped, "technical"); got != safetyMessages[StageScene] {
+		t.Errorf("userMessage = %q", got)
+	}
+	if got := userMessage(network, "technical"); got != "technical" {
+		t.Errorf("userMessage = %q", got)
+	}
+}
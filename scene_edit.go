@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/google/generative-ai-go/genai"
+	"golang.org/x/image/draw"
+)
+
+const sceneEditPrompt = "Edit this background scene: %s. Keep its style, lighting, perspective and composition, and leave space for character placement."
+
+const sceneMaskPrompt = "The second image is a mask. Change only the part of the scene under the white rectangle and leave everything under the black area exactly as it is."
+
+// sceneView is what the scene partial renders.
+type sceneView struct {
+	*Asset
+	Error string
+}
+
+// maskRect is the part of a scene an edit may change, as percentages of
+// the image's width and height.
+type maskRect struct {
+	X, Y, W, H float64
+}
+
+// parseMaskRect reads the maskX, maskY, maskW and maskH form fields. It
+// returns nil when none are set, which lets the edit change the whole scene.
+func parseMaskRect(r *http.Request) (*maskRect, error) {
+	names := []string{"maskX", "maskY", "maskW", "maskH"}
+	values := make([]float64, len(names))
+	set := 0
+	for i, name := range names {
+		raw := r.FormValue(name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v < 0 || v > 100 {
+			return nil, fmt.Errorf("%s must be a percentage", name)
+		}
+		values[i] = v
+		set++
+	}
+	switch {
+	case set == 0:
+		return nil, nil
+	case set < len(names):
+		return nil, errors.New("the mask needs maskX, maskY, maskW and maskH")
+	}
+	m := &maskRect{X: values[0], Y: values[1], W: values[2], H: values[3]}
+	if m.W <= 0 || m.H <= 0 || m.X+m.W > 100 || m.Y+m.H > 100 {
+		return nil, errors.New("the mask must be a rectangle inside the scene")
+	}
+	return m, nil
+}
+
+// pixels returns the mask as a rectangle within bounds.
+func (m *maskRect) pixels(bounds image.Rectangle) image.Rectangle {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	return image.Rect(
+		bounds.Min.X+int(m.X*w/100), bounds.Min.Y+int(m.Y*h/100),
+		bounds.Min.X+int((m.X+m.W)*w/100+0.5), bounds.Min.Y+int((m.Y+m.H)*h/100+0.5),
+	).Intersect(bounds)
+}
+
+// maskImage draws the mask as the model sees it: white where the scene may
+// change, black everywhere else.
+func maskImage(bounds image.Rectangle, rect image.Rectangle) ([]byte, error) {
+	mask := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(mask, rect.Sub(bounds.Min), image.NewUniform(color.White), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, mask); err != nil {
+		return nil, fmt.Errorf("failed to encode mask: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// keepOutsideMask pastes the masked part of the edited image onto the
+// original, so nothing outside the rectangle changes even if the model
+// redrew it. The edit is scaled to the original's size first.
+func keepOutsideMask(original, edited image.Image, rect image.Rectangle) image.Image {
+	b := original.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), original, b.Min, draw.Src)
+
+	scaled := image.NewRGBA(out.Bounds())
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), edited, edited.Bounds(), draw.Src, nil)
+	r := rect.Sub(b.Min)
+	draw.Draw(out, r, scaled, r.Min, draw.Src)
+	return out
+}
+
+// editScene applies an instruction to a scene and saves the result as a
+// new scene linked to the original. With a mask, only that rectangle
+// changes.
+func (app *App) editScene(ctx context.Context, sceneID, instruction string, mask *maskRect) (*Asset, error) {
+	scene, data, err := app.loadAsset(ctx, sceneID, AssetScene)
+	if err != nil {
+		return nil, err
+	}
+
+	var original image.Image
+	var rect image.Rectangle
+	parts := []genai.Part{genai.Text(fmt.Sprintf(sceneEditPrompt, instruction)), genai.ImageData("png", data)}
+	if mask != nil {
+		if original, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to decode scene: %v", err)
+		}
+		rect = mask.pixels(original.Bounds())
+		if rect.Empty() {
+			return nil, errors.New("the mask is too small")
+		}
+		maskData, err := maskImage(original.Bounds(), rect)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, genai.ImageData("png", maskData), genai.Text(sceneMaskPrompt))
+	}
+
+	resp, err := app.generate(ctx, app.model(StageSceneEdit), StageSceneEdit, parts...)
+	if err != nil {
+		return nil, fmt.Errorf("scene edit failed: %w", err)
+	}
+	if !hasImage(resp) {
+		return nil, errors.New("no edited scene image generated")
+	}
+
+	for _, part := range resp.Candidates[0].Content.Parts {
+		blob, ok := part.(genai.Blob)
+		if !ok {
+			continue
+		}
+		result := blob.Data
+		if mask != nil {
+			edited, _, err := image.Decode(bytes.NewReader(blob.Data))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode edited scene: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, keepOutsideMask(original, edited, rect)); err != nil {
+				return nil, fmt.Errorf("failed to encode edited scene: %v", err)
+			}
+			result = buf.Bytes()
+		}
+
+		variant := &Asset{Kind: AssetScene, ParentID: scene.ID, Theme: scene.Theme, Lighting: scene.Lighting, Prompt: scene.Prompt, Instruction: instruction}
+		if err := app.saveAsset(ctx, variant, result, "png"); err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "Scene edited", "asset_id", variant.ID, "parent_id", scene.ID, "masked", mask != nil)
+		return variant, nil
+	}
+	return nil, errors.New("no edited scene image generated")
+}
+
+// sceneEditHandler applies an instruction such as "add a full moon" to a
+// scene, optionally only inside a rectangle, and shows the edited variant.
+func (app *App) sceneEditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	scene, err := app.checkAsset(r.Context(), r.PathValue("id"), AssetScene)
+	if err != nil {
+		http.Error(w, "Unknown scene", http.StatusBadRequest)
+		return
+	}
+	mask, err := parseMaskRect(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cleaned, err := app.checkPrompt(r.Context(), SourceUser, StageSceneEdit, promptField{"instruction", r.FormValue("instruction")})
+	if err != nil {
+		app.renderPartial(w, "scene-success", sceneView{Asset: scene, Error: userMessage(err, "Invalid instruction")})
+		return
+	}
+
+	input := map[string]string{"sceneId": scene.ID, "instruction": cleaned[0]}
+	if mask != nil {
+		input["mask"] = fmt.Sprintf("%g,%g,%g,%g", mask.X, mask.Y, mask.W, mask.H)
+	}
+	ctx, job := app.startJob(r.Context(), StageSceneEdit, input)
+	variant, err := app.editScene(ctx, scene.ID, cleaned[0], mask)
+	app.finishJob(ctx, job, err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Scene edit failed", "err", err)
+		app.renderPartial(w, "scene-success", sceneView{Asset: scene, Error: userMessage(err, "Failed to edit scene")})
+		return
+	}
+	app.renderSceneSuccess(w, variant)
+}
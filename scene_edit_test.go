@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseMaskRect(t *testing.T) {
+	tests := []struct {
+		form    string
+		want    *maskRect
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"maskX=10&maskY=20&maskW=30&maskH=40", &maskRect{10, 20, 30, 40}, false},
+		{"maskX=0&maskY=0&maskW=100&maskH=100", &maskRect{0, 0, 100, 100}, false},
+		{"maskX=10&maskY=20&maskW=30", nil, true},
+		{"maskX=-1&maskY=0&maskW=10&maskH=10", nil, true},
+		{"maskX=abc&maskY=0&maskW=10&maskH=10", nil, true},
+		{"maskX=0&maskY=0&maskW=0&maskH=10", nil, true},
+		{"maskX=60&maskY=0&maskW=50&maskH=10", nil, true},
+		{"maskX=0&maskY=95&maskW=10&maskH=10", nil, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/hx/scene/abc/edit", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		got, err := parseMaskRect(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v", tt.form, err)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.form, got, tt.want)
+		}
+	}
+}
+
+func TestMaskPixels(t *testing.T) {
+	m := &maskRect{X: 25, Y: 10, W: 50, H: 33.4}
+	if got, want := m.pixels(image.Rect(0, 0, 200, 100)), image.Rect(50, 10, 150, 43); got != want {
+		t.Errorf("pixels = %v, want %v", got, want)
+	}
+	// Bounds that don't start at the origin
+	if got, want := m.pixels(image.Rect(100, 100, 300, 200)), image.Rect(150, 110, 250, 143); got != want {
+		t.Errorf("offset pixels = %v, want %v", got, want)
+	}
+	full := &maskRect{W: 100, H: 100}
+	if got := full.pixels(image.Rect(0, 0, 33, 17)); got != image.Rect(0, 0, 33, 17) {
+		t.Errorf("whole-image mask = %v", got)
+	}
+}
+
+func TestMaskImage(t *testing.T) {
+	data, err := maskImage(image.Rect(0, 0, 40, 20), image.Rect(10, 5, 20, 15))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask.Bounds() != image.Rect(0, 0, 40, 20) {
+		t.Errorf("mask bounds %v", mask.Bounds())
+	}
+	for _, p := range []struct {
+		x, y  int
+		white bool
+	}{{10, 5, true}, {19, 14, true}, {9, 5, false}, {20, 14, false}, {0, 0, false}} {
+		if white := color.GrayModel.Convert(mask.At(p.x, p.y)).(color.Gray).Y == 0xff; white != p.white {
+			t.Errorf("mask at %d,%d white = %v", p.x, p.y, white)
+		}
+	}
+}
+
+func TestKeepOutsideMask(t *testing.T) {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	original := solidImage(red)
+	// The model returned the edit at double size
+	edited := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	draw.Draw(edited, edited.Bounds(), image.NewUniform(blue), image.Point{}, draw.Src)
+
+	rect := image.Rect(16, 12, 32, 24)
+	out := keepOutsideMask(original, edited, rect)
+	if out.Bounds() != original.Bounds() {
+		t.Fatalf("bounds %v, want %v", out.Bounds(), original.Bounds())
+	}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			want := red
+			if image.Pt(x, y).In(rect) {
+				want = blue
+			}
+			if got := color.RGBAModel.Convert(out.At(x, y)); got != want {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
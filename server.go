@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	// Uploads are at most 10 MB, even over a slow phone connection
+	readTimeout = 60 * time.Second
+	// Long enough for the slowest stage, composition, to finish: a
+	// character sheet, composeBudget of attempts and a consistency check
+	writeTimeout = 4 * time.Minute
+	idleTimeout  = 2 * time.Minute
+
+	// defaultDrainDelay is how long the instance keeps serving after SIGTERM
+	// while /readyz reports it as draining, so the load balancer stops
+	// sending it traffic before it stops accepting connections. Overridden
+	// by SHUTDOWN_DRAIN_DELAY in seconds.
+	defaultDrainDelay = 5 * time.Second
+
+	// defaultDrainTimeout is how long shutdown then waits for in-flight
+	// requests, overridden by SHUTDOWN_TIMEOUT in seconds. Keep the delay
+	// and the timeout together below the platform's grace period so the
+	// drain finishes before the process is killed.
+	defaultDrainTimeout = 20 * time.Second
+
+	// modelCheckTTL spaces out readiness calls to the model backend, which
+	// count against the API quota.
+	modelCheckTTL = time.Minute
+)
+
+// serve runs the HTTP server until SIGINT or SIGTERM, then stops taking new
+// requests and lets in-flight ones finish. Every pipeline stage saves its
+// output before responding, so a request cut off when the drain times out
+// loses only that stage; the client can retry it from the assets already
+// stored.
+func (app *App) serve(addr string, handler http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Requests get a context that outlives the signal, so Gemini calls
+	// already under way aren't cancelled as soon as the drain starts
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	return app.drain(srv, cancelRequests)
+}
+
+// drain fails readiness, keeps serving for the drain delay while the load
+// balancer notices, then shuts srv down and waits for in-flight requests
+// until the drain timeout, when the rest are cancelled.
+func (app *App) drain(srv *http.Server, cancelRequests context.CancelFunc) error {
+	app.draining.Store(true)
+	delay := envSeconds("SHUTDOWN_DRAIN_DELAY", defaultDrainDelay, 0)
+	timeout := envSeconds("SHUTDOWN_TIMEOUT", defaultDrainTimeout, 1)
+	slog.Info("Shutting down, failing readiness before draining", "delay", delay.String(), "timeout", timeout.String())
+	time.Sleep(delay)
+
+	slog.Info("Draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Drain timed out, cancelling remaining requests")
+		cancelRequests()
+		srv.Close()
+		return nil
+	}
+	return err
+}
+
+// envSeconds reads a whole number of seconds, at least min, from env, or
+// returns def when it is unset or invalid.
+func envSeconds(env string, def time.Duration, min int) time.Duration {
+	if s := os.Getenv(env); s != "" {
+		if secs, err := strconv.Atoi(s); err == nil && secs >= min {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid "+env, "value", s)
+	}
+	return def
+}
+
+// ReadyResponse reports the result of each readiness check.
+type ReadyResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthzHandler reports that the process is up. It checks nothing else, so
+// a slow dependency never gets the instance restarted.
+func (app *App) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether the instance should receive traffic: the
+// store and uploads directory work, the model backend answers, and it isn't
+// shutting down.
+func (app *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := ReadyResponse{Status: "ready", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			resp.Status = "unavailable"
+			resp.Checks[name] = err.Error()
+			return
+		}
+		resp.Checks[name] = "ok"
+	}
+
+	if app.draining.Load() {
+		check("shutdown", errors.New("draining"))
+	}
+	check("storage", app.checkStorage())
+	check("model", app.modelCheck.run(r.Context(), app.pingModel))
+
+	status := http.StatusOK
+	if resp.Status != "ready" {
+		status = http.StatusServiceUnavailable
+		slog.WarnContext(r.Context(), "Not ready", "checks", resp.Checks)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, resp)
+}
+
+func (app *App) checkStorage() error {
+	if err := app.store.Ping(); err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+	info, err := os.Stat("static/uploads")
+	if err == nil && !info.IsDir() {
+		err = errors.New("not a directory")
+	}
+	// The directory is created on first save, so missing is fine
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("uploads: %v", err)
+	}
+	return nil
+}
+
+// pingModel fetches the image model's metadata, which fails if the API key
+// or model name is wrong or the backend is down.
+func (app *App) pingModel(ctx context.Context) error {
+	if app.geminiClient == nil {
+		return errors.New("not configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := app.model(StageFigurine).Info(ctx)
+	return err
+}
+
+// cachedCheck remembers a check's success for modelCheckTTL. Failures are
+// retried on the next probe so the instance becomes ready again promptly.
+type cachedCheck struct {
+	mu     sync.Mutex
+	passed time.Time
+}
+
+func (c *cachedCheck) run(ctx context.Context, check func(context.Context) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.passed) < modelCheckTTL {
+		return nil
+	}
+	if err := check(ctx); err != nil {
+		return err
+	}
+	c.passed = time.Now()
+	return nil
+}
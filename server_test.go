@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainFailsReadinessBeforeShutdown(t *testing.T) {
+	app := testApp(t)
+	t.Setenv("SHUTDOWN_DRAIN_DELAY", "1")
+	t.Setenv("SHUTDOWN_TIMEOUT", "5")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", app.readyzHandler)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/readyz"
+
+	drained := make(chan error, 1)
+	go func() { drained <- app.drain(srv, func() {}) }()
+
+	// During the delay the instance still answers, but as draining.
+	time.Sleep(200 * time.Millisecond)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("server stopped serving during the drain delay: %v", err)
+	}
+	var ready ReadyResponse
+	json.NewDecoder(resp.Body).Decode(&ready)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || ready.Checks["shutdown"] != "draining" {
+		t.Errorf("readyz during drain: %d %v", resp.StatusCode, ready.Checks)
+	}
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain didn't finish")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("server still serving after the drain")
+	}
+}
+
+func TestEnvSeconds(t *testing.T) {
+	tests := []struct {
+		value string
+		min   int
+		want  time.Duration
+	}{
+		{"", 1, 7 * time.Second},
+		{"12", 1, 12 * time.Second},
+		{"0", 0, 0},
+		{"0", 1, 7 * time.Second},
+		{"-3", 0, 7 * time.Second},
+		{"soon", 0, 7 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_SECONDS", tt.value)
+		if got := envSeconds("TEST_SECONDS", 7*time.Second, tt.min); got != tt.want {
+			t.Errorf("envSeconds(%q, min %d) = %v, want %v", tt.value, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	var c cachedCheck
+	calls := 0
+	fail := true
+	check := func(context.Context) error {
+		calls++
+		if fail {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+	// Failures aren't cached; a pass is.
+	c.run(context.Background(), check)
+	fail = false
+	for range 3 {
+		if err := c.run(context.Background(), check); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("check ran %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "bv_session"
+	sessionMaxAge = 365 * 24 * time.Hour
+)
+
+type ctxKey int
+
+const (
+	sessionKey ctxKey = iota
+	requestIDKey
+	jobKey
+)
+
+// withSession makes sure every request carries a signed anonymous session
+// cookie and exposes the session ID to handlers through the context. Banned
+// sessions can still browse but can't generate or change anything.
+func (app *App) withSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := app.verifySessionCookie(r)
+		if !ok {
+			id = newID()
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    id + "." + app.signSession(id),
+				Path:     "/",
+				MaxAge:   int(sessionMaxAge / time.Second),
+				HttpOnly: true,
+				Secure:   isHTTPS(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		if ok && app.store.IsBanned(id) && (strings.HasPrefix(r.URL.Path, "/hx/") || strings.HasPrefix(r.URL.Path, "/api/")) {
+			slog.WarnContext(r.Context(), "Rejected request from banned session", "method", r.Method, "path", r.URL.Path)
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "This session has been blocked"})
+			} else {
+				http.Error(w, "This session has been blocked", http.StatusForbidden)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey, id)))
+	})
+}
+
+// sessionID returns the anonymous session that made the request, or "" when
+// there is none (for example from the CLI).
+func sessionID(ctx context.Context) string {
+	id, _ := ctx.Value(sessionKey).(string)
+	return id
+}
+
+func (app *App) signSession(id string) string {
+	mac := hmac.New(sha256.New, app.sessionSecret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (app *App) verifySessionCookie(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	id, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(app.signSession(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// isHTTPS reports whether the client connected over TLS, either directly or
+// through a proxy such as Railway's edge.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// ownedBy reports whether the request's session owns something recorded
+// with owner. Records from before sessions existed have no owner and belong
+// to nobody.
+func ownedBy(ctx context.Context, owner string) bool {
+	id := sessionID(ctx)
+	return id != "" && owner == id
+}
+
+// uploadsHandler serves generated images and exports to the session that
+// created them, and to anyone when they appear on a share page.
+func (app *App) uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	asset, err := app.assetFromURL(r.URL.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case app.store.IsPublic(asset.ID):
+		// Kept short so a revoked share stops serving soon after.
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	case ownedBy(r.Context(), asset.Owner):
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	http.ServeFile(rec, r, "static/uploads/"+asset.Filename)
+	switch rec.status {
+	case http.StatusNotModified:
+		uploadCache.WithLabelValues("hit").Inc()
+	case http.StatusOK, http.StatusPartialContent:
+		uploadCache.WithLabelValues("miss").Inc()
+	}
+}
+
+type CreationsResponse struct {
+	Assets  []*Asset `json:"assets"`
+	Comics  []*Comic `json:"comics"`
+	Success bool     `json:"success"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// apiCreationsHandler lists everything the session has made, newest first.
+func (app *App) apiCreationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := sessionID(r.Context())
+
+	assets, err := app.store.ListAssets(owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list assets", "err", err)
+		writeJSON(w, http.StatusInternalServerError, CreationsResponse{Error: "Failed to list creations"})
+		return
+	}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filtered := assets[:0]
+		for _, a := range assets {
+			if a.Kind == kind {
+				filtered = append(filtered, a)
+			}
+		}
+		assets = filtered
+	}
+
+	comics, err := app.store.ListComics(owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list comics", "err", err)
+		writeJSON(w, http.StatusInternalServerError, CreationsResponse{Error: "Failed to list creations"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, CreationsResponse{Assets: assets, Comics: comics, Success: true})
+}
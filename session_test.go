@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// asSession makes r come from the given session, as withSession would.
+func asSession(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey, id))
+}
+
+func TestWithSession(t *testing.T) {
+	app := testApp(t)
+	var seen string
+	handler := app.withSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = sessionID(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("got cookies %v, want one HttpOnly session cookie", cookies)
+	}
+	first := seen
+	if first == "" {
+		t.Fatal("no session in the request context")
+	}
+
+	// The signed cookie is accepted as is.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if seen != first || len(w.Result().Cookies()) != 0 {
+		t.Errorf("signed cookie not reused: session %q, cookies %v", seen, w.Result().Cookies())
+	}
+
+	// A forged one gets a new session instead of the one it names.
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "someone-else." + app.signSession(first)})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if seen == "someone-else" || seen == first || len(w.Result().Cookies()) != 1 {
+		t.Errorf("forged cookie accepted as session %q", seen)
+	}
+}
+
+func TestOwnedBy(t *testing.T) {
+	ctx := context.WithValue(context.Background(), sessionKey, "alice")
+	if !ownedBy(ctx, "alice") || ownedBy(ctx, "bob") || ownedBy(ctx, "") {
+		t.Error("ownedBy matched the wrong owner")
+	}
+	if ownedBy(context.Background(), "") {
+		t.Error("records without an owner belong to requests without a session")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultShareTitle = "A BananaVerse Adventure"
+
+type ShareRequest struct {
+	AssetID string `json:"assetId"`
+	ComicID string `json:"comicId"`
+	Title   string `json:"title"`
+	Caption string `json:"caption"`
+}
+
+// ShareView is a share plus its public permalink.
+type ShareView struct {
+	*Share
+	URL string `json:"url"`
+}
+
+type ShareResponse struct {
+	Share   *ShareView  `json:"share,omitempty"`
+	Shares  []ShareView `json:"shares,omitempty"`
+	Success bool        `json:"success"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// sharePage is what templates/share.html renders.
+type sharePage struct {
+	Title    string
+	Caption  string
+	PageURL  string
+	ImageURL string
+	Images   []string
+}
+
+// apiSharesHandler lists the session's shares (GET) or publishes a panel or
+// comic (POST).
+func (app *App) apiSharesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		shares, err := app.store.ListShares(sessionID(r.Context()))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to list shares", "err", err)
+			writeJSON(w, http.StatusInternalServerError, ShareResponse{Error: "Failed to list shares"})
+			return
+		}
+		views := make([]ShareView, 0, len(shares))
+		for _, sh := range shares {
+			views = append(views, ShareView{Share: sh, URL: absoluteURL(r, shareURL(sh))})
+		}
+		writeJSON(w, http.StatusOK, ShareResponse{Shares: views, Success: true})
+
+	case http.MethodPost:
+		app.createShare(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) createShare(w http.ResponseWriter, r *http.Request) {
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ShareResponse{Error: "Invalid JSON body"})
+		return
+	}
+	if (req.AssetID == "") == (req.ComicID == "") {
+		writeJSON(w, http.StatusBadRequest, ShareResponse{Error: "Exactly one of assetId or comicId required"})
+		return
+	}
+	if len(req.Title) > maxTitleLength {
+		writeJSON(w, http.StatusBadRequest, ShareResponse{Error: fmt.Sprintf("Title must be at most %d characters", maxTitleLength)})
+		return
+	}
+	if len(req.Caption) > maxCaptionLength {
+		writeJSON(w, http.StatusBadRequest, ShareResponse{Error: fmt.Sprintf("Caption must be at most %d characters", maxCaptionLength)})
+		return
+	}
+
+	ctx := r.Context()
+	share := &Share{
+		ID:      newID(),
+		Owner:   sessionID(ctx),
+		Title:   strings.TrimSpace(req.Title),
+		Caption: strings.TrimSpace(req.Caption),
+		Created: time.Now(),
+	}
+
+	if req.AssetID != "" {
+		asset, err := app.store.GetAsset(req.AssetID)
+		if err != nil || !ownedBy(ctx, asset.Owner) {
+			writeJSON(w, http.StatusNotFound, ShareResponse{Error: "Asset not found"})
+			return
+		}
+		if asset.Kind != AssetComposite && asset.Kind != AssetPanel {
+			writeJSON(w, http.StatusBadRequest, ShareResponse{Error: "Only finished panels can be shared"})
+			return
+		}
+		share.Kind, share.TargetID = ShareAsset, asset.ID
+		share.AssetIDs = []string{asset.ID}
+	} else {
+		comic, panels, err := app.storedComicPanels(ctx, req.ComicID)
+		if errors.Is(err, ErrNotFound) {
+			writeJSON(w, http.StatusNotFound, ShareResponse{Error: "Comic not found"})
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to load comic", "comic_id", req.ComicID, "err", err)
+			writeJSON(w, http.StatusInternalServerError, ShareResponse{Error: "Failed to load comic"})
+			return
+		}
+		if len(panels) == 0 {
+			writeJSON(w, http.StatusBadRequest, ShareResponse{Error: "Add some panels before sharing"})
+			return
+		}
+		pages, err := app.renderComicPages(ctx, panels, LayoutOptions{Layout: comic.Layout, Title: comic.Title})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to render comic for sharing", "comic_id", comic.ID, "err", err)
+			writeJSON(w, http.StatusInternalServerError, ShareResponse{Error: "Failed to render comic"})
+			return
+		}
+		share.Kind, share.TargetID = ShareComic, comic.ID
+		for _, p := range pages {
+			share.AssetIDs = append(share.AssetIDs, p.ID)
+		}
+		if share.Title == "" {
+			share.Title = comic.Title
+		}
+	}
+	if share.Title == "" {
+		share.Title = defaultShareTitle
+	}
+
+	if err := app.store.CreateShare(share); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create share", "err", err)
+		writeJSON(w, http.StatusInternalServerError, ShareResponse{Error: "Failed to create share"})
+		return
+	}
+	writeJSON(w, http.StatusCreated, ShareResponse{Share: &ShareView{Share: share, URL: absoluteURL(r, shareURL(share))}, Success: true})
+}
+
+// apiShareHandler revokes (DELETE) one of the session's shares.
+func (app *App) apiShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	share, err := app.store.GetShare(r.PathValue("id"))
+	if err != nil || !ownedBy(r.Context(), share.Owner) {
+		writeJSON(w, http.StatusNotFound, ShareResponse{Error: "Share not found"})
+		return
+	}
+	if err := app.store.DeleteShare(share.ID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke share", "share_id", share.ID, "err", err)
+		writeJSON(w, http.StatusInternalServerError, ShareResponse{Error: "Failed to revoke share"})
+		return
+	}
+	writeJSON(w, http.StatusOK, ShareResponse{Success: true})
+}
+
+// sharePageHandler renders the public permalink page for a share.
+func (app *App) sharePageHandler(w http.ResponseWriter, r *http.Request) {
+	share, err := app.store.GetShare(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := sharePage{
+		Title:   share.Title,
+		Caption: share.Caption,
+		PageURL: absoluteURL(r, shareURL(share)),
+	}
+	for _, id := range share.AssetIDs {
+		if a, err := app.store.GetAsset(id); err == nil {
+			page.Images = append(page.Images, a.URL())
+		}
+	}
+	if len(page.Images) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	page.ImageURL = absoluteURL(r, page.Images[0])
+
+	// Revoking has to take the page down, so don't let it be cached.
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := app.templates.ExecuteTemplate(w, "share.html", page); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Template error", "template", "share.html", "err", err)
+	}
+}
+
+func shareURL(s *Share) string {
+	return "/s/" + s.ID
+}
+
+// absoluteURL turns a path into a full URL on the host the request came in
+// on, as link previews need.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShareAndRevoke(t *testing.T) {
+	app := testApp(t)
+	panel := &Asset{ID: newID(), Kind: AssetPanel, Owner: "alice", Filename: "panel.png"}
+	figurine := &Asset{ID: newID(), Kind: AssetFigurine, Owner: "alice", Filename: "figurine.png"}
+	for _, a := range []*Asset{panel, figurine} {
+		if err := app.store.PutAsset(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	share := func(session, assetID string) *httptest.ResponseRecorder {
+		body := `{"assetId":"` + assetID + `","title":"Banana Quest","caption":"Off we go <3"}`
+		w := httptest.NewRecorder()
+		app.apiSharesHandler(w, asSession(httptest.NewRequest(http.MethodPost, "/api/shares", strings.NewReader(body)), session))
+		return w
+	}
+	if w := share("bob", panel.ID); w.Code != http.StatusNotFound {
+		t.Errorf("sharing someone else's panel: status %d", w.Code)
+	}
+	if w := share("alice", figurine.ID); w.Code != http.StatusBadRequest {
+		t.Errorf("sharing a figurine: status %d", w.Code)
+	}
+	w := share("alice", panel.ID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("sharing: status %d: %s", w.Code, w.Body)
+	}
+	var resp ShareResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Share.ID
+	if !app.store.IsPublic(panel.ID) || app.store.IsPublic(figurine.ID) {
+		t.Error("wrong assets made public")
+	}
+
+	page := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/s/"+id, nil)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		app.sharePageHandler(w, r)
+		return w
+	}
+	w = page()
+	if w.Code != http.StatusOK {
+		t.Fatalf("share page: status %d", w.Code)
+	}
+	for _, want := range []string{
+		`<meta property="og:title" content="Banana Quest">`,
+		`<meta property="og:description" content="Off we go &lt;3">`,
+		`<meta property="og:image" content="http://example.com/static/uploads/panel.png">`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("share page is missing %s", want)
+		}
+	}
+
+	revoke := func(session string) int {
+		r := asSession(httptest.NewRequest(http.MethodDelete, "/api/shares/"+id, nil), session)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		app.apiShareHandler(w, r)
+		return w.Code
+	}
+	if code := revoke("bob"); code != http.StatusNotFound {
+		t.Errorf("revoking someone else's share: status %d", code)
+	}
+	if code := revoke("alice"); code != http.StatusOK {
+		t.Fatalf("revoking: status %d", code)
+	}
+	if app.store.IsPublic(panel.ID) {
+		t.Error("panel still public after revoking")
+	}
+	if w := page(); w.Code != http.StatusNotFound {
+		t.Errorf("revoked share page: status %d", w.Code)
+	}
+}
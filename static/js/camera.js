@@ -119,6 +119,7 @@ function usePhoto() {
             // Create form data
             const formData = new FormData();
             formData.append('photo', blob, 'camera-capture.jpg');
+            formData.append('candidates', document.getElementById('figurine-candidates').value);
             
             // Show loading
             document.getElementById('loading-overlay').classList.remove('hidden');
@@ -126,11 +127,15 @@ function usePhoto() {
             // Send to server
             fetch('/hx/figurine', {
                 method: 'POST',
+                headers: { 'X-CSRF-Token': csrfToken() },
                 body: formData
             })
             .then(response => response.text())
             .then(html => {
-                document.getElementById('figurine-container').innerHTML = html;
+                const container = document.getElementById('figurine-container');
+                container.innerHTML = html;
+                // Wire up the edit form and version buttons
+                htmx.process(container);
                 stopCamera();
                 
                 // Hide camera interface
@@ -1,5 +1,7 @@
 // Export functionality for BananaVerse comics
+// comicPanels mirrors the panels of the saved comic project on the server
 let comicPanels = [];
+let currentComicId = localStorage.getItem('bananaverse.comicId');
 
 function downloadCurrentPanel() {
     const composedImage = document.querySelector('.composed-image');
@@ -121,34 +123,106 @@ function wrapText(ctx, text, maxWidth) {
     return lines;
 }
 
-function startComicCreation() {
-    const currentPanel = document.querySelector('.comic-panel');
-    if (!currentPanel) {
-        alert('Create a panel first!');
-        return;
+function comicRequest(url, method, body) {
+    return fetch(url, {
+        method: method,
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: body ? JSON.stringify(body) : undefined
+    })
+    .then(response => response.json().then(result => {
+        if (!response.ok || !result.success) {
+            const error = new Error(result.error || 'Request failed');
+            error.status = response.status;
+            throw error;
+        }
+        return result;
+    }));
+}
+
+function ensureComic() {
+    if (currentComicId) {
+        return Promise.resolve(currentComicId);
     }
     
-    // Clone the current panel and add to collection
-    const panelData = {
-        imageUrl: currentPanel.querySelector('.composed-image').src,
-        caption: currentPanel.querySelector('.caption').textContent,
-        timestamp: Date.now()
-    };
-    
-    comicPanels.push(panelData);
+    return comicRequest('/api/comics', 'POST', { title: 'BananaVerse Comic' })
+        .then(result => {
+            currentComicId = result.comic.id;
+            localStorage.setItem('bananaverse.comicId', currentComicId);
+            return currentComicId;
+        });
+}
+
+function applyComic(result) {
+    comicPanels = (result.panels || []).map(panel => ({
+        id: panel.id,
+        imageUrl: panel.imageUrl,
+        caption: panel.caption
+    }));
     
-    // Show comic builder
     const comicBuilder = document.getElementById('comic-builder');
-    comicBuilder.classList.remove('hidden');
-    
+    if (comicBuilder && comicPanels.length > 0) {
+        comicBuilder.classList.remove('hidden');
+    }
     updateComicBuilder();
+}
+
+function loadComic() {
+    if (!currentComicId) {
+        return;
+    }
     
-    // Scroll to comic builder
-    comicBuilder.scrollIntoView({ behavior: 'smooth', block: 'start' });
+    comicRequest(`/api/comics/${currentComicId}`, 'GET')
+        .then(applyComic)
+        .catch(error => {
+            if (error.status === 404) {
+                // The saved project is gone; start a fresh one next time
+                localStorage.removeItem('bananaverse.comicId');
+                currentComicId = null;
+                return;
+            }
+            console.error('Failed to load comic:', error);
+        });
+}
+
+function addToComic() {
+    const composedImage = document.querySelector('#composition-container .composed-image');
+    if (!composedImage) {
+        alert('Create a panel first!');
+        return;
+    }
+    
+    const figurineImage = document.querySelector('#figurine-container .figurine-image');
+    const sceneImage = document.querySelector('#scene-container .scene-image');
+    const captionInput = document.querySelector('#composition-container .panel-form input[name="caption"]');
+    
+    ensureComic()
+        .then(comicId => comicRequest(`/api/comics/${comicId}/panels`, 'POST', {
+            composedId: composedImage.dataset.assetId,
+            figurineId: figurineImage ? figurineImage.dataset.assetId : '',
+            sceneId: sceneImage ? sceneImage.dataset.assetId : '',
+            caption: captionInput ? captionInput.value : ''
+        }))
+        .then(result => {
+            applyComic(result);
+            document.getElementById('comic-builder').scrollIntoView({ behavior: 'smooth', block: 'start' });
+        })
+        .catch(error => {
+            console.error('Failed to add panel:', error);
+            alert('Failed to add panel: ' + error.message);
+        });
+}
+
+function startComicCreation() {
+    addToComic();
 }
 
 function updateComicBuilder() {
     const panelsContainer = document.getElementById('comic-panels');
+    if (!panelsContainer) {
+        return;
+    }
     panelsContainer.innerHTML = '';
     
     comicPanels.forEach((panel, index) => {
@@ -157,13 +231,20 @@ function updateComicBuilder() {
         panelElement.innerHTML = `
             <div class="panel-header">
                 <span>Panel ${index + 1}</span>
-                <button onclick="removePanel(${index})" class="remove-btn">❌</button>
+                <span>
+                    <button onclick="movePanel(${index}, -1)" class="remove-btn" title="Move earlier">⬅️</button>
+                    <button onclick="movePanel(${index}, 1)" class="remove-btn" title="Move later">➡️</button>
+                    <button onclick="editCaption(${index})" class="remove-btn" title="Edit caption">✏️</button>
+                    <button onclick="removePanel(${index})" class="remove-btn" title="Remove">❌</button>
+                </span>
             </div>
             <div class="mini-comic-panel">
-                <img src="${panel.imageUrl}" alt="Panel ${index + 1}">
-                <div class="mini-caption">${panel.caption}</div>
+                <img alt="Panel ${index + 1}">
+                <div class="mini-caption"></div>
             </div>
         `;
+        panelElement.querySelector('img').src = panel.imageUrl;
+        panelElement.querySelector('.mini-caption').textContent = panel.caption;
         panelsContainer.appendChild(panelElement);
     });
     
@@ -180,8 +261,35 @@ function updateComicBuilder() {
 }
 
 function removePanel(index) {
-    comicPanels.splice(index, 1);
-    updateComicBuilder();
+    const panel = comicPanels[index];
+    comicRequest(`/api/comics/${currentComicId}/panels/${panel.id}`, 'DELETE')
+        .then(applyComic)
+        .catch(error => alert('Failed to remove panel: ' + error.message));
+}
+
+function movePanel(index, delta) {
+    const target = index + delta;
+    if (target < 0 || target >= comicPanels.length) {
+        return;
+    }
+    
+    const ids = comicPanels.map(panel => panel.id);
+    [ids[index], ids[target]] = [ids[target], ids[index]];
+    comicRequest(`/api/comics/${currentComicId}/order`, 'PUT', { panelIds: ids })
+        .then(applyComic)
+        .catch(error => alert('Failed to reorder panels: ' + error.message));
+}
+
+function editCaption(index) {
+    const panel = comicPanels[index];
+    const caption = prompt('Panel caption:', panel.caption);
+    if (caption === null) {
+        return;
+    }
+    
+    comicRequest(`/api/comics/${currentComicId}/panels/${panel.id}`, 'PATCH', { caption: caption })
+        .then(applyComic)
+        .catch(error => alert('Failed to update caption: ' + error.message));
 }
 
 function addNewPanel() {
@@ -211,102 +319,129 @@ function resetWorkflow() {
     document.getElementById('upload-form').classList.add('hidden');
 }
 
-function exportComic() {
+function exportComic(layout = '', title = '') {
     if (comicPanels.length === 0) {
         alert('Add some panels first!');
         return;
     }
     
-    // Create canvas for comic strip
-    const canvas = document.createElement('canvas');
-    const ctx = canvas.getContext('2d');
-    
-    // Calculate dimensions
-    const panelWidth = 400;
-    const panelHeight = 300;
-    const cols = Math.min(comicPanels.length, 2); // Max 2 columns
-    const rows = Math.ceil(comicPanels.length / cols);
-    const gap = 20;
+    document.getElementById('loading-overlay').classList.remove('hidden');
     
-    canvas.width = cols * panelWidth + (cols + 1) * gap;
-    canvas.height = rows * panelHeight + (rows + 1) * gap;
+    // Pages are laid out and lettered on the server so every layout matches
+    fetch('/api/comic/pages', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            layout: layout,
+            title: title,
+            credits: 'Made with BananaVerse',
+            comicId: currentComicId
+        })
+    })
+    .then(response => response.json())
+    .then(result => {
+        if (!result.success) {
+            throw new Error(result.error || 'Export failed');
+        }
+        
+        result.pages.forEach((pageUrl, index) => {
+            const link = document.createElement('a');
+            link.download = `bananaverse-comic-${Date.now()}-page${index + 1}.png`;
+            link.href = pageUrl;
+            link.click();
+        });
+    })
+    .catch(error => {
+        console.error('Comic export failed:', error);
+        alert('Comic export failed: ' + error.message);
+    })
+    .finally(() => {
+        document.getElementById('loading-overlay').classList.add('hidden');
+    });
+}
+
+function exportComicBook(format, layout = '', title = '') {
+    if (comicPanels.length === 0) {
+        alert('Add some panels first!');
+        return;
+    }
     
-    // Fill background
-    ctx.fillStyle = '#f0f0f0';
-    ctx.fillRect(0, 0, canvas.width, canvas.height);
+    document.getElementById('loading-overlay').classList.remove('hidden');
     
-    // Draw title
-    ctx.fillStyle = '#333333';
-    ctx.font = 'bold 24px Arial, sans-serif';
-    ctx.textAlign = 'center';
-    ctx.fillText('🍌 BananaVerse Comic', canvas.width / 2, 30);
+    fetch('/api/comic/export', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            format: format,
+            layout: layout,
+            title: title,
+            credits: 'Made with BananaVerse',
+            comicId: currentComicId
+        })
+    })
+    .then(response => response.json())
+    .then(result => {
+        if (!result.success) {
+            throw new Error(result.error || 'Export failed');
+        }
+        
+        const link = document.createElement('a');
+        link.download = `bananaverse-comic-${Date.now()}.${format}`;
+        link.href = result.url;
+        link.click();
+    })
+    .catch(error => {
+        console.error('Comic book export failed:', error);
+        alert('Comic book export failed: ' + error.message);
+    })
+    .finally(() => {
+        document.getElementById('loading-overlay').classList.add('hidden');
+    });
+}
+
+function exportComicGIF(target = 'messaging', captionFade = true) {
+    if (comicPanels.length === 0) {
+        alert('Add some panels first!');
+        return;
+    }
     
-    let loadedImages = 0;
-    const totalImages = comicPanels.length;
+    document.getElementById('loading-overlay').classList.remove('hidden');
     
-    // Draw each panel
-    comicPanels.forEach((panel, index) => {
-        const img = new Image();
-        img.crossOrigin = 'anonymous';
-        
-        img.onload = function() {
-            const col = index % cols;
-            const row = Math.floor(index / cols);
-            
-            const x = gap + col * (panelWidth + gap);
-            const y = gap + 50 + row * (panelHeight + gap); // 50px for title
-            
-            // Draw panel border
-            ctx.strokeStyle = '#333333';
-            ctx.lineWidth = 4;
-            ctx.strokeRect(x, y, panelWidth, panelHeight);
-            
-            // Draw panel background
-            ctx.fillStyle = '#ffffff';
-            ctx.fillRect(x + 2, y + 2, panelWidth - 4, panelHeight - 4);
-            
-            // Draw image
-            const imgPadding = 10;
-            const captionSpace = 40;
-            const availableHeight = panelHeight - imgPadding * 2 - captionSpace;
-            const availableWidth = panelWidth - imgPadding * 2;
-            
-            const scale = Math.min(availableWidth / img.width, availableHeight / img.height);
-            const scaledWidth = img.width * scale;
-            const scaledHeight = img.height * scale;
-            
-            const imgX = x + (panelWidth - scaledWidth) / 2;
-            const imgY = y + imgPadding;
-            
-            ctx.drawImage(img, imgX, imgY, scaledWidth, scaledHeight);
-            
-            // Draw caption
-            const captionY = y + panelHeight - captionSpace + 5;
-            ctx.fillStyle = 'rgba(255, 255, 255, 0.9)';
-            ctx.fillRect(x + 10, captionY, panelWidth - 20, 30);
-            
-            ctx.strokeStyle = '#333333';
-            ctx.lineWidth = 2;
-            ctx.strokeRect(x + 10, captionY, panelWidth - 20, 30);
-            
-            ctx.fillStyle = '#333333';
-            ctx.font = '14px Arial, sans-serif';
-            ctx.textAlign = 'center';
-            ctx.textBaseline = 'middle';
-            ctx.fillText(panel.caption, x + panelWidth / 2, captionY + 15);
-            
-            loadedImages++;
-            
-            // When all images are loaded, download the comic
-            if (loadedImages === totalImages) {
-                const link = document.createElement('a');
-                link.download = `bananaverse-comic-${Date.now()}.png`;
-                link.href = canvas.toDataURL();
-                link.click();
-            }
-        };
+    fetch('/api/comic/gif', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            target: target,
+            captionFade: captionFade,
+            comicId: currentComicId
+        })
+    })
+    .then(response => response.json())
+    .then(result => {
+        if (!result.success) {
+            throw new Error(result.error || 'Export failed');
+        }
+        if (!result.withinTarget) {
+            console.warn('GIF is larger than the ' + target + ' size target:', result.bytes);
+        }
         
-        img.src = panel.imageUrl;
+        const link = document.createElement('a');
+        link.download = `bananaverse-comic-${Date.now()}.gif`;
+        link.href = result.url;
+        link.click();
+    })
+    .catch(error => {
+        console.error('GIF export failed:', error);
+        alert('GIF export failed: ' + error.message);
+    })
+    .finally(() => {
+        document.getElementById('loading-overlay').classList.add('hidden');
     });
 }
 
@@ -397,4 +532,7 @@ const comicBuilderStyles = `
 </style>`;
 
 // Inject styles
-document.head.insertAdjacentHTML('beforeend', comicBuilderStyles);
\ No newline at end of file
+document.head.insertAdjacentHTML('beforeend', comicBuilderStyles);
+
+// Restore the saved comic project after a reload
+document.addEventListener('DOMContentLoaded', loadComic);
\ No newline at end of file
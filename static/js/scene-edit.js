@@ -0,0 +1,62 @@
+// Scene edits: drag across a scene to limit an edit to that area
+
+let maskDrag = null;
+
+function maskInputs(area) {
+    return area.closest('.result-panel').querySelector('.scene-edit');
+}
+
+function setSceneMask(area, x, y, w, h) {
+    const rect = area.querySelector('.mask-rect');
+    const form = maskInputs(area);
+    rect.style.left = x + '%';
+    rect.style.top = y + '%';
+    rect.style.width = w + '%';
+    rect.style.height = h + '%';
+    rect.classList.remove('hidden');
+    form.maskX.value = x.toFixed(2);
+    form.maskY.value = y.toFixed(2);
+    form.maskW.value = w.toFixed(2);
+    form.maskH.value = h.toFixed(2);
+}
+
+function clearSceneMask(button) {
+    const panel = button.closest('.result-panel');
+    const form = panel.querySelector('.scene-edit');
+    panel.querySelector('.mask-rect').classList.add('hidden');
+    ['maskX', 'maskY', 'maskW', 'maskH'].forEach(name => form[name].value = '');
+}
+
+function maskPoint(area, evt) {
+    const bounds = area.getBoundingClientRect();
+    const clamp = v => Math.min(100, Math.max(0, v));
+    return {
+        x: clamp((evt.clientX - bounds.left) / bounds.width * 100),
+        y: clamp((evt.clientY - bounds.top) / bounds.height * 100)
+    };
+}
+
+document.addEventListener('pointerdown', evt => {
+    const area = evt.target.closest('.scene-mask-area');
+    if (!area) return;
+    evt.preventDefault();
+    area.setPointerCapture(evt.pointerId);
+    maskDrag = { area: area, start: maskPoint(area, evt) };
+});
+
+document.addEventListener('pointermove', evt => {
+    if (!maskDrag) return;
+    const p = maskPoint(maskDrag.area, evt);
+    const s = maskDrag.start;
+    setSceneMask(maskDrag.area, Math.min(s.x, p.x), Math.min(s.y, p.y), Math.abs(p.x - s.x), Math.abs(p.y - s.y));
+});
+
+document.addEventListener('pointerup', evt => {
+    if (!maskDrag) return;
+    const form = maskInputs(maskDrag.area);
+    // A click without a drag clears the area rather than leaving a sliver
+    if (parseFloat(form.maskW.value || 0) < 1 || parseFloat(form.maskH.value || 0) < 1) {
+        clearSceneMask(maskDrag.area);
+    }
+    maskDrag = null;
+});
@@ -0,0 +1,78 @@
+// Public permalinks for finished panels and comics
+
+function shareAsset(button, assetId) {
+    const captionInput = document.querySelector('#composition-container .panel-form input[name="caption"]');
+    createShare({
+        assetId: assetId,
+        caption: captionInput ? captionInput.value : ''
+    }, button.parentElement);
+}
+
+function shareComic(button) {
+    if (!currentComicId || comicPanels.length === 0) {
+        alert('Add some panels first!');
+        return;
+    }
+    createShare({ comicId: currentComicId }, button.parentElement);
+}
+
+function createShare(body, container) {
+    document.getElementById('loading-overlay').classList.remove('hidden');
+    
+    comicRequest('/api/shares', 'POST', body)
+        .then(result => showShare(result.share, container))
+        .catch(error => {
+            console.error('Sharing failed:', error);
+            alert('Sharing failed: ' + error.message);
+        })
+        .finally(() => {
+            document.getElementById('loading-overlay').classList.add('hidden');
+        });
+}
+
+function showShare(share, container) {
+    const shareElement = document.createElement('div');
+    shareElement.className = 'share-result';
+    shareElement.innerHTML = `
+        <input type="text" readonly>
+        <button class="btn-secondary copy-btn">📋 Copy Link</button>
+        <button class="btn-secondary gallery-btn">🌟 Submit to Gallery</button>
+        <button class="btn-secondary revoke-btn">🚫 Revoke</button>
+    `;
+    
+    const input = shareElement.querySelector('input');
+    input.value = share.url;
+    shareElement.querySelector('.copy-btn').onclick = () => {
+        input.select();
+        navigator.clipboard.writeText(share.url).catch(() => document.execCommand('copy'));
+    };
+    shareElement.querySelector('.gallery-btn').onclick = event => submitToGallery(share.id, event.target);
+    shareElement.querySelector('.revoke-btn').onclick = () => revokeShare(share.id, shareElement);
+    
+    container.appendChild(shareElement);
+}
+
+function revokeShare(shareId, shareElement) {
+    if (!confirm('Take this page down? Anyone with the link will no longer see it.')) {
+        return;
+    }
+    
+    comicRequest(`/api/shares/${shareId}`, 'DELETE')
+        .then(() => shareElement.remove())
+        .catch(error => {
+            console.error('Failed to revoke share:', error);
+            alert('Failed to revoke share: ' + error.message);
+        });
+}
+
+function submitToGallery(shareId, button) {
+    comicRequest('/api/gallery', 'POST', { shareId: shareId })
+        .then(() => {
+            button.disabled = true;
+            button.textContent = '⏳ Awaiting review';
+        })
+        .catch(error => {
+            console.error('Gallery submission failed:', error);
+            alert('Gallery submission failed: ' + error.message);
+        });
+}
@@ -0,0 +1,99 @@
+// Story mode: plan and generate a whole comic from one premise
+
+const storyPollInterval = 3000;
+
+const beatLabels = {
+    pending: '⏳ Waiting',
+    composing: '🎨 Placing your figurine',
+    done: '✅ Done',
+    failed: '❌ Failed'
+};
+
+function startStory() {
+    const figurineImage = document.querySelector('#figurine-container .figurine-image');
+    if (!figurineImage) {
+        alert('Create your figurine first!');
+        return;
+    }
+    const premise = document.getElementById('story-premise').value.trim();
+    if (!premise) {
+        alert('Describe your adventure in one line first!');
+        return;
+    }
+
+    const button = document.getElementById('story-btn');
+    button.disabled = true;
+    comicRequest('/api/stories', 'POST', {
+        figurineId: figurineImage.dataset.assetId,
+        premise: premise,
+        beats: parseInt(document.getElementById('story-beats').value, 10)
+    })
+        .then(result => pollStory(result))
+        .catch(error => {
+            console.error('Failed to start story:', error);
+            alert('Failed to start story: ' + error.message);
+            button.disabled = false;
+        });
+}
+
+function pollStory(result) {
+    renderStory(result);
+    const story = result.story;
+    if (story.status === 'done' || story.status === 'failed') {
+        document.getElementById('story-btn').disabled = false;
+        if (story.comicId) {
+            // The story's comic becomes the one being edited
+            currentComicId = story.comicId;
+            localStorage.setItem('bananaverse.comicId', currentComicId);
+            loadComic();
+        }
+        return;
+    }
+    setTimeout(() => {
+        comicRequest(`/api/stories/${story.id}`, 'GET')
+            .then(pollStory)
+            .catch(error => {
+                console.error('Failed to check story progress:', error);
+                document.getElementById('story-btn').disabled = false;
+            });
+    }, storyPollInterval);
+}
+
+function renderStory(result) {
+    const story = result.story;
+    const container = document.getElementById('story-progress');
+    container.innerHTML = '';
+
+    const status = document.createElement('p');
+    status.className = 'instruction';
+    if (story.status === 'planning') {
+        status.textContent = '📝 Planning your story...';
+    } else if (story.status === 'failed') {
+        status.textContent = '❌ ' + (story.error || 'The story could not be generated');
+    } else {
+        status.textContent = `${story.title}: ${result.completed} of ${result.total} panels`;
+    }
+    container.appendChild(status);
+
+    (story.beats || []).forEach((beat, index) => {
+        const item = document.createElement('div');
+        item.className = 'story-beat ' + beat.status;
+        if (beat.imageUrl) {
+            const img = document.createElement('img');
+            img.src = beat.imageUrl;
+            img.alt = beat.caption;
+            item.appendChild(img);
+        }
+        const label = document.createElement('p');
+        label.textContent = `Panel ${index + 1}: ${beatLabels[beat.status] || beat.status}`;
+        if (beat.status === 'pending' && index === result.completed) {
+            label.textContent = `Panel ${index + 1}: 🎬 Generating the scene`;
+        }
+        item.appendChild(label);
+        const caption = document.createElement('p');
+        caption.className = 'caption';
+        caption.textContent = beat.error || beat.caption;
+        item.appendChild(caption);
+        container.appendChild(item);
+    });
+}
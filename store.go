@@ -0,0 +1,1307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Asset kinds recorded in the asset index.
+const (
+	AssetFigurine  = "figurine"
+	AssetScene     = "scene"
+	AssetComposite = "composite"
+	AssetPanel     = "panel"
+	AssetPage      = "page"
+	AssetComicBook = "comicbook"
+	AssetAnimation = "animation"
+	AssetCharacter = "character"
+)
+
+var (
+	bucketAssets = []byte("assets")
+	bucketComics = []byte("comics")
+	bucketPanels = []byte("panels")
+	// bucketOwners indexes what each session owns, keyed
+	// "<owner>/<asset|comic|share>/<id>".
+	bucketOwners = []byte("owners")
+	bucketMeta   = []byte("meta")
+	bucketShares = []byte("shares")
+	// bucketPublic marks assets shown on a share page, keyed
+	// "<assetID>/<shareID>".
+	bucketPublic = []byte("public")
+	// bucketGallery holds gallery submissions keyed by share ID, so a share
+	// can be submitted once.
+	bucketGallery = []byte("gallery")
+	// bucketPolicyLog records prompt policy decisions keyed by time.
+	bucketPolicyLog = []byte("policy_log")
+	// bucketJobs records pipeline runs keyed by job ID, which starts with
+	// the zero-padded start time so the bucket is in time order.
+	bucketJobs = []byte("jobs")
+	// bucketBans holds banned sessions keyed by session ID.
+	bucketBans = []byte("bans")
+	// bucketStories holds story mode runs keyed by story ID.
+	bucketStories = []byte("stories")
+	// bucketCandidates holds candidate batches keyed by batch ID.
+	bucketCandidates = []byte("candidates")
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrBadOrder = errors.New("panel order must list every panel of the comic exactly once")
+	ErrExists   = errors.New("already exists")
+	ErrBadAsset = errors.New("invalid asset reference")
+)
+
+// Asset is a generated file in static/uploads along with what produced it.
+type Asset struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Owner    string    `json:"owner,omitempty"`
+	Filename string    `json:"filename"`
+	Created  time.Time `json:"created"`
+	Theme    string    `json:"theme,omitempty"`
+	Lighting string    `json:"lighting,omitempty"`
+	Prompt   string    `json:"prompt,omitempty"`
+	// Trace is the span that created the asset, as "<trace ID>-<span ID>".
+	Trace string `json:"trace,omitempty"`
+	// Pinned assets are kept however old they get.
+	Pinned bool `json:"pinned,omitempty"`
+	// ParentID is the asset this one was derived from, such as the
+	// figurine a character sheet shows or the image an edit changed.
+	ParentID string `json:"parentId,omitempty"`
+	// Instruction is the edit that turned the parent into this asset.
+	Instruction string `json:"instruction,omitempty"`
+	// RootID and Version number a figurine's revisions: RootID is the
+	// figurine first made from the photo, version 1. PutAsset numbers a
+	// revision saved without a Version.
+	RootID  string `json:"rootId,omitempty"`
+	Version int    `json:"version,omitempty"`
+	// Consistency scores, from 0 to 100, how closely the figurine in a
+	// composite matches its character sheet. It is nil when unchecked.
+	Consistency *int `json:"consistency,omitempty"`
+	// Verification scores, from 0 to 100, how well a composite shows the
+	// figurine at a believable scale and in the scene's lighting, and
+	// Attempts is how many compositions it took. Verification is nil when
+	// unchecked.
+	Verification *int `json:"verification,omitempty"`
+	Attempts     int  `json:"attempts,omitempty"`
+	// BatchID is the candidate batch the asset was generated in, when the
+	// user was given a choice. Candidate marks one that hasn't been chosen
+	// (yet); those are only kept briefly.
+	BatchID   string `json:"batchId,omitempty"`
+	Candidate bool   `json:"candidate,omitempty"`
+}
+
+// URL is where the asset is served from.
+func (a *Asset) URL() string {
+	return "/static/uploads/" + a.Filename
+}
+
+// Comic is a saved comic project.
+type Comic struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner,omitempty"`
+	Title   string    `json:"title"`
+	Layout  string    `json:"layout"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Panel is one panel of a comic and the assets it was built from.
+type Panel struct {
+	ID         string    `json:"id"`
+	ComicID    string    `json:"comicId"`
+	Order      int       `json:"order"`
+	Caption    string    `json:"caption"`
+	FigurineID string    `json:"figurineId,omitempty"`
+	SceneID    string    `json:"sceneId,omitempty"`
+	ComposedID string    `json:"composedId"`
+	Created    time.Time `json:"created"`
+}
+
+// Share kinds.
+const (
+	ShareAsset = "asset"
+	ShareComic = "comic"
+)
+
+// Share is a public permalink to a finished panel or comic. AssetIDs are the
+// images the page shows; for a comic they are pages rendered when it was
+// shared, so later edits don't change what was published.
+type Share struct {
+	ID       string    `json:"id"`
+	Owner    string    `json:"owner,omitempty"`
+	Kind     string    `json:"kind"`
+	TargetID string    `json:"targetId"`
+	Title    string    `json:"title"`
+	Caption  string    `json:"caption"`
+	AssetIDs []string  `json:"assetIds"`
+	Created  time.Time `json:"created"`
+}
+
+// Gallery moderation states.
+const (
+	GalleryPending  = "pending"
+	GalleryApproved = "approved"
+	GalleryRejected = "rejected"
+)
+
+// Story states. A story is planned, then its beats are generated one by one.
+const (
+	StoryPlanning = "planning"
+	StoryRunning  = "running"
+	StoryDone     = "done"
+	StoryFailed   = "failed"
+)
+
+// Beat states, in the order a beat goes through them.
+const (
+	BeatPending   = "pending"
+	BeatComposing = "composing"
+	BeatDone      = "done"
+	BeatFailed    = "failed"
+)
+
+// Story is a comic generated from a premise: the planned beats and how far
+// each has got.
+type Story struct {
+	ID         string      `json:"id"`
+	Owner      string      `json:"owner,omitempty"`
+	Premise    string      `json:"premise"`
+	FigurineID string      `json:"figurineId"`
+	BeatCount  int         `json:"beatCount"`
+	Status     string      `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	Title      string      `json:"title,omitempty"`
+	ComicID    string      `json:"comicId,omitempty"`
+	Beats      []StoryBeat `json:"beats"`
+	Created    time.Time   `json:"created"`
+	Updated    time.Time   `json:"updated"`
+}
+
+// StoryBeat is one planned panel of a story.
+type StoryBeat struct {
+	Theme      string `json:"theme"`
+	Lighting   string `json:"lighting"`
+	Prompt     string `json:"prompt"`
+	Caption    string `json:"caption"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	SceneID    string `json:"sceneId,omitempty"`
+	ComposedID string `json:"composedId,omitempty"`
+	PanelID    string `json:"panelId,omitempty"`
+	ImageURL   string `json:"imageUrl,omitempty"`
+}
+
+// CandidateBatch is a set of images generated from one request for the user
+// to choose from. Which one they chose is kept with the input, to learn
+// which prompts work.
+type CandidateBatch struct {
+	ID       string            `json:"id"`
+	Owner    string            `json:"owner,omitempty"`
+	Stage    string            `json:"stage"`
+	Input    map[string]string `json:"input,omitempty"`
+	AssetIDs []string          `json:"assetIds"`
+	// ChosenID is the candidate the user picked, empty until they do.
+	ChosenID string    `json:"chosenId,omitempty"`
+	Created  time.Time `json:"created"`
+	Chosen   time.Time `json:"chosen,omitempty"`
+}
+
+// GalleryEntry is a share submitted to the public gallery. Theme and
+// Lighting come from the scene the artwork was made from.
+type GalleryEntry struct {
+	ShareID   string    `json:"shareId"`
+	Owner     string    `json:"owner,omitempty"`
+	Status    string    `json:"status"`
+	Title     string    `json:"title"`
+	Caption   string    `json:"caption"`
+	Theme     string    `json:"theme,omitempty"`
+	Lighting  string    `json:"lighting,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	Reviewed  time.Time `json:"reviewed"`
+}
+
+// PolicyDecision records one prompt policy check for later review.
+type PolicyDecision struct {
+	Time    time.Time         `json:"time"`
+	Session string            `json:"session,omitempty"`
+	Source  string            `json:"source"`
+	Stage   string            `json:"stage"`
+	Allowed bool              `json:"allowed"`
+	Field   string            `json:"field,omitempty"`
+	Rule    string            `json:"rule,omitempty"`
+	Input   map[string]string `json:"input"`
+}
+
+// Job records one run of a pipeline step, such as generating a scene, and
+// the model calls it made.
+type Job struct {
+	ID      string            `json:"id"`
+	Kind    string            `json:"kind"`
+	Session string            `json:"session,omitempty"`
+	Input   map[string]string `json:"input,omitempty"`
+	RetryOf string            `json:"retryOf,omitempty"`
+	Started time.Time         `json:"started"`
+	// Duration is rounded to the millisecond.
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	AssetID  string        `json:"assetId,omitempty"`
+	Stages   []JobStage    `json:"stages"`
+
+	// mu guards AssetID and Stages while candidates are generated at once.
+	mu sync.Mutex
+}
+
+// JobStage is one model call made by a job.
+type JobStage struct {
+	Stage        string        `json:"stage"`
+	Model        string        `json:"model"`
+	Duration     time.Duration `json:"duration"`
+	Outcome      string        `json:"outcome"`
+	Error        string        `json:"error,omitempty"`
+	InputTokens  int32         `json:"inputTokens"`
+	OutputTokens int32         `json:"outputTokens"`
+}
+
+// Ban blocks a session from generating or changing anything.
+type Ban struct {
+	Session string    `json:"session"`
+	Created time.Time `json:"created"`
+}
+
+// Store persists assets and comic projects in an embedded bbolt database.
+type Store struct {
+	db *bolt.DB
+}
+
+func openStore(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketAssets, bucketComics, bucketPanels, bucketOwners, bucketMeta, bucketShares, bucketPublic, bucketGallery, bucketPolicyLog, bucketJobs, bucketBans, bucketStories, bucketCandidates} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Size returns the size of the database file in bytes.
+func (s *Store) Size() int64 {
+	var size int64
+	s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size
+}
+
+// Ping checks that the database can be read.
+func (s *Store) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketMeta) == nil {
+			return errors.New("meta bucket missing")
+		}
+		return nil
+	})
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func getJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func ownerKey(owner, kind, id string) []byte {
+	return []byte(owner + "/" + kind + "/" + id)
+}
+
+// ownedIDs lists the IDs of everything of kind ("asset" or "comic") that
+// owner has created.
+func ownedIDs(tx *bolt.Tx, owner, kind string) []string {
+	var ids []string
+	prefix := []byte(owner + "/" + kind + "/")
+	c := tx.Bucket(bucketOwners).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ids = append(ids, string(k[len(prefix):]))
+	}
+	return ids
+}
+
+// PutAsset saves an asset. A revision with a RootID but no Version gets the
+// version after its lineage's latest, in the same transaction, so edits
+// saved at the same time never share a number.
+func (s *Store) PutAsset(a *Asset) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if a.RootID != "" && a.Version == 0 {
+			latest, err := latestVersion(tx, a.Owner, a.RootID)
+			if err != nil {
+				return err
+			}
+			a.Version = latest + 1
+		}
+		if a.Owner != "" {
+			if err := tx.Bucket(bucketOwners).Put(ownerKey(a.Owner, "asset", a.ID), nil); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx.Bucket(bucketAssets), a.ID, a)
+	})
+}
+
+// latestVersion returns the highest version among the owner's revisions of
+// root, counting root itself as version 1.
+func latestVersion(tx *bolt.Tx, owner, root string) (int, error) {
+	b := tx.Bucket(bucketAssets)
+	latest := 1
+	for _, id := range ownedIDs(tx, owner, "asset") {
+		var a Asset
+		if err := getJSON(b, id, &a); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if a.ID == root || a.RootID == root {
+			latest = max(latest, a.Version)
+		}
+	}
+	return latest, nil
+}
+
+// ListAssets returns the assets owned by a session, newest first.
+func (s *Store) ListAssets(owner string) ([]*Asset, error) {
+	var assets []*Asset
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAssets)
+		for _, id := range ownedIDs(tx, owner, "asset") {
+			var a Asset
+			if err := getJSON(b, id, &a); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			assets = append(assets, &a)
+		}
+		return nil
+	})
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Created.After(assets[j].Created) })
+	return assets, err
+}
+
+func (s *Store) GetAsset(id string) (*Asset, error) {
+	var a Asset
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketAssets), id, &a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// PinAsset pins or unpins an asset.
+func (s *Store) PinAsset(id string, pinned bool) (*Asset, error) {
+	var a Asset
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAssets)
+		if err := getJSON(b, id, &a); err != nil {
+			return err
+		}
+		a.Pinned = pinned
+		return putJSON(b, id, &a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// assetRefs counts the comic panels and share pages that use each asset.
+func assetRefs(tx *bolt.Tx) (map[string]int, error) {
+	refs := make(map[string]int)
+	err := tx.Bucket(bucketPanels).ForEach(func(k, v []byte) error {
+		var p Panel
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		for _, id := range []string{p.FigurineID, p.SceneID, p.ComposedID} {
+			if id != "" {
+				refs[id]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Bucket(bucketPublic).ForEach(func(k, v []byte) error {
+		assetID, _, _ := bytes.Cut(k, []byte("/"))
+		refs[string(assetID)]++
+		return nil
+	})
+	return refs, err
+}
+
+// unreferencedAssets returns the unpinned assets that no panel or share uses
+// and for which expired returns true. Character sheets are also kept as long
+// as their figurine is, so later panels match earlier ones.
+func unreferencedAssets(tx *bolt.Tx, expired func(*Asset) bool) ([]*Asset, error) {
+	refs, err := assetRefs(tx)
+	if err != nil {
+		return nil, err
+	}
+	b := tx.Bucket(bucketAssets)
+	var assets []*Asset
+	err = b.ForEach(func(k, v []byte) error {
+		var a Asset
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		if a.Kind == AssetCharacter && b.Get([]byte(a.ParentID)) != nil {
+			return nil
+		}
+		if !a.Pinned && refs[a.ID] == 0 && expired(&a) {
+			assets = append(assets, &a)
+		}
+		return nil
+	})
+	return assets, err
+}
+
+// ExpiredAssets lists the assets DeleteExpiredAssets would delete.
+func (s *Store) ExpiredAssets(expired func(*Asset) bool) ([]*Asset, error) {
+	var assets []*Asset
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		assets, err = unreferencedAssets(tx, expired)
+		return err
+	})
+	return assets, err
+}
+
+// DeleteExpiredAssets removes the unpinned assets that no panel or share
+// uses and for which expired returns true, and returns them so the caller
+// can delete the files. References are counted in the same transaction, so
+// an asset added to a comic or share meanwhile is never deleted.
+func (s *Store) DeleteExpiredAssets(expired func(*Asset) bool) ([]*Asset, error) {
+	var assets []*Asset
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		assets, err = unreferencedAssets(tx, expired)
+		if err != nil {
+			return err
+		}
+		for _, a := range assets {
+			if a.Owner != "" {
+				if err := tx.Bucket(bucketOwners).Delete(ownerKey(a.Owner, "asset", a.ID)); err != nil {
+					return err
+				}
+			}
+			if err := tx.Bucket(bucketAssets).Delete([]byte(a.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return assets, nil
+}
+
+func (s *Store) CreateComic(c *Comic) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if c.Owner != "" {
+			if err := tx.Bucket(bucketOwners).Put(ownerKey(c.Owner, "comic", c.ID), nil); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx.Bucket(bucketComics), c.ID, c)
+	})
+}
+
+func (s *Store) GetComic(id string) (*Comic, error) {
+	var c Comic
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketComics), id, &c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Store) UpdateComic(c *Comic) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketComics)
+		if b.Get([]byte(c.ID)) == nil {
+			return ErrNotFound
+		}
+		return putJSON(b, c.ID, c)
+	})
+}
+
+// DeleteComic removes a comic and all of its panels. The underlying assets
+// are left in place.
+func (s *Store) DeleteComic(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		comics := tx.Bucket(bucketComics)
+		var comic Comic
+		if err := getJSON(comics, id, &comic); err != nil {
+			return err
+		}
+		if err := comics.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if comic.Owner != "" {
+			if err := tx.Bucket(bucketOwners).Delete(ownerKey(comic.Owner, "comic", id)); err != nil {
+				return err
+			}
+		}
+
+		panels := tx.Bucket(bucketPanels)
+		var keys [][]byte
+		prefix := panelPrefix(id)
+		c := panels.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := panels.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListComics returns the comics owned by a session, most recently updated
+// first.
+func (s *Store) ListComics(owner string) ([]*Comic, error) {
+	var comics []*Comic
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketComics)
+		for _, id := range ownedIDs(tx, owner, "comic") {
+			var c Comic
+			if err := getJSON(b, id, &c); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			comics = append(comics, &c)
+		}
+		return nil
+	})
+	sort.Slice(comics, func(i, j int) bool { return comics[i].Updated.After(comics[j].Updated) })
+	return comics, err
+}
+
+// Panels are keyed "<comicID>/<panelID>" so a comic's panels can be read
+// with a single prefix scan.
+func panelPrefix(comicID string) []byte {
+	return []byte(comicID + "/")
+}
+
+func panelKey(comicID, panelID string) string {
+	return comicID + "/" + panelID
+}
+
+func readPanels(tx *bolt.Tx, comicID string) ([]*Panel, error) {
+	var panels []*Panel
+	prefix := panelPrefix(comicID)
+	c := tx.Bucket(bucketPanels).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var p Panel
+		if err := json.Unmarshal(v, &p); err != nil {
+			return nil, err
+		}
+		panels = append(panels, &p)
+	}
+	sort.Slice(panels, func(i, j int) bool { return panels[i].Order < panels[j].Order })
+	return panels, nil
+}
+
+// touchComic bumps a comic's Updated time inside an open transaction.
+func touchComic(tx *bolt.Tx, comicID string) error {
+	b := tx.Bucket(bucketComics)
+	var c Comic
+	if err := getJSON(b, comicID, &c); err != nil {
+		return err
+	}
+	c.Updated = time.Now()
+	return putJSON(b, comicID, &c)
+}
+
+// Panels returns a comic's panels in reading order.
+func (s *Store) Panels(comicID string) ([]*Panel, error) {
+	var panels []*Panel
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		panels, err = readPanels(tx, comicID)
+		return err
+	})
+	return panels, err
+}
+
+// AddPanel appends p to the end of its comic.
+func (s *Store) AddPanel(p *Panel) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketComics).Get([]byte(p.ComicID)) == nil {
+			return ErrNotFound
+		}
+		existing, err := readPanels(tx, p.ComicID)
+		if err != nil {
+			return err
+		}
+		p.Order = len(existing)
+		if err := putJSON(tx.Bucket(bucketPanels), panelKey(p.ComicID, p.ID), p); err != nil {
+			return err
+		}
+		return touchComic(tx, p.ComicID)
+	})
+}
+
+func (s *Store) GetPanel(comicID, panelID string) (*Panel, error) {
+	var p Panel
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketPanels), panelKey(comicID, panelID), &p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *Store) UpdatePanel(p *Panel) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketPanels)
+		key := panelKey(p.ComicID, p.ID)
+		if b.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		if err := putJSON(b, key, p); err != nil {
+			return err
+		}
+		return touchComic(tx, p.ComicID)
+	})
+}
+
+// DeletePanel removes a panel and closes the gap it leaves in the ordering.
+func (s *Store) DeletePanel(comicID, panelID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deletePanel(tx, comicID, panelID)
+	})
+}
+
+func deletePanel(tx *bolt.Tx, comicID, panelID string) error {
+	b := tx.Bucket(bucketPanels)
+	key := []byte(panelKey(comicID, panelID))
+	if b.Get(key) == nil {
+		return ErrNotFound
+	}
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+
+	panels, err := readPanels(tx, comicID)
+	if err != nil {
+		return err
+	}
+	for i, p := range panels {
+		if p.Order == i {
+			continue
+		}
+		p.Order = i
+		if err := putJSON(b, panelKey(comicID, p.ID), p); err != nil {
+			return err
+		}
+	}
+	return touchComic(tx, comicID)
+}
+
+// ReorderPanels sets the reading order. panelIDs must list every panel of the
+// comic exactly once.
+func (s *Store) ReorderPanels(comicID string, panelIDs []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		panels, err := readPanels(tx, comicID)
+		if err != nil {
+			return err
+		}
+		if len(panelIDs) != len(panels) {
+			return fmt.Errorf("%w: expected %d panel IDs, got %d", ErrBadOrder, len(panels), len(panelIDs))
+		}
+
+		byID := make(map[string]*Panel, len(panels))
+		for _, p := range panels {
+			byID[p.ID] = p
+		}
+		b := tx.Bucket(bucketPanels)
+		for i, id := range panelIDs {
+			p, ok := byID[id]
+			if !ok {
+				return fmt.Errorf("%w: %q is unknown or repeated", ErrBadOrder, id)
+			}
+			delete(byID, id)
+			p.Order = i
+			if err := putJSON(b, panelKey(comicID, id), p); err != nil {
+				return err
+			}
+		}
+		return touchComic(tx, comicID)
+	})
+}
+
+func publicKey(assetID, shareID string) []byte {
+	return []byte(assetID + "/" + shareID)
+}
+
+// CreateShare publishes a share and the assets it shows.
+func (s *Store) CreateShare(sh *Share) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketOwners).Put(ownerKey(sh.Owner, "share", sh.ID), nil); err != nil {
+			return err
+		}
+		for _, id := range sh.AssetIDs {
+			if err := tx.Bucket(bucketPublic).Put(publicKey(id, sh.ID), nil); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx.Bucket(bucketShares), sh.ID, sh)
+	})
+}
+
+func (s *Store) GetShare(id string) (*Share, error) {
+	var sh Share
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketShares), id, &sh)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sh, nil
+}
+
+// DeleteShare revokes a share. Its assets stop being public unless another
+// share still shows them.
+func (s *Store) DeleteShare(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteShare(tx, id)
+	})
+}
+
+func deleteShare(tx *bolt.Tx, id string) error {
+	b := tx.Bucket(bucketShares)
+	var sh Share
+	if err := getJSON(b, id, &sh); err != nil {
+		return err
+	}
+	for _, assetID := range sh.AssetIDs {
+		if err := tx.Bucket(bucketPublic).Delete(publicKey(assetID, id)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(bucketOwners).Delete(ownerKey(sh.Owner, "share", id)); err != nil {
+		return err
+	}
+	// A revoked share leaves the gallery too.
+	if err := tx.Bucket(bucketGallery).Delete([]byte(id)); err != nil {
+		return err
+	}
+	return b.Delete([]byte(id))
+}
+
+// ListShares returns the shares a session has published, newest first.
+func (s *Store) ListShares(owner string) ([]*Share, error) {
+	var shares []*Share
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketShares)
+		for _, id := range ownedIDs(tx, owner, "share") {
+			var sh Share
+			if err := getJSON(b, id, &sh); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			shares = append(shares, &sh)
+		}
+		return nil
+	})
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.After(shares[j].Created) })
+	return shares, err
+}
+
+// IsPublic reports whether any live share shows the asset.
+func (s *Store) IsPublic(assetID string) bool {
+	public := false
+	s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(assetID + "/")
+		k, _ := tx.Bucket(bucketPublic).Cursor().Seek(prefix)
+		public = k != nil && bytes.HasPrefix(k, prefix)
+		return nil
+	})
+	return public
+}
+
+// SubmitToGallery queues a share for moderation. It returns ErrExists if the
+// share has already been submitted.
+func (s *Store) SubmitToGallery(e *GalleryEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketGallery)
+		if b.Get([]byte(e.ShareID)) != nil {
+			return ErrExists
+		}
+		return putJSON(b, e.ShareID, e)
+	})
+}
+
+func (s *Store) GetGalleryEntry(shareID string) (*GalleryEntry, error) {
+	var e GalleryEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketGallery), shareID, &e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *Store) UpdateGalleryEntry(e *GalleryEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketGallery)
+		if b.Get([]byte(e.ShareID)) == nil {
+			return ErrNotFound
+		}
+		return putJSON(b, e.ShareID, e)
+	})
+}
+
+// ListGallery returns the entries in a moderation state, oldest submission
+// first.
+func (s *Store) ListGallery(status string) ([]*GalleryEntry, error) {
+	var entries []*GalleryEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketGallery).ForEach(func(_, v []byte) error {
+			var e GalleryEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Status == status {
+				entries = append(entries, &e)
+			}
+			return nil
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Submitted.Before(entries[j].Submitted) })
+	return entries, err
+}
+
+func (s *Store) AddPolicyDecision(d *PolicyDecision) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// Zero-padded nanoseconds keep the log in time order; the random
+		// suffix keeps simultaneous decisions apart.
+		key := fmt.Sprintf("%020d/%s", d.Time.UnixNano(), newID())
+		return putJSON(tx.Bucket(bucketPolicyLog), key, d)
+	})
+}
+
+// DeletePolicyDecisions removes the decisions made before cutoff and
+// returns how many there were.
+func (s *Store) DeletePolicyDecisions(cutoff time.Time) (int, error) {
+	var keys [][]byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Keys start with the time, so the old ones come first.
+		b := tx.Bucket(bucketPolicyLog)
+		end := []byte(fmt.Sprintf("%020d/", cutoff.UnixNano()))
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// ListPolicyDecisions returns up to limit decisions, newest first.
+func (s *Store) ListPolicyDecisions(limit int, rejectedOnly bool) ([]*PolicyDecision, error) {
+	var decisions []*PolicyDecision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketPolicyLog).Cursor()
+		for k, v := c.Last(); k != nil && len(decisions) < limit; k, v = c.Prev() {
+			var d PolicyDecision
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if rejectedOnly && d.Allowed {
+				continue
+			}
+			decisions = append(decisions, &d)
+		}
+		return nil
+	})
+	return decisions, err
+}
+
+// GetSetting reads a JSON setting saved with PutSetting.
+func (s *Store) GetSetting(key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketMeta), key, v)
+	})
+}
+
+func (s *Store) PutSetting(key string, v interface{}) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketMeta), key, v)
+	})
+}
+
+// SessionSecret returns the key used to sign session cookies, generating and
+// saving one on first use so sessions survive restarts.
+func (s *Store) SessionSecret() ([]byte, error) {
+	var secret []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta)
+		if existing := b.Get([]byte("session_secret")); existing != nil {
+			secret = append([]byte(nil), existing...)
+			return nil
+		}
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return b.Put([]byte("session_secret"), secret)
+	})
+	return secret, err
+}
+
+func newJobID(started time.Time) string {
+	return fmt.Sprintf("%020d-%s", started.UnixNano(), newID())
+}
+
+// PutJob saves a job, replacing any earlier record of it.
+func (s *Store) PutJob(j *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketJobs), j.ID, j)
+	})
+}
+
+func (s *Store) GetJob(id string) (*Job, error) {
+	var j Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketJobs), id, &j)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// ListJobs returns the jobs started since the given time, newest first.
+func (s *Store) ListJobs(since time.Time) ([]*Job, error) {
+	var jobs []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketJobs).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var j Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			if j.Started.Before(since) {
+				break
+			}
+			jobs = append(jobs, &j)
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// Purge is what PurgeAsset removed along with the asset.
+type Purge struct {
+	Asset *Asset
+	// Panels that showed the asset, deleted from their comics.
+	Panels int
+	// Shares that showed it, taken down along with their gallery entries.
+	Shares int
+}
+
+// PurgeAsset removes an asset from the index, together with the comic
+// panels and share pages that show it, so none is left pointing at a
+// missing file. Panels that were only made from it keep their image and
+// lose the reference. The asset is returned so the caller can delete the
+// file.
+func (s *Store) PurgeAsset(id string) (*Purge, error) {
+	purge := &Purge{Asset: &Asset{}}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAssets)
+		if err := getJSON(b, id, purge.Asset); err != nil {
+			return err
+		}
+		if owner := purge.Asset.Owner; owner != "" {
+			if err := tx.Bucket(bucketOwners).Delete(ownerKey(owner, "asset", id)); err != nil {
+				return err
+			}
+		}
+
+		// Collect first; deleting while iterating skips keys
+		var shareIDs []string
+		prefix := []byte(id + "/")
+		c := tx.Bucket(bucketPublic).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			shareIDs = append(shareIDs, string(k[len(prefix):]))
+		}
+		for _, shareID := range shareIDs {
+			if err := deleteShare(tx, shareID); err != nil {
+				return err
+			}
+		}
+		purge.Shares = len(shareIDs)
+
+		var shown, madeFrom []*Panel
+		err := tx.Bucket(bucketPanels).ForEach(func(k, v []byte) error {
+			var p Panel
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			switch {
+			case p.ComposedID == id:
+				shown = append(shown, &p)
+			case p.FigurineID == id || p.SceneID == id:
+				madeFrom = append(madeFrom, &p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range shown {
+			if err := deletePanel(tx, p.ComicID, p.ID); err != nil {
+				return err
+			}
+		}
+		for _, p := range madeFrom {
+			if p.FigurineID == id {
+				p.FigurineID = ""
+			}
+			if p.SceneID == id {
+				p.SceneID = ""
+			}
+			if err := putJSON(tx.Bucket(bucketPanels), panelKey(p.ComicID, p.ID), p); err != nil {
+				return err
+			}
+		}
+		purge.Panels = len(shown)
+
+		return b.Delete([]byte(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purge, nil
+}
+
+func (s *Store) BanSession(b *Ban) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketBans), b.Session, b)
+	})
+}
+
+func (s *Store) UnbanSession(session string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Delete([]byte(session))
+	})
+}
+
+// IsBanned reports whether a session has been banned.
+func (s *Store) IsBanned(session string) bool {
+	banned := false
+	s.db.View(func(tx *bolt.Tx) error {
+		banned = tx.Bucket(bucketBans).Get([]byte(session)) != nil
+		return nil
+	})
+	return banned
+}
+
+// ListBans returns every banned session, most recent first.
+func (s *Store) ListBans() ([]*Ban, error) {
+	var bans []*Ban
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).ForEach(func(k, v []byte) error {
+			var b Ban
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			bans = append(bans, &b)
+			return nil
+		})
+	})
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.After(bans[j].Created) })
+	return bans, err
+}
+
+// PutStory saves a story, replacing any earlier version of it.
+func (s *Store) PutStory(st *Story) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketOwners).Put(ownerKey(st.Owner, "story", st.ID), nil); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(bucketStories), st.ID, st)
+	})
+}
+
+func (s *Store) GetStory(id string) (*Story, error) {
+	var st Story
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketStories), id, &st)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// ListStories returns the stories a session has started, newest first.
+func (s *Store) ListStories(owner string) ([]*Story, error) {
+	var stories []*Story
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketStories)
+		for _, id := range ownedIDs(tx, owner, "story") {
+			var st Story
+			if err := getJSON(b, id, &st); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			stories = append(stories, &st)
+		}
+		return nil
+	})
+	sort.Slice(stories, func(i, j int) bool { return stories[i].Created.After(stories[j].Created) })
+	return stories, err
+}
+
+// UnfinishedStories returns the stories still planning or running, such as
+// those cut off by a restart.
+func (s *Store) UnfinishedStories() ([]*Story, error) {
+	var stories []*Story
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketStories).ForEach(func(k, v []byte) error {
+			var st Story
+			if err := json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+			if st.Status == StoryPlanning || st.Status == StoryRunning {
+				stories = append(stories, &st)
+			}
+			return nil
+		})
+	})
+	return stories, err
+}
+
+func (s *Store) PutCandidateBatch(b *CandidateBatch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketCandidates), b.ID, b)
+	})
+}
+
+func (s *Store) GetCandidateBatch(id string) (*CandidateBatch, error) {
+	var b CandidateBatch
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketCandidates), id, &b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// ChooseCandidate records that the user picked assetID from the batch and
+// keeps that asset like any other. A batch is chosen from once; picking
+// the same candidate again is allowed, another one fails with ErrExists.
+func (s *Store) ChooseCandidate(batchID, assetID string) (*CandidateBatch, *Asset, error) {
+	var b CandidateBatch
+	var a Asset
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := getJSON(tx.Bucket(bucketCandidates), batchID, &b); err != nil {
+			return err
+		}
+		if !slices.Contains(b.AssetIDs, assetID) {
+			return fmt.Errorf("%w: %s is not a candidate of batch %s", ErrBadAsset, assetID, batchID)
+		}
+		if b.ChosenID != "" {
+			if b.ChosenID != assetID {
+				return ErrExists
+			}
+		} else {
+			b.ChosenID, b.Chosen = assetID, time.Now()
+			if err := putJSON(tx.Bucket(bucketCandidates), b.ID, &b); err != nil {
+				return err
+			}
+		}
+		assets := tx.Bucket(bucketAssets)
+		if err := getJSON(assets, assetID, &a); err != nil {
+			return err
+		}
+		a.Candidate = false
+		return putJSON(assets, a.ID, &a)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &b, &a, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testStore opens a fresh database that is closed when the test ends.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := openStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func panelIDs(t *testing.T, store *Store, comicID string) []string {
+	t.Helper()
+	panels, err := store.Panels(comicID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for i, p := range panels {
+		if p.Order != i {
+			t.Errorf("panel %s has order %d at position %d", p.ID, p.Order, i)
+		}
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestComicPanels(t *testing.T) {
+	store := testStore(t)
+	comic := &Comic{ID: newID(), Owner: "alice", Title: "Banana Quest", Created: time.Now()}
+	if err := store.CreateComic(comic); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.AddPanel(&Panel{ID: id, ComicID: comic.ID, ComposedID: "img-" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AddPanel(&Panel{ID: "x", ComicID: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("adding to a missing comic: %v", err)
+	}
+
+	if err := store.ReorderPanels(comic.ID, []string{"c", "a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := panelIDs(t, store, comic.ID); !slices.Equal(got, []string{"c", "a", "b"}) {
+		t.Errorf("after reorder: %v", got)
+	}
+	for _, order := range [][]string{{"a", "b"}, {"a", "a", "b"}, {"a", "b", "z"}} {
+		if err := store.ReorderPanels(comic.ID, order); !errors.Is(err, ErrBadOrder) {
+			t.Errorf("reorder %v: %v", order, err)
+		}
+	}
+
+	if err := store.DeletePanel(comic.ID, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := panelIDs(t, store, comic.ID); !slices.Equal(got, []string{"c", "b"}) {
+		t.Errorf("after delete: %v", got)
+	}
+
+	if comics, err := store.ListComics("alice"); err != nil || len(comics) != 1 {
+		t.Errorf("ListComics = %v, %v", comics, err)
+	}
+	if err := store.DeleteComic(comic.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ids := panelIDs(t, store, comic.ID); len(ids) != 0 {
+		t.Errorf("panels outlived their comic: %v", ids)
+	}
+	if comics, _ := store.ListComics("alice"); len(comics) != 0 {
+		t.Errorf("deleted comic still listed: %v", comics)
+	}
+}
+
+// testApp is an App with a fresh store, session key and the templates, and
+// no model client.
+func testApp(t *testing.T) *App {
+	t.Helper()
+	templates := template.Must(template.ParseGlob("templates/*.html"))
+	template.Must(templates.ParseGlob("templates/partials/*.html"))
+	return &App{store: testStore(t), sessionSecret: []byte("test secret"), templates: templates}
+}
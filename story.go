@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	minStoryBeats     = 4
+	maxStoryBeats     = 8
+	defaultStoryBeats = 6
+)
+
+// storyStopTimeout is how long shutdown waits for cancelled stories to save
+// their progress.
+const storyStopTimeout = 5 * time.Second
+
+type StoryRequest struct {
+	FigurineID string `json:"figurineId"`
+	Premise    string `json:"premise"`
+	Beats      int    `json:"beats"`
+}
+
+// StoryResponse is a story and how many of its beats are finished.
+type StoryResponse struct {
+	Story     *Story `json:"story,omitempty"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// storyPlan is the JSON the story stage asks the model for.
+type storyPlan struct {
+	Title string `json:"title"`
+	Beats []struct {
+		Theme    string `json:"theme"`
+		Lighting string `json:"lighting"`
+		Prompt   string `json:"prompt"`
+		Caption  string `json:"caption"`
+	} `json:"beats"`
+}
+
+// apiStoriesHandler starts a story (POST) from a figurine and a one-line
+// premise. Generating every panel takes minutes, longer than a request may
+// run, so it happens in the background and the client polls
+// /api/stories/{id} for progress.
+func (app *App) apiStoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, StoryResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req StoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, StoryResponse{Error: "Invalid JSON body"})
+		return
+	}
+	if req.Beats == 0 {
+		req.Beats = defaultStoryBeats
+	}
+	if req.Beats < minStoryBeats || req.Beats > maxStoryBeats {
+		writeJSON(w, http.StatusBadRequest, StoryResponse{Error: fmt.Sprintf("A story has %d to %d panels", minStoryBeats, maxStoryBeats)})
+		return
+	}
+	if _, err := app.checkAsset(r.Context(), req.FigurineID, AssetFigurine); err != nil {
+		writeJSON(w, http.StatusBadRequest, StoryResponse{Error: "A figurine you created is required"})
+		return
+	}
+	cleaned, err := app.checkPrompt(r.Context(), SourceUser, StageStory, promptField{"premise", req.Premise})
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, StoryResponse{Error: userMessage(err, "Invalid premise")})
+		return
+	}
+
+	// One story at a time per session keeps a single visitor from tying up
+	// the image model
+	stories, err := app.store.ListStories(sessionID(r.Context()))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list stories", "err", err)
+		writeJSON(w, http.StatusInternalServerError, StoryResponse{Error: "Failed to start story"})
+		return
+	}
+	for _, st := range stories {
+		if st.Status == StoryPlanning || st.Status == StoryRunning {
+			writeJSON(w, http.StatusConflict, StoryResponse{Story: st, Error: "You already have a story in progress"})
+			return
+		}
+	}
+
+	now := time.Now()
+	story := &Story{
+		ID:         newID(),
+		Owner:      sessionID(r.Context()),
+		Premise:    cleaned[0],
+		FigurineID: req.FigurineID,
+		BeatCount:  req.Beats,
+		Status:     StoryPlanning,
+		Created:    now,
+		Updated:    now,
+	}
+	if err := app.store.PutStory(story); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save story", "err", err)
+		writeJSON(w, http.StatusInternalServerError, StoryResponse{Error: "Failed to start story"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Story started", "story_id", story.ID, "beats", story.BeatCount, "premise", userText(story.Premise))
+
+	// Keep the request's session, ID and trace, but not its cancellation
+	app.stories.run(context.WithoutCancel(r.Context()), func(ctx context.Context) { app.runStory(ctx, story) })
+
+	writeJSON(w, http.StatusAccepted, storyResponse(story))
+}
+
+// apiStoryHandler reports a story's progress.
+func (app *App) apiStoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, StoryResponse{Error: "Method not allowed"})
+		return
+	}
+	story, err := app.store.GetStory(r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && !ownedBy(r.Context(), story.Owner)) {
+		writeJSON(w, http.StatusNotFound, StoryResponse{Error: "Story not found"})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load story", "err", err)
+		writeJSON(w, http.StatusInternalServerError, StoryResponse{Error: "Failed to load story"})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, storyResponse(story))
+}
+
+func storyResponse(story *Story) StoryResponse {
+	resp := StoryResponse{Story: story, Total: story.BeatCount, Success: true}
+	if len(story.Beats) > 0 {
+		resp.Total = len(story.Beats)
+	}
+	for _, b := range story.Beats {
+		if b.Status == BeatDone || b.Status == BeatFailed {
+			resp.Completed++
+		}
+	}
+	return resp
+}
+
+// resumeStories picks up the stories a restart interrupted. Finished beats
+// are kept, so each resumes at the beat it was on.
+func (app *App) resumeStories(ctx context.Context) {
+	stories, err := app.store.UnfinishedStories()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list unfinished stories", "err", err)
+		return
+	}
+	for _, story := range stories {
+		slog.InfoContext(ctx, "Resuming story", "story_id", story.ID, "status", story.Status)
+		app.stories.run(context.WithValue(ctx, sessionKey, story.Owner), func(ctx context.Context) { app.runStory(ctx, story) })
+	}
+}
+
+// storyRunner tracks the stories running in the background, so shutdown
+// can stop them before the store is closed. A stopped story keeps its
+// status and resumes on the next start.
+type storyRunner struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	stopping context.Context
+	stopAll  context.CancelFunc
+}
+
+func (s *storyRunner) init() {
+	if s.stopping == nil {
+		s.stopping, s.stopAll = context.WithCancel(context.Background())
+	}
+}
+
+// run calls fn in a new goroutine with a context that stop cancels. After
+// stop it does nothing.
+func (s *storyRunner) run(ctx context.Context, fn func(context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if s.stopping.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stopCancel := context.AfterFunc(s.stopping, cancel)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		defer stopCancel()
+		fn(ctx)
+	}()
+}
+
+// stop cancels the running stories and waits up to timeout for them to
+// return. It reports whether they all did.
+func (s *storyRunner) stop(timeout time.Duration) bool {
+	s.mu.Lock()
+	s.init()
+	s.stopAll()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// runStory plans the story if needed, then generates a scene, composes the
+// figurine into it and adds the result to the story's comic, one beat at a
+// time. The story is saved after every step so progress can be polled. A
+// failed beat is recorded and skipped; the story only fails when planning
+// does or no beat succeeds.
+func (app *App) runStory(ctx context.Context, story *Story) {
+	ctx, span := tracer.Start(ctx, "story", trace.WithAttributes(
+		attribute.String("bananaverse.story_id", story.ID),
+		attribute.Int("bananaverse.beats", story.BeatCount),
+	))
+	defer span.End()
+
+	save := func() {
+		story.Updated = time.Now()
+		if err := app.store.PutStory(story); err != nil {
+			slog.ErrorContext(ctx, "Failed to save story progress", "story_id", story.ID, "err", err)
+		}
+	}
+
+	if story.Status == StoryPlanning {
+		if err := app.planStory(ctx, story); err != nil {
+			if ctx.Err() != nil {
+				slog.InfoContext(ctx, "Story interrupted, it resumes on restart", "story_id", story.ID)
+				return
+			}
+			slog.ErrorContext(ctx, "Story planning failed", "story_id", story.ID, "err", err)
+			span.SetStatus(codes.Error, err.Error())
+			story.Status = StoryFailed
+			story.Error = userMessage(err, "Failed to plan the story")
+			save()
+			return
+		}
+		story.Status = StoryRunning
+		save()
+	}
+
+	succeeded := 0
+	for i := range story.Beats {
+		beat := &story.Beats[i]
+		if beat.Status != BeatDone && beat.Status != BeatFailed {
+			if err := app.runBeat(ctx, story, beat, save); err != nil {
+				// Shutting down isn't the beat's fault; leave it to resume
+				if ctx.Err() != nil {
+					slog.InfoContext(ctx, "Story interrupted, it resumes on restart", "story_id", story.ID, "beat", i)
+					return
+				}
+				slog.ErrorContext(ctx, "Story beat failed", "story_id", story.ID, "beat", i, "err", err)
+				beat.Status = BeatFailed
+				beat.Error = userMessage(err, "Failed to generate this panel")
+				save()
+			}
+		}
+		if beat.Status == BeatDone {
+			succeeded++
+		}
+	}
+
+	story.Status = StoryDone
+	if succeeded == 0 {
+		story.Status = StoryFailed
+		story.Error = "None of the panels could be generated"
+		span.SetStatus(codes.Error, story.Error)
+	}
+	save()
+	slog.InfoContext(ctx, "Story finished", "story_id", story.ID, "status", story.Status, "panels", succeeded)
+}
+
+// planStory asks the model for the story's beats, vets them like any other
+// model text and creates the comic they will fill.
+func (app *App) planStory(ctx context.Context, story *Story) error {
+	ctx, job := app.startJob(ctx, StageStory, map[string]string{"premise": story.Premise, "beats": fmt.Sprint(story.BeatCount)})
+	plan, err := app.generateStoryPlan(ctx, story.Premise, story.BeatCount)
+	app.finishJob(ctx, job, err)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range plan.Beats {
+		cleaned, err := app.checkPrompt(ctx, SourceModel, StageStory,
+			promptField{"theme", b.Theme}, promptField{"lighting", b.Lighting},
+			promptField{"prompt", b.Prompt}, promptField{"caption", b.Caption})
+		if err != nil {
+			continue
+		}
+		story.Beats = append(story.Beats, StoryBeat{
+			Theme:    cleaned[0],
+			Lighting: cleaned[1],
+			Prompt:   cleaned[2],
+			Caption:  cleaned[3],
+			Status:   BeatPending,
+		})
+		if len(story.Beats) == story.BeatCount {
+			break
+		}
+	}
+	if len(story.Beats) < minStoryBeats {
+		return fmt.Errorf("only %d usable beats in the story plan", len(story.Beats))
+	}
+
+	story.Title = "BananaVerse Story"
+	if title, err := app.policy.check(promptField{"title", plan.Title}); err == nil {
+		story.Title = title
+	}
+	now := time.Now()
+	comic := &Comic{ID: newID(), Owner: story.Owner, Title: story.Title, Created: now, Updated: now}
+	if err := app.store.CreateComic(comic); err != nil {
+		return fmt.Errorf("failed to create comic: %v", err)
+	}
+	story.ComicID = comic.ID
+	return nil
+}
+
+// generateStoryPlan asks the text model to break the premise into beats.
+func (app *App) generateStoryPlan(ctx context.Context, premise string, beats int) (*storyPlan, error) {
+	prompt := fmt.Sprintf(`Plan a short comic adventure for a toy figurine in exactly %d panels, based on this premise: %q.
+The panels should tell one story with a beginning, a turning point and an ending.
+Reply with JSON only, in this form:
+{"title": "short comic title", "beats": [{"theme": "setting-in-kebab-case", "lighting": "lighting-in-kebab-case", "prompt": "what happens in this panel, one sentence", "caption": "witty caption under 10 words"}]}
+Use only letters, numbers, spaces and basic punctuation, no emoji. Keep it family friendly.`, beats, premise)
+
+	var plan storyPlan
+	if err := app.generateJSON(ctx, StageStory, &plan, genai.Text(prompt)); err != nil {
+		return nil, fmt.Errorf("story planning failed: %w", err)
+	}
+	slog.DebugContext(ctx, "Story plan", "title", userText(plan.Title), "beats", len(plan.Beats))
+	return &plan, nil
+}
+
+// runBeat generates one beat's scene and composite and adds it to the
+// comic, calling save after each step. Steps already done on an earlier run
+// are skipped. The panel ID is saved before the panel is added, so a run
+// interrupted in between doesn't add the panel twice.
+func (app *App) runBeat(ctx context.Context, story *Story, beat *StoryBeat, save func()) error {
+	if beat.SceneID == "" {
+		ctx, job := app.startJob(ctx, StageScene, map[string]string{"theme": beat.Theme, "lighting": beat.Lighting, "prompt": beat.Prompt})
+		scenes, err := app.generateScene(ctx, beat.Theme, beat.Lighting, beat.Prompt, 1)
+		app.finishJob(ctx, job, err)
+		if err != nil {
+			return err
+		}
+		beat.SceneID = scenes[0].ID
+		beat.Status = BeatComposing
+		save()
+	}
+
+	if beat.ComposedID == "" {
+		ctx, job := app.startJob(ctx, StageCompose, map[string]string{"figurineId": story.FigurineID, "backgroundId": beat.SceneID})
+		composed, _, err := app.composeScene(ctx, story.FigurineID, beat.SceneID)
+		app.finishJob(ctx, job, err)
+		if err != nil {
+			return err
+		}
+		beat.ComposedID = composed.ID
+		beat.ImageURL = composed.URL()
+	}
+
+	if beat.PanelID == "" {
+		beat.PanelID = newID()
+		save()
+	}
+	_, err := app.store.GetPanel(story.ComicID, beat.PanelID)
+	if errors.Is(err, ErrNotFound) {
+		err = app.store.AddPanel(&Panel{
+			ID:         beat.PanelID,
+			ComicID:    story.ComicID,
+			Caption:    beat.Caption,
+			FigurineID: story.FigurineID,
+			SceneID:    beat.SceneID,
+			ComposedID: beat.ComposedID,
+			Created:    time.Now(),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add panel: %v", err)
+	}
+	beat.Status = BeatDone
+	save()
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunBeatAddsPanelOnce(t *testing.T) {
+	app := testApp(t)
+	comic := &Comic{ID: newID(), Owner: "alice", Created: time.Now()}
+	if err := app.store.CreateComic(comic); err != nil {
+		t.Fatal(err)
+	}
+	story := &Story{ID: newID(), Owner: "alice", FigurineID: "fig", ComicID: comic.ID, Status: StoryRunning}
+	// Scene and composite are done, so no model calls are needed
+	beat := &StoryBeat{Caption: "Off we go", SceneID: "scene", ComposedID: "composed", Status: BeatComposing}
+	var saved []string
+	save := func() { saved = append(saved, beat.PanelID) }
+
+	if err := app.runBeat(context.Background(), story, beat, save); err != nil {
+		t.Fatal(err)
+	}
+	if beat.Status != BeatDone || beat.PanelID == "" {
+		t.Fatalf("beat = %+v", beat)
+	}
+	if len(saved) == 0 || saved[0] != beat.PanelID {
+		t.Errorf("panel ID wasn't saved before the panel was added: %v", saved)
+	}
+
+	// A restart after the panel was added but before the beat was marked
+	// done runs the beat again
+	beat.Status = BeatComposing
+	if err := app.runBeat(context.Background(), story, beat, save); err != nil {
+		t.Fatal(err)
+	}
+	panels, err := app.store.Panels(comic.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(panels) != 1 || panels[0].ID != beat.PanelID || panels[0].ComposedID != "composed" || panels[0].Caption != "Off we go" {
+		t.Errorf("panels = %v", panelIDs(t, app.store, comic.ID))
+	}
+}
+
+func TestStoryRunnerStop(t *testing.T) {
+	var s storyRunner
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	s.run(context.Background(), func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	})
+	<-started
+	if !s.stop(time.Second) {
+		t.Fatal("stop timed out")
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("stop returned before the story did")
+	}
+
+	ran := false
+	s.run(context.Background(), func(ctx context.Context) { ran = true })
+	if !s.stop(time.Second) || ran {
+		t.Error("story started after stop")
+	}
+
+	var stuck storyRunner
+	release := make(chan struct{})
+	defer close(release)
+	stuck.run(context.Background(), func(ctx context.Context) { <-release })
+	if stuck.stop(10 * time.Millisecond) {
+		t.Error("stop didn't time out on a story that ignores cancellation")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.32.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("bananaverse")
+
+// promptVersions identifies the prompt template each stage sends, so traces
+// from before and after a prompt change can be told apart. Bump a stage's
+// version whenever its prompt is edited.
+var promptVersions = map[string]string{
+	StageAnalysis:   "1",
+	StageFigurine:   "1",
+	StageScene:      "1",
+	StageCompose:    "2",
+	StageCaption:    "1",
+	StageAdventures: "1",
+	StageStory:      "1",
+	StageCharacter:  "1",
+	StageDrift:      "1",
+	StageRefine:     "1",
+	StageSceneEdit:  "1",
+	StageVerify:     "1",
+}
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// (or the traces-specific variant) is set, for example to a local collector
+// at http://localhost:4318. Otherwise spans are dropped. The returned
+// function flushes buffered spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("bananaverse")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// withTracing starts a server span for each request, named after the route
+// once the mux has matched it. Spans carry a tag derived from the session,
+// so one visitor's requests can be found together, and withMetrics must sit
+// inside it so the route is set on the request this sees.
+func (app *App) withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("bananaverse.request_id", requestID(ctx)),
+				attribute.String("bananaverse.session", app.sessionTag(ctx)),
+			))
+		defer span.End()
+
+		r = r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// sessionTag identifies the session in traces without exposing the ID that
+// the session cookie carries.
+func (app *App) sessionTag(ctx context.Context) string {
+	id := sessionID(ctx)
+	if id == "" {
+		return ""
+	}
+	return app.signSession("trace:" + id)[:16]
+}
+
+// traceRef records the current span so that later requests using what it
+// produced can link back to it.
+func traceRef(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String() + "-" + sc.SpanID().String()
+}
+
+// linkAsset links the current span to the span that created a, so a panel's
+// trace leads back through composition to the upload and scene requests.
+func linkAsset(ctx context.Context, a *Asset) {
+	traceID, spanID, ok := strings.Cut(a.Trace, "-")
+	if !ok {
+		return
+	}
+	tid, err := trace.TraceIDFromHex(traceID)
+	if err != nil {
+		return
+	}
+	sid, err := trace.SpanIDFromHex(spanID)
+	if err != nil {
+		return
+	}
+	trace.SpanFromContext(ctx).AddLink(trace.Link{
+		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: tid, SpanID: sid, TraceFlags: trace.FlagsSampled, Remote: true}),
+		Attributes: []attribute.KeyValue{
+			attribute.String("bananaverse.asset_id", a.ID),
+			attribute.String("bananaverse.asset_kind", a.Kind),
+		},
+	})
+}
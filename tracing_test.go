@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.32.0"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     = tracetest.NewSpanRecorder()
+)
+
+// recordSpans routes the package tracer to an in-memory recorder. The
+// global provider can only be installed once, so tests share it.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+func TestEveryStageHasPromptVersion(t *testing.T) {
+	for _, stage := range safetyStages {
+		if promptVersions[stage] == "" {
+			t.Errorf("%s has no prompt version", stage)
+		}
+	}
+}
+
+func TestWithTracingNamesSpansByRoute(t *testing.T) {
+	rec := recordSpans()
+	app := &App{sessionSecret: []byte("test secret")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/comics/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	handler := app.withTracing(mux)
+
+	r := asSession(httptest.NewRequest(http.MethodGet, "/api/comics/abc", nil), "alice-session-id")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var found bool
+	for _, span := range rec.Ended() {
+		if span.Name() != "GET /api/comics/{id}" {
+			continue
+		}
+		found = true
+		if span.Status().Code != codes.Error {
+			t.Errorf("500 response left span status %v", span.Status())
+		}
+		attrs := map[string]string{}
+		for _, kv := range span.Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		if attrs[string(semconv.HTTPRouteKey)] != "/api/comics/{id}" {
+			t.Errorf("route attribute %q", attrs[string(semconv.HTTPRouteKey)])
+		}
+		tag := attrs["bananaverse.session"]
+		if tag == "" || strings.Contains(tag, "alice") || tag != app.sessionTag(r.Context()) {
+			t.Errorf("session tag %q", tag)
+		}
+	}
+	if !found {
+		t.Error("no span named after the route")
+	}
+}
+
+func TestLinkAssetToCreatingSpan(t *testing.T) {
+	rec := recordSpans()
+	ctx, creator := tracer.Start(context.Background(), "create scene")
+	asset := &Asset{ID: "abc", Kind: AssetScene, Trace: traceRef(ctx)}
+	creator.End()
+
+	ctx, user := tracer.Start(context.Background(), "compose")
+	linkAsset(ctx, asset)
+	linkAsset(ctx, &Asset{ID: "old", Trace: "not-a-trace"})
+	user.End()
+
+	for _, span := range rec.Ended() {
+		if span.Name() != "compose" || span.SpanContext().SpanID() != user.SpanContext().SpanID() {
+			continue
+		}
+		links := span.Links()
+		if len(links) != 1 || links[0].SpanContext.SpanID() != creator.SpanContext().SpanID() {
+			t.Errorf("got links %+v, want one to the creating span", links)
+		}
+		return
+	}
+	t.Error("compose span not recorded")
+}
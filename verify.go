@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxComposeAttempts is how many times a composition is generated before
+// the best attempt is kept anyway.
+const maxComposeAttempts = 3
+
+// composeBudget bounds all the attempts at a composition, verification
+// included. Once it is spent the best attempt so far is kept.
+const composeBudget = 150 * time.Second
+
+// verifyPassScore is the lowest verification score kept without retrying.
+const verifyPassScore = 60
+
+const verifyPrompt = `Image 1 is a background scene and image 2 is a toy figurine. Image 3 should show that figurine placed into that scene.
+Check image 3: is the figurine from image 2 in it, rather than just the background or a different character? Is it at a believable scale for its surroundings and standing on something rather than floating? Do its lighting, color temperature and shadows match the scene?
+Reply with JSON only: {"figurine": true or false, "scale": 0-100 where 100 means perfectly in proportion, "lighting": 0-100 where 100 means perfectly matched, "problems": "short list of what is wrong"}`
+
+// composeHints are added to the composition prompt on a retry, by what was
+// wrong with the last attempt. The model's own description of the problems
+// is only logged, never put into a prompt.
+var composeHints = map[string]string{
+	"no_image": "Reply with the combined image.",
+	"missing":  "The figurine from image 2 must be clearly visible in the scene as its main subject; do not return the background alone or draw a different character.",
+	"scale":    "Scale the figurine so it is in proportion with its surroundings, standing on the ground or a surface rather than floating.",
+	"lighting": "Relight the figurine to match the scene: same light direction, color temperature and shadow softness, with a contact shadow where it stands.",
+}
+
+// compositionReport is the JSON the verify stage asks the model for.
+type compositionReport struct {
+	Figurine bool   `json:"figurine"`
+	Scale    int    `json:"scale"`
+	Lighting int    `json:"lighting"`
+	Problems string `json:"problems"`
+}
+
+// Score sums the report up from 0 to 100: 0 when the figurine is missing,
+// otherwise the weaker of its scale and lighting scores.
+func (r *compositionReport) Score() int {
+	if !r.Figurine {
+		return 0
+	}
+	return min(max(min(r.Scale, r.Lighting), 0), 100)
+}
+
+// retryReasons lists what to fix on the next attempt, as composeHints keys.
+func (r *compositionReport) retryReasons() []string {
+	if !r.Figurine {
+		return []string{"missing"}
+	}
+	var reasons []string
+	if r.Scale < verifyPassScore {
+		reasons = append(reasons, "scale")
+	}
+	if r.Lighting < verifyPassScore {
+		reasons = append(reasons, "lighting")
+	}
+	return reasons
+}
+
+// verifyComposition asks a vision model whether a composite shows the
+// figurine, and how believable its scale and lighting are, and records the
+// score as a metric and on the current span.
+func (app *App) verifyComposition(ctx context.Context, backgroundData, figurineData, compositeData []byte) (*compositionReport, error) {
+	var report compositionReport
+	err := app.generateJSON(ctx, StageVerify, &report,
+		genai.Text(verifyPrompt),
+		genai.ImageData("png", backgroundData),
+		genai.ImageData("png", figurineData),
+		genai.ImageData("png", compositeData),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("composition check failed: %w", err)
+	}
+
+	score := report.Score()
+	compositionVerification.Observe(float64(score))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("bananaverse.verification", score))
+	slog.InfoContext(ctx, "Composition verified", "score", score, "figurine", report.Figurine, "scale", report.Scale, "lighting", report.Lighting, "problems", userText(report.Problems))
+	return &report, nil
+}
+
+// composeVerified generates compositions with generate and checks each
+// with verify, retrying with hints for what went wrong until one passes or
+// maxComposeAttempts are made, and returns the best. generate returns nil
+// data when the model replied without an image. composed gets the number of
+// attempts and the best score, which stays nil when the check itself failed.
+func composeVerified(ctx context.Context, composed *Asset, prompt string,
+	generate func(ctx context.Context, prompt string) ([]byte, error),
+	verify func(ctx context.Context, data []byte) (*compositionReport, error),
+) ([]byte, error) {
+	// Attempts share a budget, so retries can't outlast the request
+	attemptCtx, cancel := context.WithTimeout(ctx, composeBudget)
+	defer cancel()
+
+	var best []byte
+	var retryReasons []string
+	for attempt := 1; attempt <= maxComposeAttempts; attempt++ {
+		composed.Attempts = attempt
+		data, err := generate(attemptCtx, composeWithHints(prompt, retryReasons))
+		if err != nil {
+			// A retry that fails outright still leaves the earlier attempt
+			if best != nil {
+				slog.WarnContext(ctx, "Composition retry failed, keeping the best attempt", "attempt", attempt, "err", err)
+				break
+			}
+			return nil, fmt.Errorf("composition generation failed: %w", err)
+		}
+
+		if len(data) == 0 {
+			retryReasons = []string{"no_image"}
+		} else {
+			slog.InfoContext(ctx, "Generated composition", "bytes", len(data), "attempt", attempt)
+			report, err := verify(attemptCtx, data)
+			if err != nil {
+				// An unverified composite is still better than none
+				slog.WarnContext(ctx, "Composition check failed", "err", err)
+				if best == nil {
+					best = data
+				}
+				break
+			}
+			score := report.Score()
+			if composed.Verification == nil || score > *composed.Verification {
+				best, composed.Verification = data, &score
+			}
+			if score >= verifyPassScore {
+				break
+			}
+			retryReasons = report.retryReasons()
+		}
+		if attempt < maxComposeAttempts {
+			for _, reason := range retryReasons {
+				compositionRetries.WithLabelValues(reason).Inc()
+			}
+			slog.InfoContext(ctx, "Retrying composition", "attempt", attempt, "reasons", retryReasons)
+		}
+	}
+	if len(best) == 0 {
+		return nil, errors.New("no composed image generated")
+	}
+	return best, nil
+}
+
+// composeWithHints adds the hints for the given reasons to a composition
+// prompt.
+func composeWithHints(prompt string, reasons []string) string {
+	for _, reason := range reasons {
+		prompt += " " + composeHints[reason]
+	}
+	return prompt
+}
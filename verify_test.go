@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompositionReport(t *testing.T) {
+	tests := []struct {
+		report  compositionReport
+		score   int
+		reasons []string
+	}{
+		{compositionReport{Figurine: true, Scale: 90, Lighting: 75}, 75, nil},
+		{compositionReport{Figurine: true, Scale: 40, Lighting: 80}, 40, []string{"scale"}},
+		{compositionReport{Figurine: true, Scale: 59, Lighting: 10}, 10, []string{"scale", "lighting"}},
+		{compositionReport{Figurine: true, Scale: verifyPassScore, Lighting: verifyPassScore}, verifyPassScore, nil},
+		{compositionReport{Figurine: false, Scale: 100, Lighting: 100}, 0, []string{"missing"}},
+		// Out-of-range scores from the model are clamped
+		{compositionReport{Figurine: true, Scale: 150, Lighting: 120}, 100, nil},
+		{compositionReport{Figurine: true, Scale: -5, Lighting: 80}, 0, []string{"scale"}},
+	}
+	for _, tt := range tests {
+		if got := tt.report.Score(); got != tt.score {
+			t.Errorf("%+v: score %d, want %d", tt.report, got, tt.score)
+		}
+		if got := tt.report.retryReasons(); !slices.Equal(got, tt.reasons) {
+			t.Errorf("%+v: reasons %v, want %v", tt.report, got, tt.reasons)
+		}
+	}
+}
+
+func TestComposeWithHints(t *testing.T) {
+	if got := composeWithHints("Compose.", nil); got != "Compose." {
+		t.Errorf("no reasons: %q", got)
+	}
+	got := composeWithHints("Compose.", []string{"scale", "lighting"})
+	if !strings.HasPrefix(got, "Compose. ") || !strings.Contains(got, composeHints["scale"]) || !strings.HasSuffix(got, composeHints["lighting"]) {
+		t.Errorf("with hints: %q", got)
+	}
+	for reason := range composeHints {
+		if composeHints[reason] == "" {
+			t.Errorf("empty hint for %s", reason)
+		}
+	}
+}
+
+// fakeCompose plays back generated images and their scores in order; a nil
+// image is a reply without one, and an error in errs fails that attempt.
+type fakeCompose struct {
+	images  [][]byte
+	scores  []int
+	errs    []error
+	prompts []string
+}
+
+func (f *fakeCompose) generate(ctx context.Context, prompt string) ([]byte, error) {
+	n := len(f.prompts)
+	f.prompts = append(f.prompts, prompt)
+	if n < len(f.errs) && f.errs[n] != nil {
+		return nil, f.errs[n]
+	}
+	return f.images[n], nil
+}
+
+func (f *fakeCompose) verify(ctx context.Context, data []byte) (*compositionReport, error) {
+	for i, image := range f.images {
+		if bytes.Equal(image, data) {
+			score := f.scores[i]
+			return &compositionReport{Figurine: true, Scale: score, Lighting: score}, nil
+		}
+	}
+	return nil, errors.New("unknown image")
+}
+
+func TestComposeVerified(t *testing.T) {
+	low := verifyPassScore - 30
+	tests := []struct {
+		name     string
+		fake     fakeCompose
+		want     string
+		score    int
+		attempts int
+	}{
+		{
+			name:     "retries on no image",
+			fake:     fakeCompose{images: [][]byte{nil, []byte("b")}, scores: []int{0, verifyPassScore}},
+			want:     "b",
+			score:    verifyPassScore,
+			attempts: 2,
+		},
+		{
+			name:     "keeps the best of low scores",
+			fake:     fakeCompose{images: [][]byte{[]byte("a"), []byte("b"), []byte("c")}, scores: []int{low, low + 20, low + 10}},
+			want:     "b",
+			score:    low + 20,
+			attempts: maxComposeAttempts,
+		},
+		{
+			name:     "stops at the pass score",
+			fake:     fakeCompose{images: [][]byte{[]byte("a"), []byte("b"), []byte("c")}, scores: []int{verifyPassScore, 100, 100}},
+			want:     "a",
+			score:    verifyPassScore,
+			attempts: 1,
+		},
+		{
+			name:     "keeps the earlier attempt when a retry fails",
+			fake:     fakeCompose{images: [][]byte{[]byte("a"), nil}, scores: []int{low, 0}, errs: []error{nil, errors.New("quota")}},
+			want:     "a",
+			score:    low,
+			attempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			composed := &Asset{}
+			got, err := composeVerified(context.Background(), composed, "Compose.", tt.fake.generate, tt.fake.verify)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("kept %q, want %q", got, tt.want)
+			}
+			if composed.Verification == nil || *composed.Verification != tt.score {
+				t.Errorf("verification %v, want %d", composed.Verification, tt.score)
+			}
+			if composed.Attempts != tt.attempts {
+				t.Errorf("attempts %d, want %d", composed.Attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestComposeVerifiedHintsRetries(t *testing.T) {
+	fake := fakeCompose{images: [][]byte{nil, []byte("b")}, scores: []int{0, verifyPassScore}}
+	if _, err := composeVerified(context.Background(), &Asset{}, "Compose.", fake.generate, fake.verify); err != nil {
+		t.Fatal(err)
+	}
+	if fake.prompts[0] != "Compose." || fake.prompts[1] != composeWithHints("Compose.", []string{"no_image"}) {
+		t.Errorf("prompts %q", fake.prompts)
+	}
+}
+
+func TestComposeVerifiedFails(t *testing.T) {
+	blank := fakeCompose{images: make([][]byte, maxComposeAttempts), scores: make([]int, maxComposeAttempts)}
+	composed := &Asset{}
+	_, err := composeVerified(context.Background(), composed, "Compose.", blank.generate, blank.verify)
+	if err == nil || err.Error() != "no composed image generated" {
+		t.Errorf("all blank: %v", err)
+	}
+	if composed.Attempts != maxComposeAttempts || composed.Verification != nil {
+		t.Errorf("all blank: attempts %d, verification %v", composed.Attempts, composed.Verification)
+	}
+
+	failing := fakeCompose{images: [][]byte{nil}, scores: []int{0}, errs: []error{errors.New("quota")}}
+	if _, err := composeVerified(context.Background(), &Asset{}, "Compose.", failing.generate, failing.verify); err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Errorf("first attempt failing: %v", err)
+	}
+}